@@ -1,178 +1,242 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
-	"net/rpc"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gocql/gocql"
-
 	"github.com/johananl/simple-cm/master"
-	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/tlsconfig"
+	"github.com/johananl/simple-cm/transport"
 	"github.com/johananl/simple-cm/worker"
 )
 
-// Formats a script's output for visual clarity.
-func formatScriptOutput(s string) string {
-	return "===================================================================\n" +
-		s +
-		"===================================================================\n"
+// Imports the CQL seed file at path into the given store.
+func seed(store master.Store, path string) error {
+	w, ok := store.(master.InventoryWriter)
+	if !ok {
+		return fmt.Errorf("the DB driver doesn't support seeding")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening seed file: %v", err)
+	}
+	defer f.Close()
+
+	n, err := master.ImportCQL(w, f)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d rows from %s", n, path)
+
+	return nil
+}
+
+// Runs the master as a long-running service which exposes an HTTP API. If tlsConfig isn't nil, the
+// API is served over TLS and clients may authenticate using a certificate signed by its CA.
+func serve(m *master.Master, addr string, defaults master.RunSpec, workerTTL time.Duration, tlsConfig *tls.Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	api := master.NewAPI(ctx, m, defaults)
+	api.RegistrationToken = os.Getenv(worker.RegistrationTokenEnv)
+	if api.RegistrationToken == "" && tlsConfig == nil {
+		log.Printf("WARNING: Neither %s nor TLS is set. Workers can't register", worker.RegistrationTokenEnv)
+	}
+
+	// Remove registered workers which stopped sending heartbeats
+	go m.ExpireWorkersPeriodically(ctx, workerTTL)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	server := http.Server{Addr: addr, Handler: api}
+	if tlsConfig != nil {
+		// Clients other than workers, such as curl, don't need a certificate.
+		server.TLSConfig = tlsConfig.Clone()
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Listening for API requests on %s", addr)
+
+	<-stop
+	log.Println("Shutting down")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+
+	// Cancel in-progress runs and wait for the workers to stop executing their operations.
+	cancel()
+	api.Wait()
+	log.Printf("Graceful shutdown complete")
 }
 
 func main() {
-	concurrency := flag.Int("c", 10, "Specify the maximum number of concurrent host connections")
-	sshKeysPath := flag.String("ssh-keys-dir", "/etc/simple-cm/keys", "Directory to look for SSH keys in")
+	// The "serve" subcommand runs the master as a service. Without it, the master executes a
+	// single run and exits.
+	args := os.Args[1:]
+	serveMode := len(args) > 0 && args[0] == "serve"
+	if serveMode {
+		args = args[1:]
+	}
+
+	concurrency := flag.Int("c", master.DefaultConcurrency, "Specify the maximum number of concurrent host connections")
+	dbDriver := flag.String("db-driver", master.DriverCassandra, "DB driver to use: cassandra, bolt (embedded, file-based) or memory")
 	dbHostsFlag := flag.String("db-hosts", "127.0.0.1", "A comma-separated list of DB nodes to connect to")
 	dbKeyspace := flag.String("db-keyspace", "simplecm", "Cassandra keyspace to use")
-	workersFlag := flag.String("workers", "127.0.0.1:8888", "A comma-separated list of workers to connect to, in a <host>:<port> format")
-	flag.Parse()
+	dbPath := flag.String("db-path", "/var/lib/simple-cm/simplecm.db", "Path of the DB file when using the bolt driver")
+	dbSeed := flag.String("db-seed", "", "CQL seed file to import hosts and operations from when using the bolt or memory driver. Ignored if the DB already contains hosts")
+	maxOutputSize := flag.Int("max-output-size", 64*1024, "Maximum number of bytes of stdout and of stderr to store for each operation result. 0 means no limit")
+	workersFlag := flag.String("workers", "127.0.0.1:8888", "A comma-separated list of workers to connect to, in a <host>:<port> format. May be empty in serve mode, where workers can register with the master")
+	workerSelection := flag.String("worker-selection", master.SelectRoundRobin, "Policy for selecting the worker which executes the operations of a host: round-robin, least-outstanding, random or consistent-hash")
+	listen := flag.String("listen", ":8080", "Address to serve the HTTP API on (serve mode only)")
+	trustOnFirstUse := flag.Bool("trust-on-first-use", false, "Accept the SSH host key of hosts which have no pinned host key fingerprint and aren't in the worker's known_hosts file, and pin the key in the DB")
+	maxAttempts := flag.Int("max-attempts", master.DefaultMaxAttempts, "Maximum number of workers to send a host's operations to when workers fail")
+	healthCheckInterval := flag.Duration("health-check-interval", 10*time.Second, "Interval between worker health checks. Unresponsive workers are removed and reconnected once they recover")
+	transportFlag := flag.String("transport", transport.RPC, "Transport to use for connecting to workers: rpc or stream. Must match the workers' transport")
+	tlsCert := flag.String("tls-cert", "", "PEM-encoded TLS certificate to present to workers and to serve the HTTP API with. Enables TLS together with -tls-key and -tls-ca")
+	tlsKey := flag.String("tls-key", "", "PEM-encoded private key of the TLS certificate")
+	tlsCA := flag.String("tls-ca", "", "PEM-encoded certificate of the CA which workers' certificates must be signed by")
+	hostTimeout := flag.Duration("host-timeout", 0, "Maximum time a worker may spend executing the operations of a host. Operations which don't complete in time are marked as timed out. 0 means no limit")
+	operationTimeout := flag.Duration("operation-timeout", 0, "Maximum time an operation may execute if the operation doesn't specify a timeout. 0 means no limit")
+	check := flag.Bool("check", false, "Execute runs in check mode, in which modules report what they would change without changing anything. In serve mode, runs can also be triggered in check mode through the API")
+	limit := flag.String("limit", "", "Execute runs only on the hosts which match a comma-separated list of labels and groups, e.g. 'env=prod,role=web' or 'webservers'. In serve mode, this is the default for runs triggered through the API")
+	hostsFlag := flag.String("hosts", "", "Execute runs only on the given comma-separated list of hosts. In serve mode, this is the default for runs triggered through the API")
+	modulesDir := flag.String("modules-dir", "", "Directory of the modules which are sent to workers along with the operations. The attributes of operations are validated against the manifests of their modules before the operations are sent. If empty, workers use the modules in their own modules dir")
+	workerTTL := flag.Duration("worker-ttl", 30*time.Second, "Remove a registered worker if no heartbeat is received from it within this duration (serve mode only)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [serve] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Executes a single run and exits, or runs as a service exposing an HTTP API when\n")
+		fmt.Fprintf(os.Stderr, "the serve subcommand is given.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 
 	// Init master
-	m := master.Master{SSHKeysDir: *sshKeysPath}
-
-	// Connect to DB
-	dbHosts := strings.Split(*dbHostsFlag, ",")
-	log.Printf("Connecting to DB hosts %s", dbHosts)
-	session, err := m.ConnectToDB(dbHosts, *dbKeyspace)
+	selector, err := master.NewWorkerSelector(*workerSelection)
 	if err != nil {
-		log.Fatalf("Could not connect to DB: %v", err)
+		log.Fatal(err)
 	}
-	defer session.Close()
-
-	// Read hosts from DB
-	hosts, err := m.GetHosts(session)
+	dialer, err := transport.NewDialer(*transportFlag)
 	if err != nil {
-		log.Fatalf("Could not get hosts from DB: %v", err)
+		log.Fatal(err)
 	}
-
-	log.Printf("%d hosts retrieved from DB", len(hosts))
-
-	// Connect to workers
-	workers := strings.Split(*workersFlag, ",")
-	log.Printf("Connecting to workers %s", workers)
-	for _, w := range workers {
-		c, err := rpc.DialHTTP("tcp", w)
+	m := master.Master{
+		MaxOutputSize:    *maxOutputSize,
+		Selector:         selector,
+		Transport:        dialer,
+		MaxAttempts:      *maxAttempts,
+		TrustOnFirstUse:  *trustOnFirstUse,
+		HostTimeout:      *hostTimeout,
+		OperationTimeout: *operationTimeout,
+		ModulesDir:       *modulesDir,
+	}
+	var apiTLSConfig *tls.Config
+	if tlsFiles := (tlsconfig.Files{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}); tlsFiles.Enabled() {
+		m.TLSConfig, err = tlsconfig.Client(tlsFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiTLSConfig, err = tlsconfig.Server(tlsFiles)
 		if err != nil {
-			log.Printf("Error dialing worker %v: %v", w, err)
-			continue
+			log.Fatal(err)
 		}
-		m.Workers = append(m.Workers, c)
 	}
 
-	// Store new run in DB
-	runID := gocql.TimeUUID()
-	err = m.StoreRun(session, runID, time.Now())
+	// Connect to DB
+	dbHosts := strings.Split(*dbHostsFlag, ",")
+	if *dbDriver == master.DriverCassandra {
+		log.Printf("Connecting to DB hosts %s", dbHosts)
+	} else {
+		log.Printf("Opening %s DB", *dbDriver)
+	}
+	store, err := master.OpenStore(master.StoreConfig{
+		Driver:   *dbDriver,
+		Hosts:    dbHosts,
+		Keyspace: *dbKeyspace,
+		Path:     *dbPath,
+	})
 	if err != nil {
-		log.Fatalf("Could not store run in DB: %v", err)
-	}
-
-	// Process multiple hosts in parallel
-	log.Printf("Executing operations on a maximum of %d hosts in parallel", *concurrency)
-	sem := make(chan struct{}, *concurrency)
-	var wg sync.WaitGroup
-	for _, h := range hosts {
-		// Acquire semaphore slot
-		sem <- struct{}{}
-		wg.Add(1)
-		go func(host ops.Host) {
-			defer func() {
-				// Release semaphore slot
-				<-sem
-				wg.Done()
-			}()
-
-			// Get operations for host
-			operations, err := m.GetOperations(session, host.Hostname)
-			if err != nil {
-				log.Printf("[%s] Could not get operations from DB: %v", host.Hostname, err)
-				return
-			}
-
-			log.Printf("[%s] Retrieved %d operations", host.Hostname, len(operations))
-
-			// Read SSH key only if configured
-			key := ""
-			if host.KeyName != "" {
-				key, err = m.SSHKey(host.KeyName)
-				if err != nil {
-					log.Printf("[%s] Error reading SSH key: %v", host.Hostname, err)
-					// Not returning here because we might still be able to log in with a password.
-				}
-			}
-
-			// Execute operations
-			in := worker.ExecuteInput{
-				Hostname:   host.Hostname,
-				User:       host.User,
-				Key:        key,
-				Password:   host.Password,
-				Operations: operations,
-			}
-			var out worker.ExecuteOutput
+		log.Fatalf("Could not connect to DB: %v", err)
+	}
+	defer store.Close()
+	m.Store = store
 
-			client, err := m.SelectWorker()
-			if err != nil {
-				log.Printf("[%s] Could not select worker: %v", host.Hostname, err)
-				return
+	// Seed DB if needed
+	if *dbSeed != "" {
+		hosts, err := m.GetHosts()
+		if err != nil {
+			log.Fatalf("Could not get hosts from DB: %v", err)
+		}
+		if len(hosts) == 0 {
+			if err := seed(store, *dbSeed); err != nil {
+				log.Fatalf("Could not seed DB: %v", err)
 			}
+		}
+	}
 
-			err = client.Call("Worker.Execute", in, &out)
-			if err != nil {
-				log.Printf("[%s] Error executing operations: %v", host.Hostname, err)
-				return
+	// Connect to workers
+	if *workersFlag != "" {
+		workers := strings.Split(*workersFlag, ",")
+		log.Printf("Connecting to workers %s", workers)
+		for _, w := range workers {
+			if err := m.AddWorker(w); err != nil {
+				log.Printf("%v, retrying during health checks", err)
+				m.AddDisconnectedWorker(w)
 			}
+		}
+	}
 
-			// Store results in DB
-			err = m.StoreResults(session, runID, host.Hostname, out.Results)
-			if err != nil {
-				log.Printf("[%s] Could not store results in DB: %v", host.Hostname, err)
-			}
+	// Check worker health in the background
+	go m.CheckWorkersPeriodically(context.Background(), *healthCheckInterval)
 
-			// Analyze results
-			var good, bad []ops.OperationResult
-			for _, i := range out.Results {
-				if i.Successful {
-					good = append(good, i)
-				} else {
-					bad = append(bad, i)
-				}
-			}
+	target, err := master.ParseLimit(*limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *hostsFlag != "" {
+		target.Hostnames = strings.Split(*hostsFlag, ",")
+	}
 
-			// TODO Set colors for success / fail
-			if len(good) > 0 {
-				s := fmt.Sprintf("[%s] Completed operations:\n", host.Hostname)
-				for _, i := range good {
-					s = s + fmt.Sprintf("* %s\n", i.Operation.Description)
-					if i.StdOut != "" {
-						s = s + fmt.Sprintf("stdout:\n%v", formatScriptOutput(i.StdOut))
-					}
-					if i.StdErr != "" {
-						s = s + fmt.Sprintf("stderr:\n%v", formatScriptOutput(i.StdErr))
-					}
-				}
-				log.Print(s)
-			}
+	spec := master.RunSpec{Concurrency: *concurrency, Check: *check, Target: target}
+	if serveMode {
+		serve(&m, *listen, spec, *workerTTL, apiTLSConfig)
+		return
+	}
 
-			if len(bad) > 0 {
-				s := fmt.Sprintf("[%s] Failed operations:\n", host.Hostname)
-				for _, i := range bad {
-					s = s + fmt.Sprintf("* %s\n", i.Operation.Description)
-					if i.StdOut != "" {
-						s = s + fmt.Sprintf("stdout:\n%v", formatScriptOutput(i.StdOut))
-					}
-					if i.StdErr != "" {
-						s = s + fmt.Sprintf("stderr:\n%v", formatScriptOutput(i.StdErr))
-					}
-				}
-				log.Print(s)
-			}
-		}(h)
+	// Cancel the run on SIGINT or SIGTERM. A second signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Println("Cancelling run")
+		cancel()
+		signal.Stop(stop)
+	}()
+
+	if _, err := m.Run(ctx, spec); err != nil {
+		log.Fatalf("Run failed: %v", err)
 	}
-	wg.Wait()
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/johananl/simple-cm/master"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// Checks the modules in a modules dir and the operations in the DB which use them. Every module
+// and manifest must parse, and every operation must use an existing module, be valid according to
+// the module's manifest and supply all the attributes which the module references, either as
+// attributes, as variables of its host or through the defaults of the manifest. A diagnostic is
+// printed for every problem found and an error is returned if there were any.
+func lintCommand(m *master.Master, args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	modulesDir := fs.String("modules-dir", "/etc/simple-cm/modules", "Directory of the modules to check")
+	fs.Parse(args)
+
+	files, err := ioutil.ReadDir(*modulesDir)
+	if err != nil {
+		return fmt.Errorf("could not read modules dir: %v", err)
+	}
+
+	problems := 0
+	report := func(format string, a ...interface{}) {
+		fmt.Fprintf(stdout, format+"\n", a...)
+		problems++
+	}
+
+	// Nil for modules which couldn't be parsed.
+	modules := make(map[string]*ops.Module)
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") ||
+			strings.HasSuffix(f.Name(), ops.ManifestExt) {
+			continue
+		}
+		mod, err := ops.LoadModule(*modulesDir, f.Name())
+		if err != nil {
+			report("module %s: %v", f.Name(), err)
+			modules[f.Name()] = nil
+			continue
+		}
+		for _, p := range mod.Lint() {
+			report("module %s: %s", f.Name(), p)
+		}
+		modules[f.Name()] = mod
+	}
+
+	hosts, err := m.GetHosts()
+	if err != nil {
+		return fmt.Errorf("could not get hosts: %v", err)
+	}
+	for _, h := range hosts {
+		operations, err := m.GetHostOperations(h)
+		if err != nil {
+			report("host %s: could not get operations: %v", h.Hostname, err)
+			continue
+		}
+		vars, err := m.GetHostVariables(h)
+		if err != nil {
+			return fmt.Errorf("could not get variables: %v", err)
+		}
+		values := master.VariableValues(vars)
+
+		for _, o := range operations {
+			mod, ok := modules[o.ScriptName]
+			if !ok {
+				report("host %s: operation %s: module %s not found", h.Hostname, o.Description,
+					o.ScriptName)
+				continue
+			}
+			if mod == nil {
+				// The module's parsing error was already reported.
+				continue
+			}
+			if mod.Manifest != nil {
+				if hostOS := h.Labels[ops.OSLabel]; !mod.Manifest.SupportsOS(hostOS) {
+					report("host %s: operation %s: module %s doesn't support OS %s", h.Hostname,
+						o.Description, o.ScriptName, hostOS)
+				}
+				if o, err = mod.Manifest.Apply(o, values); err != nil {
+					report("host %s: operation %s: %v", h.Hostname, o.Description, err)
+					continue
+				}
+			}
+			var missing []string
+			for _, a := range mod.Attributes() {
+				if _, ok := o.Attributes[a]; ok {
+					continue
+				}
+				if _, ok := values[a]; !ok {
+					missing = append(missing, a)
+				}
+			}
+			if len(missing) > 0 {
+				report("host %s: operation %s: module %s requires missing attributes: %s",
+					h.Hostname, o.Description, o.ScriptName, strings.Join(missing, ", "))
+			}
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	fmt.Fprintln(stdout, "No problems found")
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johananl/simple-cm/master"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestLintCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating modules dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"file":      "ls {{.path}} {{index . \"mode\"}}",
+		"file.json": `{"os": ["linux"], "parameters": {"mode": {"type": "int"}}}`,
+		"sleep":     "sleep {.seconds}",
+		"broken":    "{{if}}",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing module: %v", err)
+		}
+	}
+
+	clean := master.NewMemoryStore()
+	clean.AddHost(ops.Host{Hostname: "host1"})
+	clean.AddOperation("host1", ops.Operation{Description: "op", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}})
+
+	s := master.NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", Labels: map[string]string{"os": "windows"}})
+	s.AddHost(ops.Host{Hostname: "host2"})
+	s.AddOperation("host1", ops.Operation{Description: "op1", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}})
+	s.AddOperation("host2", ops.Operation{Description: "op1", ScriptName: "file"})
+	s.AddOperation("host2", ops.Operation{Description: "op2", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts", "mode": "rw"}})
+	s.AddOperation("host2", ops.Operation{Description: "op3", ScriptName: "missing"})
+
+	testCommand(t, &master.Master{Store: clean}, lintCommand, []commandTest{
+		{args: []string{"-modules-dir", filepath.Join(dir, "missing")},
+			wantErr: "could not read modules dir"},
+	})
+
+	// Modules which can't be parsed are reported regardless of the operations.
+	testCommand(t, &master.Master{Store: clean}, lintCommand, []commandTest{
+		{args: []string{"-modules-dir", dir}, wantErr: "found 2 problems", want: []string{
+			"module broken: error parsing script template",
+			`module sleep: "{.seconds}" looks like an action with single braces`,
+		}},
+	})
+
+	testCommand(t, &master.Master{Store: s}, lintCommand, []commandTest{
+		{args: []string{"-modules-dir", dir}, wantErr: "found 6 problems", want: []string{
+			"host host1: operation op1: module file doesn't support OS windows",
+			"host host2: operation op1: module file requires missing attributes: path",
+			`host host2: operation op2: invalid attributes: parameter mode must be of type int`,
+			"host host2: operation op3: module missing not found",
+		}},
+	})
+
+	os.Remove(filepath.Join(dir, "broken"))
+	os.Remove(filepath.Join(dir, "sleep"))
+	testCommand(t, &master.Master{Store: clean}, lintCommand, []commandTest{
+		{args: []string{"-modules-dir", dir}, want: []string{"No problems found"}},
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/johananl/simple-cm/master"
+)
+
+// A command is a simple-cm subcommand. Its run function receives the arguments which follow the
+// command's name. Commands which don't need the DB set noDB and receive a nil *master.Master.
+type command struct {
+	summary string
+	run     func(m *master.Master, args []string) error
+	noDB    bool
+}
+
+var commands = map[string]command{
+	"lint":  {summary: "Check the modules and the operations which use them", run: lintCommand},
+	"runs":  {summary: "List runs and inspect their results", run: runsCommand},
+	"vault": {summary: "Manage secrets in an encrypted vault file", run: vaultCommand, noDB: true},
+	"vars":  {summary: "Show the effective variables of a host", run: varsCommand},
+}
+
+// The streams which commands read from and write to.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", n, commands[n].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	dbDriver := flag.String("db-driver", master.DriverCassandra, "DB driver to use: cassandra, bolt (embedded, file-based) or memory")
+	dbHostsFlag := flag.String("db-hosts", "127.0.0.1", "A comma-separated list of DB nodes to connect to")
+	dbKeyspace := flag.String("db-keyspace", "simplecm", "Cassandra keyspace to use")
+	dbPath := flag.String("db-path", "/var/lib/simple-cm/simplecm.db", "Path of the DB file when using the bolt driver")
+	flag.Usage = usage
+	flag.Parse()
+
+	log.SetFlags(0)
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if cmd.noDB {
+		if err := cmd.run(nil, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	store, err := master.OpenStore(master.StoreConfig{
+		Driver:   *dbDriver,
+		Hosts:    strings.Split(*dbHostsFlag, ","),
+		Keyspace: *dbKeyspace,
+		Path:     *dbPath,
+	})
+	if err != nil {
+		log.Fatalf("Could not connect to DB: %v", err)
+	}
+	m := master.Master{Store: store}
+
+	err = cmd.run(&m, flag.Args()[1:])
+	store.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/johananl/simple-cm/master"
+)
+
+// A test case of a command: the command's arguments along with strings which its output or its
+// error must contain, and strings which its output mustn't contain.
+type commandTest struct {
+	args    []string
+	want    []string
+	wantErr string
+	notWant []string
+}
+
+// Runs a command for each test case and checks its output.
+func testCommand(t *testing.T, m *master.Master, run func(*master.Master, []string) error, tests []commandTest) {
+	for _, tc := range tests {
+		out := captureOutput(func() error {
+			err := run(m, tc.args)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("%v: unexpected error: %v", tc.args, err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("%v: expected an error containing %q, got %v", tc.args, tc.wantErr, err)
+			}
+			return err
+		})
+		for _, s := range tc.want {
+			if !strings.Contains(out, s) {
+				t.Errorf("%v: expected output to contain %q, got:\n%s", tc.args, s, out)
+			}
+		}
+		for _, s := range tc.notWant {
+			if strings.Contains(out, s) {
+				t.Errorf("%v: expected output not to contain %q, got:\n%s", tc.args, s, out)
+			}
+		}
+	}
+}
+
+// Returns what f writes to stdout and stderr.
+func captureOutput(f func() error) string {
+	var b bytes.Buffer
+	defer func(o, e io.Writer) { stdout, stderr = o, e }(stdout, stderr)
+	stdout, stderr = &b, &b
+	f()
+	return b.String()
+}
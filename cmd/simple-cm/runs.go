@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/johananl/simple-cm/master"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+const runsUsage = `Usage:
+  runs list [-n <count>]               List recent runs
+  runs show <run-id>                   Show a pass/fail summary for each host in a run
+  runs show <run-id> -host <hostname>  Show the results of each operation on a host in a run
+  runs output <run-id> -host <hostname> [-follow]
+                                       Show the output of a host in a run. With -follow, keep
+                                       showing new output until the run completes`
+
+func runsCommand(m *master.Master, args []string) error {
+	if len(args) == 0 {
+		return errors.New(runsUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		return runsList(m, args[1:])
+	case "show":
+		return runsShow(m, args[1:])
+	case "output":
+		return runsOutput(m, args[1:])
+	}
+
+	return errors.New(runsUsage)
+}
+
+func runsList(m *master.Master, args []string) error {
+	fs := flag.NewFlagSet("runs list", flag.ExitOnError)
+	n := fs.Int("n", 20, "Maximum number of runs to list")
+	fs.Parse(args)
+
+	runs, err := m.GetRuns(*n)
+	if err != nil {
+		return fmt.Errorf("could not get runs: %v", err)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN ID\tSTARTED\tFINISHED\tDURATION\tMODE\tSUMMARY")
+	for _, r := range runs {
+		finished, duration, mode, summary := "-", "-", "-", "-"
+		if !r.EndTime.IsZero() {
+			finished = formatTime(r.EndTime)
+			duration = r.EndTime.Sub(r.CreateTime).Round(time.Millisecond).String()
+		}
+		if r.Check {
+			mode = "check"
+		}
+		if len(r.Counts) > 0 {
+			summary = master.FormatCounts(r.Counts)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, formatTime(r.CreateTime), finished,
+			duration, mode, summary)
+	}
+
+	return w.Flush()
+}
+
+func runsShow(m *master.Master, args []string) error {
+	fs := flag.NewFlagSet("runs show", flag.ExitOnError)
+	host := fs.String("host", "", "Show the results of each operation on the given host")
+	fs.Parse(args)
+	// Allow flags both before and after the run ID.
+	if fs.NArg() == 0 {
+		return errors.New(runsUsage)
+	}
+	runIDArg := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	runID, err := gocql.ParseUUID(runIDArg)
+	if err != nil {
+		return fmt.Errorf("invalid run ID %q: %v", runIDArg, err)
+	}
+
+	run, err := m.GetRun(runID)
+	if err != nil {
+		return fmt.Errorf("could not get run: %v", err)
+	}
+	results, err := m.GetResults(runID, *host)
+	if err != nil {
+		return fmt.Errorf("could not get results: %v", err)
+	}
+
+	// A run which is in progress may have no results yet.
+	showRunHeader(run)
+	if *host != "" {
+		showHostResults(results)
+		return nil
+	}
+
+	return showRunSummary(results)
+}
+
+func runsOutput(m *master.Master, args []string) error {
+	fs := flag.NewFlagSet("runs output", flag.ExitOnError)
+	host := fs.String("host", "", "Host to show the output of")
+	follow := fs.Bool("follow", false, "Keep showing new output until the run completes")
+	fs.Parse(args)
+	// Allow flags both before and after the run ID.
+	if fs.NArg() == 0 {
+		return errors.New(runsUsage)
+	}
+	runIDArg := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if *host == "" {
+		return errors.New(runsUsage)
+	}
+
+	runID, err := gocql.ParseUUID(runIDArg)
+	if err != nil {
+		return fmt.Errorf("invalid run ID %q: %v", runIDArg, err)
+	}
+
+	var shown int
+	var description string
+	for {
+		// Check whether the run completed before getting the output, so that no output which is
+		// stored before completion is missed.
+		run, err := m.GetRun(runID)
+		if err != nil {
+			return fmt.Errorf("could not get run: %v", err)
+		}
+
+		output, err := m.GetOutput(runID, *host)
+		if err != nil {
+			return fmt.Errorf("could not get output: %v", err)
+		}
+		description = showOutput(output[shown:], description)
+		shown = len(output)
+
+		if !*follow || !run.EndTime.IsZero() {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Prints chunks of output. stdout is printed to stdout and stderr to stderr, and a header is
+// printed whenever the operation differs from the previous chunk's. Returns the operation of the
+// last chunk.
+func showOutput(output []master.Output, description string) string {
+	for _, o := range output {
+		if o.Description != description {
+			fmt.Fprintf(stdout, "==> %s <==\n", o.Description)
+			description = o.Description
+		}
+		if o.Stream == "stderr" {
+			fmt.Fprint(stderr, o.Data)
+		} else {
+			fmt.Fprint(stdout, o.Data)
+		}
+	}
+	return description
+}
+
+// Prints the ID, times and mode of a run.
+func showRunHeader(run master.Run) {
+	finished := "in progress"
+	if !run.EndTime.IsZero() {
+		finished = formatTime(run.EndTime)
+	}
+	fmt.Fprintf(stdout, "Run:      %s\n", run.ID)
+	fmt.Fprintf(stdout, "Started:  %s\n", formatTime(run.CreateTime))
+	fmt.Fprintf(stdout, "Finished: %s\n", finished)
+	if run.Check {
+		fmt.Fprintf(stdout, "Mode:     check\n")
+	}
+	fmt.Fprintln(stdout)
+}
+
+// Prints a pass/fail summary for each host. A host passes if all of its operations succeeded.
+func showRunSummary(results []master.Result) error {
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tRESULT\tOPERATIONS\tSUMMARY")
+
+	for i := 0; i < len(results); {
+		// Results are sorted by hostname.
+		j := i
+		counts := make(map[ops.Status]int)
+		passed := true
+		for ; j < len(results) && results[j].Hostname == results[i].Hostname; j++ {
+			counts[results[j].Status]++
+			if !results[j].Successful {
+				passed = false
+			}
+		}
+
+		result := "pass"
+		if !passed {
+			result = "fail"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", results[i].Hostname, result, j-i, master.FormatCounts(counts))
+		i = j
+	}
+
+	return w.Flush()
+}
+
+// Prints the details of each result, including the operation's output.
+func showHostResults(results []master.Result) {
+	for _, r := range results {
+		fmt.Fprintf(stdout, "* %s (%s)\n", r.Operation.Description, r.Operation.ScriptName)
+		fmt.Fprintf(stdout, "  Status:   %s\n", r.Status)
+		if !r.Successful {
+			fmt.Fprintf(stdout, "  Reason:   %s\n", r.FailureReason())
+		}
+		if r.Message != "" {
+			fmt.Fprintf(stdout, "  Message:  %s\n", r.Message)
+		}
+		fmt.Fprintf(stdout, "  Started:  %s\n", formatTime(r.StartTime))
+		fmt.Fprintf(stdout, "  Duration: %v\n", r.Duration())
+		if r.Worker != "" {
+			fmt.Fprintf(stdout, "  Worker:   %s\n", r.Worker)
+		}
+		if r.ModuleVersion != "" {
+			fmt.Fprintf(stdout, "  Version:  %s\n", r.ModuleVersion)
+		}
+		if r.Attempts > 1 {
+			fmt.Fprintf(stdout, "  Attempts: %d\n", r.Attempts)
+		}
+		if len(r.Facts) > 0 {
+			fmt.Fprintf(stdout, "  Facts:\n")
+			for _, k := range sortedKeys(r.Facts) {
+				fmt.Fprintf(stdout, "    %s: %s\n", k, r.Facts[k])
+			}
+		}
+		if r.StdOut != "" {
+			fmt.Fprintf(stdout, "  stdout:\n%s", indent(r.StdOut))
+		}
+		if r.StdErr != "" {
+			fmt.Fprintf(stdout, "  stderr:\n%s", indent(r.StdErr))
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// Returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Indents every line of s for display under a result.
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return "    " + strings.Join(lines, "\n    ") + "\n"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/johananl/simple-cm/master"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestRunsCommand(t *testing.T) {
+	s := master.NewMemoryStore()
+	start := time.Now().Add(-time.Minute)
+
+	finished := master.Run{ID: gocql.TimeUUID(), CreateTime: start, EndTime: start.Add(time.Second),
+		Counts: map[ops.Status]int{ops.StatusOK: 1, ops.StatusFailed: 1}}
+	s.StoreRun(finished)
+	s.FinishRun(finished)
+	s.StoreResults(finished.ID, "host1", []ops.OperationResult{{
+		Operation:     ops.Operation{Description: "op1", ScriptName: "file_exists"},
+		Status:        ops.StatusOK,
+		Successful:    true,
+		StdOut:        "all good\n",
+		ModuleVersion: "abc123",
+	}})
+	s.StoreResults(finished.ID, "host2", []ops.OperationResult{{
+		Operation: ops.Operation{Description: "op1", ScriptName: "file_exists"},
+		Status:    ops.StatusFailed,
+		ExitCode:  2,
+	}})
+
+	running := master.Run{ID: gocql.TimeUUID(), CreateTime: start, Check: true}
+	s.StoreRun(running)
+
+	m := &master.Master{Store: s}
+	testCommand(t, m, runsCommand, []commandTest{
+		{args: nil, wantErr: "Usage:"},
+		{args: []string{"unknown"}, wantErr: "Usage:"},
+		{args: []string{"list"}, want: []string{"RUN ID", finished.ID.String(), "1 failed, 1 ok",
+			running.ID.String(), "check"}},
+		{args: []string{"list", "-n", "1"}, want: []string{"RUN ID"}},
+		{args: []string{"show"}, wantErr: "Usage:"},
+		{args: []string{"show", "not-a-uuid"}, wantErr: "invalid run ID"},
+		{args: []string{"show", gocql.TimeUUID().String()}, wantErr: "could not get run"},
+		{args: []string{"show", finished.ID.String()}, want: []string{
+			"Run:      " + finished.ID.String(),
+			"Finished: " + formatTime(finished.EndTime),
+			"HOST", "host1  pass    1           1 ok", "host2  fail    1           1 failed",
+		}},
+		// A run without results is shown with an empty table.
+		{args: []string{"show", running.ID.String()}, want: []string{
+			"Finished: in progress", "Mode:     check", "HOST  RESULT  OPERATIONS  SUMMARY\n",
+		}, notWant: []string{"host1"}},
+		// Flags may follow the run ID.
+		{args: []string{"show", finished.ID.String(), "-host", "host1"}, want: []string{
+			"* op1 (file_exists)", "Status:   ok", "Version:  abc123", "stdout:\n    all good\n",
+		}, notWant: []string{"Reason:"}},
+		{args: []string{"show", "-host", "host2", finished.ID.String()}, want: []string{
+			"Status:   failed", "Reason:   exit code 2",
+		}},
+		{args: []string{"output", finished.ID.String()}, wantErr: "Usage:"},
+	})
+}
+
+func TestIndent(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"a\n", "    a\n"},
+		{"a\nb", "    a\n    b\n"},
+		{"a\n\n", "    a\n"},
+	} {
+		if got := indent(tc.in); got != tc.want {
+			t.Errorf("indent(%q): got %q want %q", tc.in, got, tc.want)
+		}
+	}
+}
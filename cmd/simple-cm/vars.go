@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/johananl/simple-cm/master"
+)
+
+const varsUsage = `Usage:
+  vars <hostname>  Show the effective variables of a host and the scope each one comes from`
+
+func varsCommand(m *master.Master, args []string) error {
+	if len(args) != 1 {
+		return errors.New(varsUsage)
+	}
+
+	hosts, err := m.GetHosts()
+	if err != nil {
+		return fmt.Errorf("could not get hosts: %v", err)
+	}
+	hosts, err = master.Target{Hostnames: args}.Select(hosts)
+	if err != nil {
+		return err
+	}
+
+	vars, err := m.GetHostVariables(hosts[0])
+	if err != nil {
+		return fmt.Errorf("could not get variables: %v", err)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSCOPE")
+	for _, v := range vars {
+		scope := string(v.Scope)
+		if v.ScopeName != "" {
+			scope = fmt.Sprintf("%s %s", v.Scope, v.ScopeName)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, v.Value, scope)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/johananl/simple-cm/master"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestVarsCommand(t *testing.T) {
+	s := master.NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", Groups: []string{"web"}})
+	s.SetVariable(master.ScopeGlobal, "", "ntp", "pool.ntp.org")
+	s.SetVariable(master.ScopeGlobal, "", "port", "80")
+	s.SetVariable(master.ScopeGroup, "web", "port", "8080")
+	s.SetVariable(master.ScopeHost, "host1", "user", "deploy")
+
+	m := &master.Master{Store: s}
+	testCommand(t, m, varsCommand, []commandTest{
+		{args: nil, wantErr: "Usage:"},
+		{args: []string{"host1", "host2"}, wantErr: "Usage:"},
+		{args: []string{"host2"}, wantErr: "host2"},
+		{args: []string{"host1"}, want: []string{
+			"NAME  VALUE         SCOPE\n" +
+				"ntp   pool.ntp.org  global\n" +
+				"port  8080          group web\n" +
+				"user  deploy        host host1\n",
+		}},
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/johananl/simple-cm/master"
+	"github.com/johananl/simple-cm/secrets"
+)
+
+const vaultUsage = `Usage:
+  vault list [-file <path>]         List the names of the secrets in a vault
+  vault set [-file <path>] <name>   Store a secret read from stdin in a vault, creating the vault
+                                    if it doesn't exist
+  vault rm [-file <path>] <name>    Remove a secret from a vault
+
+The vault passphrase is read from the ` + secrets.VaultPassphraseEnv + ` environment variable.`
+
+func vaultCommand(m *master.Master, args []string) error {
+	if len(args) == 0 {
+		return errors.New(vaultUsage)
+	}
+
+	fs := flag.NewFlagSet("vault "+args[0], flag.ExitOnError)
+	file := fs.String("file", "/etc/simple-cm/vault", "Path of the vault file")
+	fs.Parse(args[1:])
+
+	passphrase := os.Getenv(secrets.VaultPassphraseEnv)
+	if passphrase == "" {
+		return fmt.Errorf("%s isn't set", secrets.VaultPassphraseEnv)
+	}
+
+	// Only setting a secret creates the vault.
+	s := map[string]string{}
+	if _, err := os.Stat(*file); args[0] != "set" || !os.IsNotExist(err) {
+		s, err = secrets.ReadVault(*file, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case args[0] == "list" && fs.NArg() == 0:
+		var names []string
+		for n := range s {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Fprintln(stdout, n)
+		}
+		return nil
+	case args[0] == "set" && fs.NArg() == 1:
+		value, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("error reading secret: %v", err)
+		}
+		// Passwords are typically piped with a trailing newline. Keys are unaffected.
+		s[fs.Arg(0)] = secrets.TrimNewline(string(value))
+		return secrets.WriteVault(*file, passphrase, s)
+	case args[0] == "rm" && fs.NArg() == 1:
+		if _, ok := s[fs.Arg(0)]; !ok {
+			return fmt.Errorf("no such secret: %s", fs.Arg(0))
+		}
+		delete(s, fs.Arg(0))
+		return secrets.WriteVault(*file, passphrase, s)
+	}
+
+	return errors.New(vaultUsage)
+}
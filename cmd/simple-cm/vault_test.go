@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johananl/simple-cm/secrets"
+)
+
+func TestVaultCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "vault")
+
+	os.Setenv(secrets.VaultPassphraseEnv, "passphrase")
+	defer os.Unsetenv(secrets.VaultPassphraseEnv)
+	defer func() { stdin = os.Stdin }()
+
+	stdin = strings.NewReader("hunter2\n")
+	testCommand(t, nil, vaultCommand, []commandTest{
+		{args: nil, wantErr: "Usage:"},
+		// Only setting a secret creates the vault.
+		{args: []string{"list", "-file", file}, wantErr: "no such file or directory"},
+		{args: []string{"rm", "-file", file, "password"}, wantErr: "no such file or directory"},
+		{args: []string{"set", "-file", file}, wantErr: "Usage:"},
+		{args: []string{"set", "-file", file, "password"}},
+	})
+	stdin = strings.NewReader("-----BEGIN KEY-----\nabc\n-----END KEY-----\n")
+	testCommand(t, nil, vaultCommand, []commandTest{
+		{args: []string{"set", "-file", file, "key"}},
+		{args: []string{"list", "-file", file}, want: []string{"key\npassword\n"}},
+		{args: []string{"rm", "-file", file, "missing"}, wantErr: "no such secret: missing"},
+		{args: []string{"rm", "-file", file, "key"}},
+		{args: []string{"list", "-file", file}, want: []string{"password\n"}, notWant: []string{"key"}},
+	})
+
+	// A trailing newline is removed from single-line secrets only.
+	s, err := secrets.ReadVault(file, "passphrase")
+	if err != nil || s["password"] != "hunter2" {
+		t.Fatalf("Wrong secrets: got %q, %v", s, err)
+	}
+
+	os.Setenv(secrets.VaultPassphraseEnv, "wrong")
+	testCommand(t, nil, vaultCommand, []commandTest{
+		{args: []string{"list", "-file", file}, wantErr: "passphrase"},
+	})
+	os.Unsetenv(secrets.VaultPassphraseEnv)
+	testCommand(t, nil, vaultCommand, []commandTest{
+		{args: []string{"list", "-file", file}, wantErr: secrets.VaultPassphraseEnv + " isn't set"},
+	})
+}
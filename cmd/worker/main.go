@@ -2,49 +2,165 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/johananl/simple-cm/secrets"
+	"github.com/johananl/simple-cm/tlsconfig"
+	"github.com/johananl/simple-cm/transport"
 	"github.com/johananl/simple-cm/worker"
 )
 
+// Returns a provider which resolves secrets using the given comma-separated list of providers in
+// order.
+func secretsProvider(providers, dir, envPrefix, vaultFile string) (secrets.Provider, error) {
+	var chain secrets.Chain
+	for _, p := range strings.Split(providers, ",") {
+		switch p {
+		case "dir":
+			chain = append(chain, secrets.DirProvider{Dir: dir})
+		case "env":
+			chain = append(chain, secrets.EnvProvider{Prefix: envPrefix})
+		case "vault":
+			v, err := secrets.OpenVault(vaultFile, os.Getenv(secrets.VaultPassphraseEnv))
+			if err != nil {
+				return nil, fmt.Errorf("error opening vault %s: %v", vaultFile, err)
+			}
+			chain = append(chain, v)
+		default:
+			return nil, fmt.Errorf("unknown secrets provider %q", p)
+		}
+	}
+
+	return chain, nil
+}
+
 func main() {
-	modulesDir := flag.String("modules-dir", "/etc/simple-cm/modules", "Directory to look for modules in")
+	modulesDir := flag.String("modules-dir", "/etc/simple-cm/modules", "Directory to look for modules in if the master doesn't send the modules along with the operations")
 	port := flag.String("port", "8888", "TCP port to listen on")
+	knownHosts := flag.String("known-hosts", "", "Path of an OpenSSH known_hosts file to verify the SSH host keys of hosts which have no pinned host key fingerprint against")
+	secretsFlag := flag.String("secrets", "dir,env", "A comma-separated list of providers to resolve SSH keys and passwords with, in lookup order: dir, env or vault")
+	secretsDir := flag.String("secrets-dir", "/etc/simple-cm/secrets", "Directory to read secrets from when using the dir provider. Each file contains one secret")
+	secretsEnvPrefix := flag.String("secrets-env-prefix", "SIMPLECM_SECRET_", "Prefix of the environment variables to read secrets from when using the env provider")
+	vaultFile := flag.String("vault-file", "/etc/simple-cm/vault", "Encrypted vault file to read secrets from when using the vault provider. The passphrase is read from the "+secrets.VaultPassphraseEnv+" environment variable")
+	masterURL := flag.String("master", "", "URL of a master's HTTP API to register with, e.g. http://master:8080. If not set, the worker waits for the master to connect to it")
+	advertiseAddr := flag.String("advertise-addr", "", "The <host>:<port> address the master should use to connect to this worker. Defaults to the machine's hostname and the listening port")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 10*time.Second, "Interval between heartbeats sent to the master")
+	transportFlag := flag.String("transport", transport.RPC, "Transport to serve the master on: rpc or stream")
+	tlsCert := flag.String("tls-cert", "", "PEM-encoded TLS certificate to present to the master. Enables TLS together with -tls-key and -tls-ca")
+	tlsKey := flag.String("tls-key", "", "PEM-encoded private key of the TLS certificate")
+	tlsCA := flag.String("tls-ca", "", "PEM-encoded certificate of the CA which the master's client certificate must be signed by")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 
-	// Initialize RPC server
-	w := worker.Worker{ModulesDir: *modulesDir}
-	rpc.Register(&w)
-	rpc.HandleHTTP()
+	provider, err := secretsProvider(*secretsFlag, *secretsDir, *secretsEnvPrefix, *vaultFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := worker.Worker{ModulesDir: *modulesDir, KnownHostsFile: *knownHosts, Secrets: provider}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	server := http.Server{Addr: fmt.Sprintf(":%s", *port)}
+	addr := fmt.Sprintf(":%s", *port)
+	var tlsConfig *tls.Config
+	tlsFiles := tlsconfig.Files{Cert: *tlsCert, Key: *tlsKey, CA: *tlsCA}
+	if tlsFiles.Enabled() {
+		tlsConfig, err = tlsconfig.Server(tlsFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Print("WARNING: TLS is disabled. Any client which can connect to the worker can execute operations using its credentials")
+	}
 
-	go func() {
-		err := server.ListenAndServe()
+	// Serve the master
+	var shutdown func(context.Context) error
+	switch *transportFlag {
+	case transport.RPC:
+		rpc.Register(&w)
+		rpc.HandleHTTP()
+
+		server := http.Server{Addr: addr, TLSConfig: tlsConfig}
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		shutdown = server.Shutdown
+	case transport.Stream:
+		l, err := net.Listen("tcp", addr)
 		if err != nil {
 			log.Fatal(err)
 		}
-	}()
-	log.Printf("Listening for connections on :%s", *port)
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			err := transport.ServeStream(l, &w)
+			select {
+			case <-closed:
+			default:
+				log.Fatal(err)
+			}
+		}()
+		shutdown = func(context.Context) error {
+			close(closed)
+			return l.Close()
+		}
+	default:
+		log.Fatalf("Unknown transport %q", *transportFlag)
+	}
+	log.Printf("Listening for connections on %s (%s transport)", addr, *transportFlag)
+
+	// Register with master
+	ctx, cancelRegister := context.WithCancel(context.Background())
+	if *masterURL != "" {
+		addr := *advertiseAddr
+		if addr == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.Fatalf("Could not get hostname: %v", err)
+			}
+			addr = fmt.Sprintf("%s:%s", hostname, *port)
+		}
+		var clientConfig *tls.Config
+		if tlsFiles.Enabled() {
+			clientConfig, err = tlsconfig.Client(tlsFiles)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		token := os.Getenv(worker.RegistrationTokenEnv)
+		go worker.Register(ctx, *masterURL, addr, token, *heartbeatInterval, clientConfig)
+	}
 
 	<-stop
 	log.Println("Shutting down")
+	cancelRegister()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	server.Shutdown(ctx)
+	shutdown(shutdownCtx)
 	log.Printf("Graceful shutdown complete")
 }
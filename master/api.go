@@ -0,0 +1,597 @@
+package master
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// Run statuses reported by the API.
+const (
+	runStatusRunning   = "running"
+	runStatusCompleted = "completed"
+	// The run was started but never completed, e.g. because the master was restarted.
+	runStatusIncomplete = "incomplete"
+)
+
+// An API exposes a Master over a JSON HTTP API which allows triggering runs, querying their status
+// and listing the inventory. The following endpoints are supported:
+//
+//	GET  /hosts?limit=<labels/groups>    List hosts, optionally only those matching a limit
+//	GET  /hosts/<hostname>/operations    List the operations of a host and of its groups
+//	GET  /runs?limit=<n>                 List recent runs
+//	POST /runs                           Trigger a new run, optionally in check mode or limited
+//	                                     to some of the hosts
+//	GET  /runs/<run ID>                  Get the status of a run
+//	GET  /runs/<run ID>/results?host=<h> Get the results of a run, optionally for a single host
+//	GET  /runs/<run ID>/output?host=<h>  Get the output of a host in a run
+//	POST /runs/<run ID>/cancel           Cancel a run which is in progress
+//	GET  /workers                        List connected workers
+//	POST /workers/register               Register a worker
+//	POST /workers/heartbeat              Refresh the registration of a worker
+//
+// Runs are executed in the background and may overlap. Since the master sends operations and
+// modules to registered workers, worker registrations and heartbeats must either carry
+// RegistrationToken as a bearer token or be made over TLS with a verified client certificate.
+type API struct {
+	// RegistrationToken is the token workers present when registering. If it is empty, only
+	// workers which present a verified TLS client certificate can register.
+	RegistrationToken string
+
+	m        *Master
+	ctx      context.Context
+	defaults RunSpec
+	// Cancels the runs which are in progress, by ID.
+	active map[gocql.UUID]context.CancelFunc
+	lock   sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// NewAPI returns an *API which serves the given Master. Runs which are triggered through the API
+// use defaults as their spec unless the request overrides it, and are cancelled once ctx is done.
+func NewAPI(ctx context.Context, m *Master, defaults RunSpec) *API {
+	return &API{
+		m:        m,
+		ctx:      ctx,
+		defaults: defaults,
+		active:   make(map[gocql.UUID]context.CancelFunc),
+	}
+}
+
+// Wait blocks until all the runs which were triggered through the API have completed.
+func (a *API) Wait() {
+	a.wg.Wait()
+}
+
+type hostJSON struct {
+	Hostname           string `json:"hostname"`
+	User               string `json:"user"`
+	KeyName            string `json:"key_name,omitempty"`
+	PasswordName       string `json:"password_name,omitempty"`
+	HostKeyFingerprint string `json:"host_key_fingerprint,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+	Groups []string          `json:"groups,omitempty"`
+}
+
+type operationJSON struct {
+	Description string            `json:"description"`
+	ScriptName  string            `json:"script_name"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	// Timeout in seconds.
+	Timeout   int      `json:"timeout,omitempty"`
+	Order     int      `json:"order,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+type runJSON struct {
+	ID         string                `json:"id"`
+	Status     string                `json:"status"`
+	CreateTime time.Time             `json:"create_time"`
+	EndTime    *time.Time            `json:"end_time,omitempty"`
+	Check      bool                  `json:"check,omitempty"`
+	Counts     map[ops.Status]int    `json:"counts,omitempty"`
+	Hosts      map[string]hostStatus `json:"hosts,omitempty"`
+}
+
+// The number of results of a host in a run by status.
+type hostStatus map[ops.Status]int
+
+type resultJSON struct {
+	Hostname    string            `json:"hostname"`
+	Description string            `json:"description"`
+	ScriptName  string            `json:"script_name"`
+	Status      string            `json:"status"`
+	Successful  bool              `json:"successful"`
+	ExitCode    int               `json:"exit_code"`
+	Signal      string            `json:"signal,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	StdOut      string            `json:"stdout,omitempty"`
+	StdErr      string            `json:"stderr,omitempty"`
+	StartTime   time.Time         `json:"start_time"`
+	EndTime     time.Time         `json:"end_time"`
+	Worker      string            `json:"worker,omitempty"`
+	Attempts    int               `json:"attempts"`
+	Changed     bool              `json:"changed"`
+	Facts       map[string]string `json:"facts,omitempty"`
+	Message     string            `json:"message,omitempty"`
+
+	ModuleVersion string `json:"module_version,omitempty"`
+}
+
+type outputJSON struct {
+	Description string    `json:"description"`
+	Stream      string    `json:"stream"`
+	Data        string    `json:"data"`
+	Timestamp   time.Time `json:"ts"`
+}
+
+type workerJSON struct {
+	Addr        string     `json:"addr"`
+	Static      bool       `json:"static"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	Outstanding int        `json:"outstanding"`
+}
+
+// The body of worker registration and heartbeat requests.
+type workerRequest struct {
+	Addr string `json:"addr"`
+}
+
+type runRequest struct {
+	Concurrency int  `json:"concurrency"`
+	Check       bool `json:"check"`
+	// Limit is parsed using ParseLimit.
+	Limit string   `json:"limit"`
+	Hosts []string `json:"hosts"`
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "hosts":
+		a.listHosts(w, r)
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "hosts" &&
+		parts[2] == "operations":
+		a.listOperations(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "runs":
+		a.listRuns(w, r)
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "runs":
+		a.startRun(w, r)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "runs":
+		a.getRun(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "runs" &&
+		parts[2] == "results":
+		a.getResults(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "runs" &&
+		parts[2] == "output":
+		a.getOutput(w, r, parts[1])
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "runs" &&
+		parts[2] == "cancel":
+		a.cancelRun(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "workers":
+		a.listWorkers(w, r)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[0] == "workers" &&
+		parts[1] == "register":
+		a.registerWorker(w, r)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[0] == "workers" &&
+		parts[1] == "heartbeat":
+		a.heartbeat(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method,
+			r.URL.Path))
+	}
+}
+
+func (a *API) listHosts(w http.ResponseWriter, r *http.Request) {
+	target, err := ParseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hosts, err := a.m.GetHosts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	hosts, err = target.Select(hosts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := []hostJSON{}
+	for _, h := range hosts {
+		out = append(out, hostJSON{
+			Hostname:           h.Hostname,
+			User:               h.User,
+			KeyName:            h.KeyName,
+			PasswordName:       h.PasswordName,
+			HostKeyFingerprint: h.HostKeyFingerprint,
+			Labels:             h.Labels,
+			Groups:             h.Groups,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) listOperations(w http.ResponseWriter, r *http.Request, hostname string) {
+	hosts, err := a.m.GetHosts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	hosts, err = Target{Hostnames: []string{hostname}}.Select(hosts)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	operations, err := a.m.GetHostOperations(hosts[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := []operationJSON{}
+	for _, o := range operations {
+		out = append(out, operationJSON{
+			Description: o.Description,
+			ScriptName:  o.ScriptName,
+			Attributes:  o.Attributes,
+			Timeout:     int(o.Timeout / time.Second),
+			Order:       o.Order,
+			DependsOn:   o.DependsOn,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) listRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+			return
+		}
+	}
+
+	runs, err := a.m.GetRuns(limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := []runJSON{}
+	for _, run := range runs {
+		out = append(out, a.runJSON(run))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) startRun(w http.ResponseWriter, r *http.Request) {
+	var req runRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+			return
+		}
+	}
+
+	spec := a.defaults
+	spec.ID = gocql.TimeUUID()
+	if req.Concurrency > 0 {
+		spec.Concurrency = req.Concurrency
+	}
+	if req.Check {
+		spec.Check = true
+	}
+	if req.Limit != "" || len(req.Hosts) > 0 {
+		target, err := ParseLimit(req.Limit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		target.Hostnames = req.Hosts
+
+		// Reject unknown hosts before the run is started.
+		hosts, err := a.m.GetHosts()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := target.Select(hosts); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		spec.Target = target
+	}
+
+	ctx, cancel := context.WithCancel(a.ctx)
+	a.lock.Lock()
+	a.active[spec.ID] = cancel
+	a.lock.Unlock()
+
+	a.wg.Add(1)
+	go func() {
+		defer func() {
+			a.lock.Lock()
+			delete(a.active, spec.ID)
+			a.lock.Unlock()
+			cancel()
+			a.wg.Done()
+		}()
+
+		if _, err := a.m.Run(ctx, spec); err != nil {
+			log.Printf("Run %s failed: %v", spec.ID, err)
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": spec.ID.String()})
+}
+
+// Cancels a run which is in progress. The run completes in the background once the workers have
+// stopped executing its operations.
+func (a *API) cancelRun(w http.ResponseWriter, r *http.Request, id string) {
+	runID, err := gocql.ParseUUID(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid run ID %q", id))
+		return
+	}
+
+	a.lock.Lock()
+	cancel, ok := a.active[runID]
+	a.lock.Unlock()
+	if !ok {
+		if _, err := a.m.GetRun(runID); err == ErrRunNotFound {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusConflict, fmt.Errorf("run %s isn't in progress", id))
+		return
+	}
+
+	log.Printf("Cancelling run %s", id)
+	cancel()
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": id})
+}
+
+func (a *API) getRun(w http.ResponseWriter, r *http.Request, id string) {
+	runID, err := gocql.ParseUUID(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid run ID %q", id))
+		return
+	}
+
+	run, err := a.m.GetRun(runID)
+	if err == ErrRunNotFound && a.isActive(runID) {
+		// The run was triggered but hasn't been stored yet.
+		writeJSON(w, http.StatusOK, runJSON{ID: id, Status: runStatusRunning})
+		return
+	}
+	if err == ErrRunNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	results, err := a.m.GetResults(runID, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := a.runJSON(run)
+	out.Hosts = make(map[string]hostStatus)
+	for _, res := range results {
+		if out.Hosts[res.Hostname] == nil {
+			out.Hosts[res.Hostname] = make(hostStatus)
+		}
+		out.Hosts[res.Hostname][res.Status]++
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) getResults(w http.ResponseWriter, r *http.Request, id string) {
+	runID, err := gocql.ParseUUID(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid run ID %q", id))
+		return
+	}
+
+	results, err := a.m.GetResults(runID, r.URL.Query().Get("host"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := []resultJSON{}
+	for _, res := range results {
+		out = append(out, resultJSON{
+			Hostname:    res.Hostname,
+			Description: res.Operation.Description,
+			ScriptName:  res.Operation.ScriptName,
+			Status:      string(res.Status),
+			Successful:  res.Successful,
+			ExitCode:    res.ExitCode,
+			Signal:      res.Signal,
+			Error:       res.Error,
+			StdOut:      res.StdOut,
+			StdErr:      res.StdErr,
+			StartTime:   res.StartTime,
+			EndTime:     res.EndTime,
+			Worker:      res.Worker,
+			Attempts:    res.Attempts,
+			Changed:     res.Changed,
+			Facts:       res.Facts,
+			Message:     res.Message,
+
+			ModuleVersion: res.ModuleVersion,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) getOutput(w http.ResponseWriter, r *http.Request, id string) {
+	runID, err := gocql.ParseUUID(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid run ID %q", id))
+		return
+	}
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		writeError(w, http.StatusBadRequest, errors.New("host is required"))
+		return
+	}
+
+	output, err := a.m.GetOutput(runID, host)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := []outputJSON{}
+	for _, o := range output {
+		out = append(out, outputJSON{
+			Description: o.Description,
+			Stream:      o.Stream,
+			Data:        o.Data,
+			Timestamp:   o.Timestamp,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) listWorkers(w http.ResponseWriter, r *http.Request) {
+	a.m.lock.RLock()
+	out := []workerJSON{}
+	for _, wc := range a.m.Workers {
+		wj := workerJSON{Addr: wc.Addr, Static: wc.Static, Outstanding: wc.Outstanding}
+		if !wc.LastSeen.IsZero() {
+			lastSeen := wc.LastSeen
+			wj.LastSeen = &lastSeen
+		}
+		out = append(out, wj)
+	}
+	a.m.lock.RUnlock()
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// Returns whether a worker registration or heartbeat request is authorized.
+func (a *API) authorizeWorker(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if a.RegistrationToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.RegistrationToken)) == 1
+}
+
+// The error returned for unauthorized worker registrations and heartbeats.
+var errUnauthorizedWorker = errors.New("a valid registration token or TLS client certificate is required")
+
+func (a *API) registerWorker(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizeWorker(r) {
+		writeError(w, http.StatusUnauthorized, errUnauthorizedWorker)
+		return
+	}
+	req, err := decodeWorkerRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := a.m.RegisterWorker(req.Addr); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (a *API) heartbeat(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizeWorker(r) {
+		writeError(w, http.StatusUnauthorized, errUnauthorizedWorker)
+		return
+	}
+	req, err := decodeWorkerRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = a.m.Heartbeat(req.Addr)
+	if err == ErrWorkerNotRegistered {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func decodeWorkerRequest(r *http.Request) (workerRequest, error) {
+	var req workerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, fmt.Errorf("invalid request body: %v", err)
+	}
+	if req.Addr == "" {
+		return req, fmt.Errorf("addr is required")
+	}
+	return req, nil
+}
+
+func (a *API) isActive(id gocql.UUID) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.active[id]
+	return ok
+}
+
+func (a *API) runJSON(run Run) runJSON {
+	out := runJSON{ID: run.ID.String(), CreateTime: run.CreateTime, Check: run.Check,
+		Counts: run.Counts}
+	switch {
+	case !run.EndTime.IsZero():
+		out.Status = runStatusCompleted
+		out.EndTime = &run.EndTime
+	case a.isActive(run.ID):
+		out.Status = runStatusRunning
+	default:
+		out.Status = runStatusIncomplete
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,217 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestAPI(t *testing.T) {
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root", PasswordName: "host_password"})
+	s.AddOperation("host1", ops.Operation{Description: "op", ScriptName: "file_exists"})
+	m := Master{Store: s}
+	api := NewAPI(context.Background(), &m, RunSpec{Concurrency: 1})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	// List hosts
+	resp, err := http.Get(server.URL + "/hosts")
+	if err != nil {
+		t.Fatalf("Error listing hosts: %v", err)
+	}
+	var hosts []map[string]string
+	json.NewDecoder(resp.Body).Decode(&hosts)
+	resp.Body.Close()
+	if len(hosts) != 1 || hosts[0]["hostname"] != "host1" ||
+		hosts[0]["password_name"] != "host_password" {
+		t.Fatalf("Wrong hosts: got %v", hosts)
+	}
+
+	// List hosts matching a limit
+	resp, err = http.Get(server.URL + "/hosts?limit=env=prod")
+	if err != nil {
+		t.Fatalf("Error listing hosts: %v", err)
+	}
+	hosts = nil
+	json.NewDecoder(resp.Body).Decode(&hosts)
+	resp.Body.Close()
+	if len(hosts) != 0 {
+		t.Fatalf("Wrong hosts: got %v want none", hosts)
+	}
+
+	// Runs can't be limited to unknown hosts.
+	resp, err = http.Post(server.URL+"/runs", "application/json",
+		strings.NewReader(`{"hosts": ["nosuchhost"]}`))
+	if err != nil {
+		t.Fatalf("Error starting run: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Wrong status code: got %d want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// Trigger a run. There are no workers, so no results are stored.
+	resp, err = http.Post(server.URL+"/runs", "application/json", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Error starting run: %v", err)
+	}
+	var started map[string]string
+	json.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || started["id"] == "" {
+		t.Fatalf("Wrong response: got %d %v", resp.StatusCode, started)
+	}
+	api.Wait()
+
+	// Get the run's status
+	resp, err = http.Get(server.URL + "/runs/" + started["id"])
+	if err != nil {
+		t.Fatalf("Error getting run: %v", err)
+	}
+	var run runJSON
+	json.NewDecoder(resp.Body).Decode(&run)
+	resp.Body.Close()
+	if run.ID != started["id"] || run.Status != runStatusCompleted || run.EndTime == nil {
+		t.Fatalf("Wrong run: got %+v", run)
+	}
+
+	// The output endpoint requires a host.
+	resp, err = http.Get(server.URL + "/runs/" + started["id"] + "/output")
+	if err != nil {
+		t.Fatalf("Error getting output: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Wrong status code: got %d want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	resp, err = http.Get(server.URL + "/runs/" + started["id"] + "/output?host=host1")
+	if err != nil {
+		t.Fatalf("Error getting output: %v", err)
+	}
+	var output []outputJSON
+	json.NewDecoder(resp.Body).Decode(&output)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || output == nil || len(output) != 0 {
+		t.Fatalf("Wrong output: got %d %v", resp.StatusCode, output)
+	}
+
+	// A completed run can't be cancelled.
+	resp, err = http.Post(server.URL+"/runs/"+started["id"]+"/cancel", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error cancelling run: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Wrong status code: got %d want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	// Unknown run
+	resp, err = http.Get(server.URL + "/runs/00000000-0000-0000-0000-000000000000")
+	if err != nil {
+		t.Fatalf("Error getting run: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Wrong status code: got %d want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAPICancelRun(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{cancel: make(chan string)})
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op"})
+	m := Master{Store: s}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	api := NewAPI(context.Background(), &m, RunSpec{})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/runs", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error starting run: %v", err)
+	}
+	var started map[string]string
+	json.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	waitBusy(t, &m)
+
+	resp, err = http.Post(server.URL+"/runs/"+started["id"]+"/cancel", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error cancelling run: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Wrong status code: got %d want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	api.Wait()
+
+	id, _ := gocql.ParseUUID(started["id"])
+	run, err := m.GetRun(id)
+	if err != nil || run.EndTime.IsZero() {
+		t.Fatalf("Run wasn't completed: got %+v, %v", run, err)
+	}
+	results, _ := m.GetResults(id, "host1")
+	if len(results) != 1 || results[0].Status != ops.StatusCancelled {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+func TestAPIRegisterWorkerAuthorization(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	tests := []struct {
+		name              string
+		registrationToken string
+		token             string
+		want              int
+	}{
+		{"no token configured", "", "", http.StatusUnauthorized},
+		{"no token configured but one sent", "", "secret", http.StatusUnauthorized},
+		{"missing token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "wrong", http.StatusUnauthorized},
+		{"valid token", "secret", "secret", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := Master{Store: NewMemoryStore()}
+			api := NewAPI(context.Background(), &m, RunSpec{})
+			api.RegistrationToken = tc.registrationToken
+			server := httptest.NewServer(api)
+			defer server.Close()
+
+			for _, path := range []string{"/workers/register", "/workers/heartbeat"} {
+				req, _ := http.NewRequest(http.MethodPost, server.URL+path,
+					strings.NewReader(`{"addr": "`+addr+`"}`))
+				if tc.token != "" {
+					req.Header.Set("Authorization", "Bearer "+tc.token)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Error posting to %s: %v", path, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.want {
+					t.Fatalf("Wrong status code for %s: got %d want %d", path, resp.StatusCode, tc.want)
+				}
+			}
+			registered := tc.want == http.StatusOK
+			if got := len(m.Workers) == 1; got != registered {
+				t.Fatalf("Wrong registration: got %t want %t", got, registered)
+			}
+		})
+	}
+}
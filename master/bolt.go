@@ -0,0 +1,879 @@
+package master
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Store which is backed by an embedded, file-based BoltDB database. It is meant for
+// small deployments (labs, edge sites) where running a ScyllaDB cluster is not justified.
+//
+// The data is laid out in buckets which follow the tables in db/seed.cql. Records are stored as
+// JSON documents whose keys match the columns of the corresponding tables:
+//
+//	hosts:                           hostname -> host
+//	operations/<hostname>:           sequence -> operation
+//	group_operations/<group>:        sequence -> operation
+//	roles:                           role name -> role, including its operations
+//	host_roles/<hostname>:           sequence -> role assignment
+//	global_variables:                variable name -> value
+//	group_variables/<group>:         variable name -> value
+//	host_variables/<hostname>:       variable name -> value
+//	runs:                            run ID -> run
+//	results/<run ID>/<hostname>:     sequence -> result
+//	output/<run ID>/<hostname>:      sequence -> output chunk
+//
+// The nested results buckets satisfy both the "results by run ID" and the "results by run ID and
+// hostname" queries, so a single bucket replaces the two results tables.
+type BoltStore struct {
+	db *bolt.DB
+
+	// Output chunks which weren't written to the DB yet (see StoreOutput). flushLock serializes
+	// flushes, which keeps the chunks in order.
+	outputLock     sync.Mutex
+	output         []Output
+	flushScheduled bool
+	flushLock      sync.Mutex
+}
+
+// The maximum time output chunks are buffered before they are written to the DB.
+var outputFlushInterval = 100 * time.Millisecond
+
+var (
+	bucketMeta       = []byte("meta")
+	bucketHosts      = []byte("hosts")
+	bucketOperations = []byte("operations")
+	bucketRuns       = []byte("runs")
+	bucketResults    = []byte("results")
+	bucketOutput     = []byte("output")
+
+	bucketGroupOperations = []byte("group_operations")
+	bucketRoles           = []byte("roles")
+	bucketHostRoles       = []byte("host_roles")
+	bucketGlobalVariables = []byte("global_variables")
+	bucketGroupVariables  = []byte("group_variables")
+	bucketHostVariables   = []byte("host_variables")
+
+	keySchemaVersion = []byte("schema_version")
+)
+
+// boltMigrations bring an embedded DB up to date with the latest schema. They are applied in
+// order and the number of applied migrations is recorded in the meta bucket, so each migration
+// runs exactly once per DB. Released migrations must never be changed - add a new one instead.
+//
+// Since records are JSON documents, adding a column doesn't require a migration. Migrations are
+// needed only when buckets are added or when existing records have to be rewritten.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// 1: Initial schema.
+	func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketHosts, bucketOperations, bucketRuns, bucketResults} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: Output streamed while operations execute.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketOutput)
+		return err
+	},
+	// 3: Operations of host groups.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketGroupOperations)
+		return err
+	},
+	// 4: Roles and their assignment to hosts.
+	func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketRoles, bucketHostRoles} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 5: Global, group and host variables.
+	func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketGlobalVariables, bucketGroupVariables, bucketHostVariables} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+type boltHost struct {
+	Hostname           string `json:"hostname"`
+	User               string `json:"user"`
+	KeyName            string `json:"key_name"`
+	PasswordName       string `json:"password_name"`
+	HostKeyFingerprint string `json:"host_key_fingerprint"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+	Groups []string          `json:"groups,omitempty"`
+}
+
+type boltOperation struct {
+	Description string            `json:"description"`
+	ScriptName  string            `json:"script_name"`
+	Attributes  map[string]string `json:"attributes"`
+	// Timeout in seconds.
+	Timeout   int      `json:"timeout,omitempty"`
+	Order     int      `json:"order,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// Converts an Operation to a stored operation.
+func newBoltOperation(o ops.Operation) boltOperation {
+	return boltOperation{
+		Description: o.Description,
+		ScriptName:  o.ScriptName,
+		Attributes:  o.Attributes,
+		Timeout:     int(o.Timeout / time.Second),
+		Order:       o.Order,
+		DependsOn:   o.DependsOn,
+	}
+}
+
+// Converts a stored operation to an Operation.
+func (o *boltOperation) operation() ops.Operation {
+	return ops.Operation{
+		Description: o.Description,
+		ScriptName:  o.ScriptName,
+		Attributes:  o.Attributes,
+		Timeout:     time.Duration(o.Timeout) * time.Second,
+		Order:       o.Order,
+		DependsOn:   o.DependsOn,
+	}
+}
+
+type boltRole struct {
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Operations []boltOperation   `json:"operations"`
+}
+
+type boltRoleAssignment struct {
+	Role       string            `json:"role"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type boltRun struct {
+	ID         gocql.UUID `json:"id"`
+	CreateTime time.Time  `json:"create_time"`
+	EndTime    time.Time  `json:"end_time"`
+	Check      bool       `json:"check,omitempty"`
+
+	Counts map[ops.Status]int `json:"counts,omitempty"`
+}
+
+// Converts a stored run to a Run.
+func (r *boltRun) run() Run {
+	return Run{ID: r.ID, CreateTime: r.CreateTime, EndTime: r.EndTime, Check: r.Check,
+		Counts: r.Counts}
+}
+
+type boltResult struct {
+	RunID       gocql.UUID        `json:"run_id"`
+	Hostname    string            `json:"hostname"`
+	Timestamp   time.Time         `json:"ts"`
+	Description string            `json:"description"`
+	ScriptName  string            `json:"script_name"`
+	Successful  bool              `json:"successful"`
+	Status      string            `json:"status"`
+	StdOut      string            `json:"stdout"`
+	StdErr      string            `json:"stderr"`
+	ExitCode    int               `json:"exit_code"`
+	Signal      string            `json:"signal"`
+	Error       string            `json:"error"`
+	StartTime   time.Time         `json:"start_time"`
+	EndTime     time.Time         `json:"end_time"`
+	Worker      string            `json:"worker"`
+	Attempts    int               `json:"attempts"`
+	Changed     bool              `json:"changed,omitempty"`
+	Facts       map[string]string `json:"facts,omitempty"`
+	Message     string            `json:"message,omitempty"`
+
+	ModuleVersion string `json:"module_version,omitempty"`
+}
+
+type boltOutput struct {
+	Description string    `json:"description"`
+	Stream      string    `json:"stream"`
+	Data        string    `json:"data"`
+	Timestamp   time.Time `json:"ts"`
+}
+
+// Converts a stored result to a Result.
+func (r *boltResult) result() Result {
+	return Result{
+		OperationResult: ops.OperationResult{
+			Operation: ops.Operation{
+				Description: r.Description,
+				ScriptName:  r.ScriptName,
+			},
+			StdOut:     r.StdOut,
+			StdErr:     r.StdErr,
+			Successful: r.Successful,
+			Status:     ops.Status(r.Status),
+			ExitCode:   r.ExitCode,
+			Signal:     r.Signal,
+			Error:      r.Error,
+			StartTime:  r.StartTime,
+			EndTime:    r.EndTime,
+			Worker:     r.Worker,
+			Attempts:   r.Attempts,
+			Changed:    r.Changed,
+			Facts:      r.Facts,
+			Message:    r.Message,
+
+			ModuleVersion: r.ModuleVersion,
+		},
+		RunID:     r.RunID,
+		Hostname:  r.Hostname,
+		Timestamp: r.Timestamp,
+	}
+}
+
+// NewBoltStore opens the BoltDB database at the given path, creating it if necessary, and applies
+// any pending schema migrations.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening DB file: %v", err)
+	}
+
+	s := &BoltStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Applies all the migrations which haven't been applied to the DB yet.
+func (s *BoltStore) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return fmt.Errorf("error creating meta bucket: %v", err)
+		}
+
+		var version uint64
+		if v := meta.Get(keySchemaVersion); v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		if version > uint64(len(boltMigrations)) {
+			return fmt.Errorf("DB schema version %d is newer than the latest known version %d",
+				version, len(boltMigrations))
+		}
+
+		for i := version; i < uint64(len(boltMigrations)); i++ {
+			if err := boltMigrations[i](tx); err != nil {
+				return fmt.Errorf("error applying migration %d: %v", i+1, err)
+			}
+		}
+
+		return meta.Put(keySchemaVersion, itob(uint64(len(boltMigrations))))
+	})
+}
+
+// AddHost adds a host to the inventory. An existing host with the same hostname is replaced.
+func (s *BoltStore) AddHost(h ops.Host) error {
+	v, err := json.Marshal(boltHost{
+		Hostname:           h.Hostname,
+		User:               h.User,
+		KeyName:            h.KeyName,
+		PasswordName:       h.PasswordName,
+		HostKeyFingerprint: h.HostKeyFingerprint,
+		Labels:             h.Labels,
+		Groups:             h.Groups,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding host: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHosts).Put([]byte(h.Hostname), v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing host in DB: %v", err)
+	}
+	return nil
+}
+
+// SetHostKeyFingerprint pins the SSH host key fingerprint of the given host.
+func (s *BoltStore) SetHostKeyFingerprint(hostname, fingerprint string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHosts)
+		v := b.Get([]byte(hostname))
+		if v == nil {
+			return fmt.Errorf("no such host: %s", hostname)
+		}
+
+		var h boltHost
+		if err := json.Unmarshal(v, &h); err != nil {
+			return fmt.Errorf("error decoding host %s: %v", hostname, err)
+		}
+		h.HostKeyFingerprint = fingerprint
+
+		v, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(hostname), v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing host key fingerprint in DB: %v", err)
+	}
+	return nil
+}
+
+// AddOperation adds an operation for the given host.
+func (s *BoltStore) AddOperation(hostname string, o ops.Operation) error {
+	return s.addOperation(bucketOperations, hostname, o)
+}
+
+// AddGroupOperation adds an operation for the hosts in the given group.
+func (s *BoltStore) AddGroupOperation(group string, o ops.Operation) error {
+	return s.addOperation(bucketGroupOperations, group, o)
+}
+
+// Adds an operation to the nested bucket key of the given bucket.
+func (s *BoltStore) addOperation(bucket []byte, key string, o ops.Operation) error {
+	v, err := json.Marshal(newBoltOperation(o))
+	if err != nil {
+		return fmt.Errorf("error encoding operation: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		return putNext(b, v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing operation in DB: %v", err)
+	}
+	return nil
+}
+
+// AddRole adds a role, replacing an existing role with the same name.
+func (s *BoltStore) AddRole(r ops.Role) error {
+	br := boltRole{Name: r.Name, Attributes: r.Attributes, Operations: []boltOperation{}}
+	for _, o := range r.Operations {
+		br.Operations = append(br.Operations, newBoltOperation(o))
+	}
+	v, err := json.Marshal(br)
+	if err != nil {
+		return fmt.Errorf("error encoding role: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRoles).Put([]byte(r.Name), v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing role in DB: %v", err)
+	}
+	return nil
+}
+
+// AddHostRole assigns a role to a host after the roles which are already assigned to it.
+func (s *BoltStore) AddHostRole(hostname string, a ops.RoleAssignment) error {
+	v, err := json.Marshal(boltRoleAssignment{Role: a.Role, Attributes: a.Attributes})
+	if err != nil {
+		return fmt.Errorf("error encoding role assignment: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucketHostRoles).CreateBucketIfNotExists([]byte(hostname))
+		if err != nil {
+			return err
+		}
+		return putNext(b, v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing role assignment in DB: %v", err)
+	}
+	return nil
+}
+
+// SetVariable sets a variable in the given scope, replacing its existing value.
+func (s *BoltStore) SetVariable(scope VariableScope, scopeName, name, value string) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error encoding variable: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := variablesBucket(tx, scope, scopeName, true)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing variable in DB: %v", err)
+	}
+	return nil
+}
+
+// GetHosts gets all the hosts from the DB sorted by hostname.
+func (s *BoltStore) GetHosts() ([]ops.Host, error) {
+	var hosts []ops.Host
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHosts).ForEach(func(k, v []byte) error {
+			var h boltHost
+			if err := json.Unmarshal(v, &h); err != nil {
+				return fmt.Errorf("error decoding host %s: %v", k, err)
+			}
+			hosts = append(hosts, ops.Host{
+				Hostname:           h.Hostname,
+				User:               h.User,
+				KeyName:            h.KeyName,
+				PasswordName:       h.PasswordName,
+				HostKeyFingerprint: h.HostKeyFingerprint,
+				Labels:             h.Labels,
+				Groups:             h.Groups,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return []ops.Host{}, fmt.Errorf("error getting hosts from DB: %v", err)
+	}
+
+	return hosts, nil
+}
+
+// GetOperations gets all operations for the given host from the DB in the order they were added.
+func (s *BoltStore) GetOperations(hostname string) ([]ops.Operation, error) {
+	return s.getOperations(bucketOperations, hostname)
+}
+
+// GetGroupOperations gets all operations for the given group from the DB in the order they were
+// added.
+func (s *BoltStore) GetGroupOperations(group string) ([]ops.Operation, error) {
+	return s.getOperations(bucketGroupOperations, group)
+}
+
+// Gets the operations in the nested bucket key of the given bucket.
+func (s *BoltStore) getOperations(bucket []byte, key string) ([]ops.Operation, error) {
+	var operations []ops.Operation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var o boltOperation
+			if err := json.Unmarshal(v, &o); err != nil {
+				return fmt.Errorf("error decoding operation: %v", err)
+			}
+			operations = append(operations, o.operation())
+			return nil
+		})
+	})
+	if err != nil {
+		return []ops.Operation{}, fmt.Errorf("error getting operations from DB: %v", err)
+	}
+
+	return operations, nil
+}
+
+// GetHostRoles gets the roles which are assigned to the given host from the DB in the order they
+// were assigned.
+func (s *BoltStore) GetHostRoles(hostname string) ([]ops.RoleAssignment, error) {
+	var roles []ops.RoleAssignment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHostRoles).Bucket([]byte(hostname))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var a boltRoleAssignment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("error decoding role assignment: %v", err)
+			}
+			roles = append(roles, ops.RoleAssignment{Role: a.Role, Attributes: a.Attributes})
+			return nil
+		})
+	})
+	if err != nil {
+		return []ops.RoleAssignment{}, fmt.Errorf("error getting roles from DB: %v", err)
+	}
+
+	return roles, nil
+}
+
+// GetRole gets the role with the given name from the DB.
+func (s *BoltStore) GetRole(name string) (ops.Role, error) {
+	var br boltRole
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketRoles).Get([]byte(name))
+		if v == nil {
+			return ErrRoleNotFound
+		}
+		return json.Unmarshal(v, &br)
+	})
+	if err == ErrRoleNotFound {
+		return ops.Role{}, err
+	}
+	if err != nil {
+		return ops.Role{}, fmt.Errorf("error getting role from DB: %v", err)
+	}
+
+	r := ops.Role{Name: br.Name, Attributes: br.Attributes}
+	for _, o := range br.Operations {
+		r.Operations = append(r.Operations, o.operation())
+	}
+	return r, nil
+}
+
+// GetVariables gets the variables which are defined in the given scope from the DB.
+func (s *BoltStore) GetVariables(scope VariableScope, scopeName string) (map[string]string, error) {
+	vars := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := variablesBucket(tx, scope, scopeName, false)
+		if b == nil || err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var value string
+			if err := json.Unmarshal(v, &value); err != nil {
+				return fmt.Errorf("error decoding variable: %v", err)
+			}
+			vars[string(k)] = value
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting variables from DB: %v", err)
+	}
+
+	return vars, nil
+}
+
+// Returns the bucket which holds the variables of the given scope. If create is false, a nil
+// bucket is returned for a group or host which has no variables.
+func variablesBucket(tx *bolt.Tx, scope VariableScope, scopeName string, create bool) (*bolt.Bucket, error) {
+	var parent *bolt.Bucket
+	switch scope {
+	case ScopeGlobal:
+		return tx.Bucket(bucketGlobalVariables), nil
+	case ScopeGroup:
+		parent = tx.Bucket(bucketGroupVariables)
+	case ScopeHost:
+		parent = tx.Bucket(bucketHostVariables)
+	default:
+		return nil, fmt.Errorf("unknown variable scope %q", scope)
+	}
+
+	if create {
+		return parent.CreateBucketIfNotExists([]byte(scopeName))
+	}
+	return parent.Bucket([]byte(scopeName)), nil
+}
+
+// StoreRun stores a new run in the DB.
+func (s *BoltStore) StoreRun(r Run) error {
+	v, err := json.Marshal(boltRun{ID: r.ID, CreateTime: r.CreateTime, Check: r.Check})
+	if err != nil {
+		return fmt.Errorf("error encoding run: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRuns).Put(r.ID.Bytes(), v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing run in DB: %v", err)
+	}
+	return nil
+}
+
+// FinishRun updates a stored run in the DB once it has completed.
+func (s *BoltStore) FinishRun(r Run) error {
+	v, err := json.Marshal(boltRun{ID: r.ID, CreateTime: r.CreateTime, EndTime: r.EndTime,
+		Check: r.Check, Counts: r.Counts})
+	if err != nil {
+		return fmt.Errorf("error encoding run: %v", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRuns).Put(r.ID.Bytes(), v)
+	})
+	if err != nil {
+		return fmt.Errorf("error storing run in DB: %v", err)
+	}
+	return nil
+}
+
+// GetRun gets the run with the given ID from the DB.
+func (s *BoltStore) GetRun(id gocql.UUID) (Run, error) {
+	var r boltRun
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketRuns).Get(id.Bytes())
+		if v == nil {
+			return ErrRunNotFound
+		}
+		return json.Unmarshal(v, &r)
+	})
+	if err == ErrRunNotFound {
+		return Run{}, err
+	}
+	if err != nil {
+		return Run{}, fmt.Errorf("error getting run from DB: %v", err)
+	}
+
+	return r.run(), nil
+}
+
+// GetRuns gets up to limit runs from the DB, most recent first.
+func (s *BoltStore) GetRuns(limit int) ([]Run, error) {
+	var runs []Run
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRuns).ForEach(func(k, v []byte) error {
+			var r boltRun
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("error decoding run: %v", err)
+			}
+			runs = append(runs, r.run())
+			return nil
+		})
+	})
+	if err != nil {
+		return []Run{}, fmt.Errorf("error getting runs from DB: %v", err)
+	}
+
+	return sortRuns(runs, limit), nil
+}
+
+// GetResults gets the results of a run from the DB, optionally only for the given host.
+func (s *BoltStore) GetResults(runID gocql.UUID, hostname string) ([]Result, error) {
+	var results []Result
+	readHost := func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			var r boltResult
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("error decoding result: %v", err)
+			}
+			results = append(results, r.result())
+			return nil
+		})
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		rb := tx.Bucket(bucketResults).Bucket(runID.Bytes())
+		if rb == nil {
+			return nil
+		}
+		if hostname != "" {
+			if hb := rb.Bucket([]byte(hostname)); hb != nil {
+				return readHost(hb)
+			}
+			return nil
+		}
+		return rb.ForEach(func(k, v []byte) error {
+			return readHost(rb.Bucket(k))
+		})
+	})
+	if err != nil {
+		return []Result{}, fmt.Errorf("error getting results from DB: %v", err)
+	}
+
+	sortResults(results)
+	return results, nil
+}
+
+// StoreResults stores the results of a run in the DB. All the results are stored in a single
+// transaction.
+func (s *BoltStore) StoreResults(runID gocql.UUID, hostname string, results []ops.OperationResult) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rb, err := tx.Bucket(bucketResults).CreateBucketIfNotExists(runID.Bytes())
+		if err != nil {
+			return err
+		}
+		hb, err := rb.CreateBucketIfNotExists([]byte(hostname))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, r := range results {
+			v, err := json.Marshal(boltResult{
+				RunID:       runID,
+				Hostname:    hostname,
+				Timestamp:   now,
+				Description: r.Operation.Description,
+				ScriptName:  r.Operation.ScriptName,
+				Successful:  r.Successful,
+				Status:      string(r.Status),
+				StdOut:      r.StdOut,
+				StdErr:      r.StdErr,
+				ExitCode:    r.ExitCode,
+				Signal:      r.Signal,
+				Error:       r.Error,
+				StartTime:   r.StartTime,
+				EndTime:     r.EndTime,
+				Worker:      r.Worker,
+				Attempts:    r.Attempts,
+				Changed:     r.Changed,
+				Facts:       r.Facts,
+				Message:     r.Message,
+
+				ModuleVersion: r.ModuleVersion,
+			})
+			if err != nil {
+				return err
+			}
+			if err := putNext(hb, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error storing results in DB: %v", err)
+	}
+	return nil
+}
+
+// StoreOutput stores a chunk of an operation's output in the DB. Since every write transaction
+// syncs the DB file, chunks are buffered and written together once outputFlushInterval passes.
+// Errors which occur while writing buffered chunks are logged.
+func (s *BoltStore) StoreOutput(o Output) error {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+
+	s.output = append(s.output, o)
+	if !s.flushScheduled {
+		s.flushScheduled = true
+		time.AfterFunc(outputFlushInterval, func() {
+			if err := s.flushOutput(); err != nil {
+				log.Print(err)
+			}
+		})
+	}
+	return nil
+}
+
+// Writes the buffered output chunks to the DB in a single transaction.
+func (s *BoltStore) flushOutput() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.outputLock.Lock()
+	output := s.output
+	s.output = nil
+	s.flushScheduled = false
+	s.outputLock.Unlock()
+	if len(output) == 0 {
+		return nil
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, o := range output {
+			rb, err := tx.Bucket(bucketOutput).CreateBucketIfNotExists(o.RunID.Bytes())
+			if err != nil {
+				return err
+			}
+			hb, err := rb.CreateBucketIfNotExists([]byte(o.Hostname))
+			if err != nil {
+				return err
+			}
+
+			v, err := json.Marshal(boltOutput{
+				Description: o.Description,
+				Stream:      o.Stream,
+				Data:        o.Data,
+				Timestamp:   o.Timestamp,
+			})
+			if err != nil {
+				return err
+			}
+			if err := putNext(hb, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error storing output in DB: %v", err)
+	}
+	return nil
+}
+
+// GetOutput gets the output stored for a host in a run from the DB, oldest first. Buffered output
+// is written to the DB first.
+func (s *BoltStore) GetOutput(runID gocql.UUID, hostname string) ([]Output, error) {
+	if err := s.flushOutput(); err != nil {
+		return []Output{}, err
+	}
+
+	var output []Output
+	err := s.db.View(func(tx *bolt.Tx) error {
+		rb := tx.Bucket(bucketOutput).Bucket(runID.Bytes())
+		if rb == nil {
+			return nil
+		}
+		hb := rb.Bucket([]byte(hostname))
+		if hb == nil {
+			return nil
+		}
+		return hb.ForEach(func(k, v []byte) error {
+			var o boltOutput
+			if err := json.Unmarshal(v, &o); err != nil {
+				return fmt.Errorf("error decoding output: %v", err)
+			}
+			output = append(output, Output{
+				RunID:       runID,
+				Hostname:    hostname,
+				Description: o.Description,
+				Stream:      o.Stream,
+				Data:        o.Data,
+				Timestamp:   o.Timestamp,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return []Output{}, fmt.Errorf("error getting output from DB: %v", err)
+	}
+
+	return output, nil
+}
+
+// Close writes the buffered output to the DB and closes the DB file.
+func (s *BoltStore) Close() error {
+	if err := s.flushOutput(); err != nil {
+		log.Print(err)
+	}
+	return s.db.Close()
+}
+
+// Stores v in b under the bucket's next sequence number, which preserves insertion order.
+func putNext(b *bolt.Bucket, v []byte) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	return b.Put(itob(seq), v)
+}
+
+// Returns an 8-byte big endian representation of v.
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
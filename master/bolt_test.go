@@ -0,0 +1,266 @@
+package master
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("Error opening DB: %v", err)
+	}
+
+	h := ops.Host{Hostname: "host1", User: "root", PasswordName: "host_password",
+		Labels: map[string]string{"env": "prod"}, Groups: []string{"web"}}
+	if err := s.AddHost(h); err != nil {
+		t.Fatalf("Error adding host: %v", err)
+	}
+	o1 := ops.Operation{
+		Description: "verify_test_file_exists",
+		ScriptName:  "file_exists",
+		Attributes:  map[string]string{"path": "/etc/passwd"},
+	}
+	o2 := ops.Operation{
+		Description: "verify_test_file_contains_1.1.1.1",
+		ScriptName:  "file_contains",
+		Attributes:  map[string]string{"path": "/etc/hosts", "text": "1.1.1.1 cloudflare-dns"},
+		Timeout:     30 * time.Second,
+	}
+	for _, o := range []ops.Operation{o1, o2} {
+		if err := s.AddOperation("host1", o); err != nil {
+			t.Fatalf("Error adding operation: %v", err)
+		}
+	}
+	if err := s.AddGroupOperation("web", o2); err != nil {
+		t.Fatalf("Error adding group operation: %v", err)
+	}
+	role := ops.Role{Name: "base", Attributes: map[string]string{"path": "/etc/hosts"},
+		Operations: []ops.Operation{o1, o2}}
+	if err := s.AddRole(role); err != nil {
+		t.Fatalf("Error adding role: %v", err)
+	}
+	assignment := ops.RoleAssignment{Role: "base", Attributes: map[string]string{"text": "x"}}
+	if err := s.AddHostRole("host1", assignment); err != nil {
+		t.Fatalf("Error adding role assignment: %v", err)
+	}
+	if err := s.SetVariable(ScopeGlobal, "", "ntp_server", "pool.ntp.org"); err != nil {
+		t.Fatalf("Error setting variable: %v", err)
+	}
+	if err := s.SetVariable(ScopeGroup, "web", "ntp_server", "ntp.web"); err != nil {
+		t.Fatalf("Error setting variable: %v", err)
+	}
+	h.HostKeyFingerprint = "SHA256:key"
+	if err := s.SetHostKeyFingerprint("host1", h.HostKeyFingerprint); err != nil {
+		t.Fatalf("Error setting host key fingerprint: %v", err)
+	}
+	if err := s.SetHostKeyFingerprint("nosuchhost", "SHA256:key"); err == nil {
+		t.Fatalf("Expected an error setting the fingerprint of an unknown host")
+	}
+	runID := gocql.TimeUUID()
+	runStart := time.Now()
+	if err := s.StoreRun(Run{ID: runID, CreateTime: runStart, Check: true}); err != nil {
+		t.Fatalf("Error storing run: %v", err)
+	}
+	r := ops.OperationResult{
+		Operation: o1,
+		StdOut:    "out",
+		Status:    ops.StatusFailed,
+		ExitCode:  1,
+		StartTime: runStart,
+		EndTime:   runStart.Add(time.Second),
+
+		ModuleVersion: "fakeversion",
+	}
+	if err := s.StoreResults(runID, "host1", []ops.OperationResult{r}); err != nil {
+		t.Fatalf("Error storing results: %v", err)
+	}
+	chunks := []Output{
+		{RunID: runID, Hostname: "host1", Description: o1.Description, Stream: "stdout", Data: "o"},
+		{RunID: runID, Hostname: "host1", Description: o1.Description, Stream: "stdout", Data: "ut"},
+	}
+	for _, o := range chunks {
+		if err := s.StoreOutput(o); err != nil {
+			t.Fatalf("Error storing output: %v", err)
+		}
+	}
+	runEnd := runStart.Add(time.Minute)
+	err = s.FinishRun(Run{ID: runID, CreateTime: runStart, EndTime: runEnd, Check: true})
+	if err != nil {
+		t.Fatalf("Error finishing run: %v", err)
+	}
+	s.Close()
+
+	// Reopen the DB to verify the data is persisted and that migrations aren't applied twice.
+	s, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("Error reopening DB: %v", err)
+	}
+	defer s.Close()
+
+	hosts, err := s.GetHosts()
+	if err != nil {
+		t.Fatalf("Error getting hosts: %v", err)
+	}
+	if !reflect.DeepEqual(hosts, []ops.Host{h}) {
+		t.Fatalf("Wrong hosts: got %v want %v", hosts, []ops.Host{h})
+	}
+
+	operations, err := s.GetOperations("host1")
+	if err != nil {
+		t.Fatalf("Error getting operations: %v", err)
+	}
+	if !reflect.DeepEqual(operations, []ops.Operation{o1, o2}) {
+		t.Fatalf("Wrong operations: got %v want %v", operations, []ops.Operation{o1, o2})
+	}
+	operations, err = s.GetGroupOperations("web")
+	if err != nil {
+		t.Fatalf("Error getting group operations: %v", err)
+	}
+	if !reflect.DeepEqual(operations, []ops.Operation{o2}) {
+		t.Fatalf("Wrong group operations: got %v want %v", operations, []ops.Operation{o2})
+	}
+	gotRole, err := s.GetRole("base")
+	if err != nil || !reflect.DeepEqual(gotRole, role) {
+		t.Fatalf("Wrong role: got %v, %v want %v", gotRole, err, role)
+	}
+	if _, err := s.GetRole("nosuchrole"); err != ErrRoleNotFound {
+		t.Fatalf("Wrong error for an unknown role: got %v want %v", err, ErrRoleNotFound)
+	}
+	assignments, err := s.GetHostRoles("host1")
+	if err != nil || !reflect.DeepEqual(assignments, []ops.RoleAssignment{assignment}) {
+		t.Fatalf("Wrong role assignments: got %v, %v want %v", assignments, err,
+			[]ops.RoleAssignment{assignment})
+	}
+	for _, tc := range []struct {
+		scope VariableScope
+		name  string
+		want  map[string]string
+	}{
+		{ScopeGlobal, "", map[string]string{"ntp_server": "pool.ntp.org"}},
+		{ScopeGroup, "web", map[string]string{"ntp_server": "ntp.web"}},
+		{ScopeHost, "host1", map[string]string{}},
+	} {
+		vars, err := s.GetVariables(tc.scope, tc.name)
+		if err != nil || !reflect.DeepEqual(vars, tc.want) {
+			t.Fatalf("Wrong %s variables: got %v, %v want %v", tc.scope, vars, err, tc.want)
+		}
+	}
+
+	runs, err := s.GetRuns(10)
+	if err != nil {
+		t.Fatalf("Error getting runs: %v", err)
+	}
+	if len(runs) != 1 || runs[0].ID != runID || !runs[0].EndTime.Equal(runEnd) || !runs[0].Check {
+		t.Fatalf("Wrong runs: got %v", runs)
+	}
+
+	results, err := s.GetResults(runID, "")
+	if err != nil {
+		t.Fatalf("Error getting results: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Wrong number of results: got %d want %d", len(results), 1)
+	}
+	got := results[0]
+	if got.Hostname != "host1" || got.Operation.Description != o1.Description ||
+		got.Status != r.Status || got.ExitCode != r.ExitCode || got.StdOut != r.StdOut ||
+		got.Duration() != time.Second || got.ModuleVersion != r.ModuleVersion {
+		t.Fatalf("Wrong result: got %+v want %+v", got.OperationResult, r)
+	}
+
+	output, err := s.GetOutput(runID, "host1")
+	if err != nil {
+		t.Fatalf("Error getting output: %v", err)
+	}
+	if !reflect.DeepEqual(output, chunks) {
+		t.Fatalf("Wrong output: got %+v want %+v", output, chunks)
+	}
+
+	operations, err = s.GetOperations("nosuchhost")
+	if err != nil {
+		t.Fatalf("Error getting operations: %v", err)
+	}
+	if len(operations) != 0 {
+		t.Fatalf("Wrong number of operations: got %d want 0", len(operations))
+	}
+}
+
+func TestBoltStoreOutputBuffering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+	defer func(d time.Duration) { outputFlushInterval = d }(outputFlushInterval)
+	outputFlushInterval = 20 * time.Millisecond
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("Error opening DB: %v", err)
+	}
+	runID := gocql.TimeUUID()
+	chunk := func(data string) Output {
+		return Output{RunID: runID, Hostname: "host1", Description: "op", Stream: "stdout", Data: data}
+	}
+	// Returns the number of chunks which were written to the DB.
+	written := func() int {
+		n := 0
+		s.db.View(func(tx *bolt.Tx) error {
+			if rb := tx.Bucket(bucketOutput).Bucket(runID.Bytes()); rb != nil {
+				n = rb.Bucket([]byte("host1")).Stats().KeyN
+			}
+			return nil
+		})
+		return n
+	}
+
+	// Buffered chunks are written once the flush interval passes.
+	s.StoreOutput(chunk("1"))
+	if n := written(); n != 0 {
+		t.Fatalf("Chunk was written before the flush interval passed: got %d chunks", n)
+	}
+	time.Sleep(10 * outputFlushInterval)
+	if n := written(); n != 1 {
+		t.Fatalf("Wrong number of written chunks: got %d want 1", n)
+	}
+
+	// Reads include buffered chunks.
+	s.StoreOutput(chunk("2"))
+	s.StoreOutput(chunk("3"))
+	output, err := s.GetOutput(runID, "host1")
+	if err != nil {
+		t.Fatalf("Error getting output: %v", err)
+	}
+	if want := []Output{chunk("1"), chunk("2"), chunk("3")}; !reflect.DeepEqual(output, want) {
+		t.Fatalf("Wrong output: got %+v want %+v", output, want)
+	}
+
+	// Closing the DB writes buffered chunks.
+	s.StoreOutput(chunk("4"))
+	s.Close()
+	s, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("Error reopening DB: %v", err)
+	}
+	defer s.Close()
+	if output, _ := s.GetOutput(runID, "host1"); len(output) != 4 || output[3].Data != "4" {
+		t.Fatalf("Wrong output after reopening: got %+v", output)
+	}
+}
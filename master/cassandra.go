@@ -0,0 +1,336 @@
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// CassandraStore is a Store which is backed by a Cassandra-compatible DB such as ScyllaDB. The
+// schema it expects can be found in db/seed.cql.
+type CassandraStore struct {
+	session *gocql.Session
+}
+
+// NewCassandraStore connects to the given DB nodes and returns a *CassandraStore which uses the
+// given keyspace.
+func NewCassandraStore(hosts []string, keyspace string) (*CassandraStore, error) {
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Keyspace = keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("error creating DB session: %v", err)
+	}
+
+	return &CassandraStore{session: session}, nil
+}
+
+// GetHosts gets all the hosts from the DB and returns a slice of Hosts.
+func (s *CassandraStore) GetHosts() ([]ops.Host, error) {
+	var hosts []ops.Host
+	var hostname, user, keyName, passwordName, fingerprint string
+	var labels map[string]string
+	var groups []string
+	q := `SELECT hostname, user, key_name, password_name, host_key_fingerprint, labels, groups
+		FROM hosts`
+	iter := s.session.Query(q).Iter()
+	for iter.Scan(&hostname, &user, &keyName, &passwordName, &fingerprint, &labels, &groups) {
+		hosts = append(hosts, ops.Host{
+			Hostname:           hostname,
+			User:               user,
+			KeyName:            keyName,
+			PasswordName:       passwordName,
+			HostKeyFingerprint: fingerprint,
+			Labels:             labels,
+			Groups:             groups,
+		})
+		labels, groups = nil, nil
+	}
+	if err := iter.Close(); err != nil {
+		return []ops.Host{}, fmt.Errorf("error getting hosts from DB: %v", err)
+	}
+
+	return hosts, nil
+}
+
+// SetHostKeyFingerprint pins the SSH host key fingerprint of the given host.
+func (s *CassandraStore) SetHostKeyFingerprint(hostname, fingerprint string) error {
+	q := `UPDATE hosts SET host_key_fingerprint = ? WHERE hostname = ?`
+	if err := s.session.Query(q, fingerprint, hostname).Exec(); err != nil {
+		return fmt.Errorf("error storing host key fingerprint in DB: %v", err)
+	}
+	return nil
+}
+
+// GetOperations gets all operations for the given host from the DB and returns them in a slice.
+func (s *CassandraStore) GetOperations(hostname string) ([]ops.Operation, error) {
+	q := `SELECT description, script_name, attributes, timeout, execution_order, depends_on
+		FROM operations where hostname = ?`
+	return s.getOperations(q, hostname)
+}
+
+// GetGroupOperations gets all operations for the given group from the DB and returns them in a
+// slice.
+func (s *CassandraStore) GetGroupOperations(group string) ([]ops.Operation, error) {
+	q := `SELECT description, script_name, attributes, timeout, execution_order, depends_on
+		FROM group_operations where group_name = ?`
+	return s.getOperations(q, group)
+}
+
+// GetHostRoles gets the roles which are assigned to the given host from the DB in the order they
+// were assigned.
+func (s *CassandraStore) GetHostRoles(hostname string) ([]ops.RoleAssignment, error) {
+	var roles []ops.RoleAssignment
+	var role string
+	var attributes map[string]string
+	q := `SELECT role, attributes FROM host_roles WHERE hostname = ?`
+	iter := s.session.Query(q, hostname).Iter()
+	for iter.Scan(&role, &attributes) {
+		roles = append(roles, ops.RoleAssignment{Role: role, Attributes: attributes})
+		attributes = nil
+	}
+	if err := iter.Close(); err != nil {
+		return []ops.RoleAssignment{}, fmt.Errorf("error getting roles from DB: %v", err)
+	}
+
+	return roles, nil
+}
+
+// GetRole gets the role with the given name, including its operations, from the DB.
+func (s *CassandraStore) GetRole(name string) (ops.Role, error) {
+	r := ops.Role{Name: name}
+	q := `SELECT attributes FROM roles WHERE name = ?`
+	err := s.session.Query(q, name).Scan(&r.Attributes)
+	if err == gocql.ErrNotFound {
+		return ops.Role{}, ErrRoleNotFound
+	}
+	if err != nil {
+		return ops.Role{}, fmt.Errorf("error getting role from DB: %v", err)
+	}
+
+	q = `SELECT description, script_name, attributes, timeout, execution_order, depends_on
+		FROM role_operations where role = ?`
+	if r.Operations, err = s.getOperations(q, name); err != nil {
+		return ops.Role{}, err
+	}
+
+	return r, nil
+}
+
+// GetVariables gets the variables which are defined in the given scope from the DB.
+func (s *CassandraStore) GetVariables(scope VariableScope, scopeName string) (map[string]string, error) {
+	var q string
+	var args []interface{}
+	switch scope {
+	case ScopeGlobal:
+		q = `SELECT name, value FROM global_variables`
+	case ScopeGroup:
+		q = `SELECT name, value FROM group_variables WHERE group_name = ?`
+		args = append(args, scopeName)
+	case ScopeHost:
+		q = `SELECT name, value FROM host_variables WHERE hostname = ?`
+		args = append(args, scopeName)
+	default:
+		return nil, fmt.Errorf("unknown variable scope %q", scope)
+	}
+
+	vars := make(map[string]string)
+	var name, value string
+	iter := s.session.Query(q, args...).Iter()
+	for iter.Scan(&name, &value) {
+		vars[name] = value
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("error getting variables from DB: %v", err)
+	}
+
+	return vars, nil
+}
+
+// Gets the operations selected by the given query, whose only parameter is key.
+func (s *CassandraStore) getOperations(q, key string) ([]ops.Operation, error) {
+	var operations []ops.Operation
+	var description, scriptName string
+	var attributes map[string]string
+	var timeout, order int
+	var dependsOn []string
+	iter := s.session.Query(q, key).Iter()
+	for iter.Scan(&description, &scriptName, &attributes, &timeout, &order, &dependsOn) {
+		o := ops.Operation{
+			Description: description,
+			ScriptName:  scriptName,
+			Attributes:  attributes,
+			Timeout:     time.Duration(timeout) * time.Second,
+			Order:       order,
+			DependsOn:   dependsOn,
+		}
+		operations = append(operations, o)
+	}
+	if err := iter.Close(); err != nil {
+		return []ops.Operation{}, fmt.Errorf("error getting operations from DB: %v", err)
+	}
+
+	return operations, nil
+}
+
+// StoreRun stores a new run in the DB.
+func (s *CassandraStore) StoreRun(r Run) error {
+	q := `INSERT INTO runs (id, create_time, check_mode) values (?, ?, ?)`
+	if err := s.session.Query(q, r.ID, r.CreateTime, r.Check).Exec(); err != nil {
+		return fmt.Errorf("error storing run in DB: %v", err)
+	}
+	return nil
+}
+
+// FinishRun updates a stored run in the DB once it has completed.
+func (s *CassandraStore) FinishRun(r Run) error {
+	q := `UPDATE runs SET end_time = ?, status_counts = ? WHERE id = ? AND create_time = ?`
+	if err := s.session.Query(q, r.EndTime, r.Counts, r.ID, r.CreateTime).Exec(); err != nil {
+		return fmt.Errorf("error updating run in DB: %v", err)
+	}
+	return nil
+}
+
+// GetRun gets the run with the given ID from the DB.
+func (s *CassandraStore) GetRun(id gocql.UUID) (Run, error) {
+	r := Run{ID: id}
+	q := `SELECT create_time, end_time, check_mode, status_counts FROM runs WHERE id = ? LIMIT 1`
+	err := s.session.Query(q, id).Scan(&r.CreateTime, &r.EndTime, &r.Check, &r.Counts)
+	if err == gocql.ErrNotFound {
+		return Run{}, ErrRunNotFound
+	}
+	if err != nil {
+		return Run{}, fmt.Errorf("error getting run from DB: %v", err)
+	}
+
+	return r, nil
+}
+
+// GetRuns gets up to limit runs from the DB, most recent first.
+//
+// NOTE: The runs table is partitioned by run ID, so getting the most recent runs requires reading
+// the entire table. This is fine for a moderate number of runs but a table which is partitioned
+// by time (e.g. by day) should be added if the number of runs grows large.
+func (s *CassandraStore) GetRuns(limit int) ([]Run, error) {
+	var runs []Run
+	var id gocql.UUID
+	var createTime, endTime time.Time
+	var check bool
+	var counts map[ops.Status]int
+	q := `SELECT id, create_time, end_time, check_mode, status_counts FROM runs`
+	iter := s.session.Query(q).Iter()
+	for iter.Scan(&id, &createTime, &endTime, &check, &counts) {
+		runs = append(runs, Run{ID: id, CreateTime: createTime, EndTime: endTime, Check: check,
+			Counts: counts})
+		counts = nil
+	}
+	if err := iter.Close(); err != nil {
+		return []Run{}, fmt.Errorf("error getting runs from DB: %v", err)
+	}
+
+	return sortRuns(runs, limit), nil
+}
+
+// StoreResults stores the results of a run in the DB.
+func (s *CassandraStore) StoreResults(runID gocql.UUID, hostname string, results []ops.OperationResult) error {
+	for _, r := range results {
+		// Insert result atomically to two tables
+		b := s.session.NewBatch(gocql.UnloggedBatch)
+
+		now := time.Now()
+
+		q1 := `INSERT INTO results_by_run_id (id, run_id, hostname, ts, description, script_name,
+			successful, status, stdout, stderr, exit_code, signal, error, start_time, end_time,
+			worker, attempts, changed, facts, message, module_version)
+			values (uuid(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		b.Query(q1, runID, hostname, now, r.Operation.Description, r.Operation.ScriptName,
+			r.Successful, string(r.Status), r.StdOut, r.StdErr, r.ExitCode, r.Signal, r.Error,
+			r.StartTime, r.EndTime, r.Worker, r.Attempts, r.Changed, r.Facts, r.Message,
+			r.ModuleVersion)
+
+		q2 := `INSERT INTO results_by_run_id_and_hostname
+			(id, run_id, hostname, ts, description, script_name, successful, status, stdout,
+			stderr, exit_code, signal, error, start_time, end_time, worker, attempts, changed,
+			facts, message, module_version)
+			values (uuid(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		b.Query(q2, runID, hostname, now, r.Operation.Description, r.Operation.ScriptName,
+			r.Successful, string(r.Status), r.StdOut, r.StdErr, r.ExitCode, r.Signal, r.Error,
+			r.StartTime, r.EndTime, r.Worker, r.Attempts, r.Changed, r.Facts, r.Message,
+			r.ModuleVersion)
+
+		if err := s.session.ExecuteBatch(b); err != nil {
+			return fmt.Errorf("error storing results in DB: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetResults gets the results of a run from the DB, optionally only for the given host.
+func (s *CassandraStore) GetResults(runID gocql.UUID, hostname string) ([]Result, error) {
+	cols := `hostname, ts, description, script_name, successful, status, stdout, stderr,
+		exit_code, signal, error, start_time, end_time, worker, attempts, changed, facts, message,
+		module_version`
+	var q *gocql.Query
+	if hostname == "" {
+		q = s.session.Query(`SELECT `+cols+` FROM results_by_run_id WHERE run_id = ?`, runID)
+	} else {
+		q = s.session.Query(`SELECT `+cols+` FROM results_by_run_id_and_hostname
+			WHERE run_id = ? AND hostname = ?`, runID, hostname)
+	}
+
+	var results []Result
+	var status string
+	r := Result{RunID: runID}
+	iter := q.Iter()
+	for iter.Scan(&r.Hostname, &r.Timestamp, &r.Operation.Description, &r.Operation.ScriptName,
+		&r.Successful, &status, &r.StdOut, &r.StdErr, &r.ExitCode, &r.Signal, &r.Error,
+		&r.StartTime, &r.EndTime, &r.Worker, &r.Attempts, &r.Changed, &r.Facts, &r.Message,
+		&r.ModuleVersion) {
+		r.Status = ops.Status(status)
+		results = append(results, r)
+	}
+	if err := iter.Close(); err != nil {
+		return []Result{}, fmt.Errorf("error getting results from DB: %v", err)
+	}
+
+	sortResults(results)
+	return results, nil
+}
+
+// StoreOutput stores a chunk of an operation's output in the DB.
+func (s *CassandraStore) StoreOutput(o Output) error {
+	q := `INSERT INTO output_by_run_id_and_hostname (run_id, hostname, id, ts, description, stream,
+		data) values (?, ?, now(), ?, ?, ?, ?)`
+	err := s.session.Query(q, o.RunID, o.Hostname, o.Timestamp, o.Description, o.Stream,
+		o.Data).Exec()
+	if err != nil {
+		return fmt.Errorf("error storing output in DB: %v", err)
+	}
+	return nil
+}
+
+// GetOutput gets the output stored for a host in a run from the DB, oldest first.
+func (s *CassandraStore) GetOutput(runID gocql.UUID, hostname string) ([]Output, error) {
+	q := s.session.Query(`SELECT ts, description, stream, data FROM output_by_run_id_and_hostname
+		WHERE run_id = ? AND hostname = ?`, runID, hostname)
+
+	var output []Output
+	o := Output{RunID: runID, Hostname: hostname}
+	iter := q.Iter()
+	for iter.Scan(&o.Timestamp, &o.Description, &o.Stream, &o.Data) {
+		output = append(output, o)
+	}
+	if err := iter.Close(); err != nil {
+		return []Output{}, fmt.Errorf("error getting output from DB: %v", err)
+	}
+
+	return output, nil
+}
+
+// Close closes the DB session.
+func (s *CassandraStore) Close() error {
+	s.session.Close()
+	return nil
+}
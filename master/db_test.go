@@ -1,3 +1,4 @@
+//go:build integration
 // +build integration
 
 package master
@@ -13,45 +14,45 @@ import (
 	"github.com/gocql/gocql"
 )
 
-var m Master
 var keyspace string
 var dbHosts []string
 
 func init() {
-	m = Master{}
 	keyspace = "simplecm"
 	dbHosts = []string{"127.0.0.1"}
 }
 
-func TestConnectToDB(t *testing.T) {
-	// m := Master{}
-
-	_, err := m.ConnectToDB(dbHosts, keyspace)
+func TestNewCassandraStore(t *testing.T) {
+	s, err := NewCassandraStore(dbHosts, keyspace)
 	if err != nil {
 		t.Fatalf("Error connecting to test DB: %v", err)
 	}
+	s.Close()
 }
 
 func TestGetHosts(t *testing.T) {
-	session, err := m.ConnectToDB(dbHosts, keyspace)
+	s, err := NewCassandraStore(dbHosts, keyspace)
 	if err != nil {
 		t.Fatalf("Error connecting to test DB: %v", err)
 	}
+	defer s.Close()
+	session := s.session
 
 	// Insert dummy hosts to DB
-	q := `create table hosts(hostname text, user text, key_name text, password text,
+	q := `create table hosts(hostname text, user text, key_name text, password_name text,
+		host_key_fingerprint text, labels map<text, text>, groups set<text>,
 		primary key(hostname));`
 	if err := session.Query(q).Exec(); err != nil {
 		t.Fatalf("Error creating table: %v", err)
 	}
-	q = `insert into hosts (hostname, user, key_name, password)
-		values ('testhost', 'testuser', '','testpass');`
+	q = `insert into hosts (hostname, user, key_name, password_name, labels, groups)
+		values ('testhost', 'testuser', '','testpass', {'env': 'prod'}, {'web'});`
 	if err := session.Query(q).Exec(); err != nil {
 		t.Fatalf("Error inserting dummy hosts: %v", err)
 	}
 
 	// Run test
-	hosts, err := m.GetHosts(session)
+	hosts, err := s.GetHosts()
 	if err != nil {
 		t.Fatalf("Error getting hosts: %v", err)
 	}
@@ -67,20 +68,28 @@ func TestGetHosts(t *testing.T) {
 	if hosts[0].User != "testuser" {
 		t.Fatalf("Wrong user retrieved: got %s want %s", hosts[0].User, "testuser")
 	}
-	if hosts[0].Password != "testpass" {
-		t.Fatalf("Wrong password retrieved: got %s want %s", hosts[0].Password, "testpass")
+	if hosts[0].PasswordName != "testpass" {
+		t.Fatalf("Wrong password name retrieved: got %s want %s", hosts[0].PasswordName,
+			"testpass")
+	}
+	if !reflect.DeepEqual(hosts[0].Labels, map[string]string{"env": "prod"}) ||
+		!reflect.DeepEqual(hosts[0].Groups, []string{"web"}) {
+		t.Fatalf("Wrong labels or groups retrieved: got %v, %v", hosts[0].Labels, hosts[0].Groups)
 	}
 }
 
 func TestGetOperations(t *testing.T) {
-	session, err := m.ConnectToDB(dbHosts, keyspace)
+	s, err := NewCassandraStore(dbHosts, keyspace)
 	if err != nil {
 		t.Fatalf("Error connecting to test DB: %v", err)
 	}
+	defer s.Close()
+	session := s.session
 
 	// Insert dummy operations to DB
 	q := `create table operations(id UUID, hostname text, description text, script_name text,
-		attributes map<text, text>, primary key(hostname, id));`
+		attributes map<text, text>, timeout int, execution_order int, depends_on set<text>,
+		primary key(hostname, id));`
 	if err := session.Query(q).Exec(); err != nil {
 		t.Fatalf("Error creating table: %v", err)
 	}
@@ -92,7 +101,7 @@ func TestGetOperations(t *testing.T) {
 	}
 
 	// Run test
-	ops, err := m.GetOperations(session, "host1")
+	ops, err := s.GetOperations("host1")
 	if err != nil {
 		t.Fatalf("Error getting hosts: %v", err)
 	}
@@ -116,14 +125,158 @@ func TestGetOperations(t *testing.T) {
 	}
 }
 
+func TestGetGroupOperations(t *testing.T) {
+	s, err := NewCassandraStore(dbHosts, keyspace)
+	if err != nil {
+		t.Fatalf("Error connecting to test DB: %v", err)
+	}
+	defer s.Close()
+	session := s.session
+
+	// Insert dummy operations to DB
+	q := `create table group_operations(id UUID, group_name text, description text,
+		script_name text, attributes map<text, text>, timeout int, execution_order int,
+		depends_on set<text>, primary key(group_name, id));`
+	if err := session.Query(q).Exec(); err != nil {
+		t.Fatalf("Error creating table: %v", err)
+	}
+	q = `insert into group_operations (id, group_name, description, script_name, attributes)
+		values (uuid(), 'web', 'verify_test_file_exists', 'file_exists',
+		{'path': '/etc/passwd'});`
+	if err := session.Query(q).Exec(); err != nil {
+		t.Fatalf("Error inserting dummy operations: %v", err)
+	}
+
+	// Run test
+	ops, err := s.GetGroupOperations("web")
+	if err != nil {
+		t.Fatalf("Error getting operations: %v", err)
+	}
+
+	// Verify
+	if len(ops) != 1 || ops[0].Description != "verify_test_file_exists" {
+		t.Fatalf("Wrong operations returned: got %v", ops)
+	}
+	if ops, _ := s.GetGroupOperations("db"); len(ops) != 0 {
+		t.Fatalf("Wrong operations returned: got %v want none", ops)
+	}
+}
+
+func TestGetRole(t *testing.T) {
+	s, err := NewCassandraStore(dbHosts, keyspace)
+	if err != nil {
+		t.Fatalf("Error connecting to test DB: %v", err)
+	}
+	defer s.Close()
+	session := s.session
+
+	// Insert a dummy role and its assignment to DB
+	for _, q := range []string{
+		`create table roles(name text, attributes map<text, text>, primary key(name));`,
+		`create table role_operations(role text, position int, description text, script_name text,
+			attributes map<text, text>, timeout int, execution_order int, depends_on set<text>,
+			primary key(role, position));`,
+		`create table host_roles(hostname text, position int, role text,
+			attributes map<text, text>, primary key(hostname, position));`,
+	} {
+		if err := session.Query(q).Exec(); err != nil {
+			t.Fatalf("Error creating table: %v", err)
+		}
+	}
+	for _, q := range []string{
+		`insert into roles (name, attributes) values ('base', {'path': '/etc/passwd'});`,
+		`insert into role_operations (role, position, description, script_name)
+			values ('base', 1, 'second', 'file_exists');`,
+		`insert into role_operations (role, position, description, script_name)
+			values ('base', 0, 'first', 'file_exists');`,
+		`insert into host_roles (hostname, position, role, attributes)
+			values ('host1', 0, 'base', {'path': '/etc/hosts'});`,
+	} {
+		if err := session.Query(q).Exec(); err != nil {
+			t.Fatalf("Error inserting dummy role: %v", err)
+		}
+	}
+
+	// Run test
+	r, err := s.GetRole("base")
+	if err != nil {
+		t.Fatalf("Error getting role: %v", err)
+	}
+	assignments, err := s.GetHostRoles("host1")
+	if err != nil {
+		t.Fatalf("Error getting roles: %v", err)
+	}
+
+	// Verify
+	if r.Attributes["path"] != "/etc/passwd" || len(r.Operations) != 2 ||
+		r.Operations[0].Description != "first" || r.Operations[1].Description != "second" {
+		t.Fatalf("Wrong role: got %+v", r)
+	}
+	want := []ops.RoleAssignment{{Role: "base", Attributes: map[string]string{"path": "/etc/hosts"}}}
+	if !reflect.DeepEqual(assignments, want) {
+		t.Fatalf("Wrong role assignments: got %v want %v", assignments, want)
+	}
+	if _, err := s.GetRole("nosuchrole"); err != ErrRoleNotFound {
+		t.Fatalf("Wrong error for an unknown role: got %v want %v", err, ErrRoleNotFound)
+	}
+}
+
+func TestGetVariables(t *testing.T) {
+	s, err := NewCassandraStore(dbHosts, keyspace)
+	if err != nil {
+		t.Fatalf("Error connecting to test DB: %v", err)
+	}
+	defer s.Close()
+	session := s.session
+
+	// Insert dummy variables to DB
+	for _, q := range []string{
+		`create table global_variables(name text, value text, primary key(name));`,
+		`create table group_variables(group_name text, name text, value text,
+			primary key(group_name, name));`,
+		`create table host_variables(hostname text, name text, value text,
+			primary key(hostname, name));`,
+		`insert into global_variables (name, value) values ('ntp_server', 'pool.ntp.org');`,
+		`insert into group_variables (group_name, name, value) values ('web', 'port', '8080');`,
+		`insert into host_variables (hostname, name, value) values ('host1', 'ntp_server', 'ntp.host1');`,
+	} {
+		if err := session.Query(q).Exec(); err != nil {
+			t.Fatalf("Error inserting dummy variables: %v", err)
+		}
+	}
+
+	// Run test and verify
+	for _, tc := range []struct {
+		scope VariableScope
+		name  string
+		want  map[string]string
+	}{
+		{ScopeGlobal, "", map[string]string{"ntp_server": "pool.ntp.org"}},
+		{ScopeGroup, "web", map[string]string{"port": "8080"}},
+		{ScopeGroup, "db", map[string]string{}},
+		{ScopeHost, "host1", map[string]string{"ntp_server": "ntp.host1"}},
+	} {
+		vars, err := s.GetVariables(tc.scope, tc.name)
+		if err != nil {
+			t.Fatalf("Error getting variables: %v", err)
+		}
+		if !reflect.DeepEqual(vars, tc.want) {
+			t.Fatalf("Wrong %s variables: got %v want %v", tc.scope, vars, tc.want)
+		}
+	}
+}
+
 func TestStoreRun(t *testing.T) {
-	session, err := m.ConnectToDB(dbHosts, keyspace)
+	s, err := NewCassandraStore(dbHosts, keyspace)
 	if err != nil {
 		t.Fatalf("Error connecting to test DB: %v", err)
 	}
+	defer s.Close()
+	session := s.session
 
 	// Create table
-	q := `create table runs(id UUID, create_time timestamp, primary key(id, create_time));`
+	q := `create table runs(id UUID, create_time timestamp, end_time timestamp,
+		check_mode boolean, status_counts map<text, int>, primary key(id, create_time));`
 	if err := session.Query(q).Exec(); err != nil {
 		t.Fatalf("Error creating table: %v", err)
 	}
@@ -131,7 +284,7 @@ func TestStoreRun(t *testing.T) {
 	// Run test
 	id := gocql.TimeUUID()
 	ts := time.Now()
-	err = m.StoreRun(session, id, ts)
+	err = s.StoreRun(Run{ID: id, CreateTime: ts, Check: true})
 	if err != nil {
 		t.Fatalf("Error storing run: %v", err)
 	}
@@ -139,13 +292,18 @@ func TestStoreRun(t *testing.T) {
 	// Verify
 	var idOut gocql.UUID
 	var createTime time.Time
-	q = `select id, create_time from runs where id = ? LIMIT 1`
-	if err := session.Query(q, id).Consistency(gocql.One).Scan(&idOut, &createTime); err != nil {
+	var check bool
+	q = `select id, create_time, check_mode from runs where id = ? LIMIT 1`
+	err = session.Query(q, id).Consistency(gocql.One).Scan(&idOut, &createTime, &check)
+	if err != nil {
 		log.Fatalf("Error getting run from DB: %v", err)
 	}
 	if idOut != id {
 		log.Fatalf("Wrong ID retrieved: got %v want %v", idOut, id)
 	}
+	if !check {
+		log.Fatalf("Check mode wasn't stored")
+	}
 	// TODO Fix timezone conversion problem. There is a mismatch between how the timestamp is
 	// represented in the DB and in the code.
 	// if createTime != ts {
@@ -154,20 +312,28 @@ func TestStoreRun(t *testing.T) {
 }
 
 func TestStoreResults(t *testing.T) {
-	session, err := m.ConnectToDB(dbHosts, keyspace)
+	s, err := NewCassandraStore(dbHosts, keyspace)
 	if err != nil {
 		t.Fatalf("Error connecting to test DB: %v", err)
 	}
+	defer s.Close()
+	session := s.session
 
 	// Create tables
 	q := `create table results_by_run_id(id UUID, run_id UUID, hostname text, ts timestamp,
-		script_name text, successful boolean, primary key(run_id, id));`
+		description text, script_name text, successful boolean, status text, stdout text, stderr text,
+		exit_code int, signal text, error text, start_time timestamp, end_time timestamp,
+		worker text, attempts int, changed boolean, facts map<text, text>, message text,
+		module_version text, primary key(run_id, id));`
 	if err := session.Query(q).Exec(); err != nil {
 		t.Fatalf("Error creating table: %v", err)
 	}
 
 	q = `create table results_by_run_id_and_hostname(id UUID, run_id UUID, hostname text,
-		ts timestamp, script_name text, successful boolean, primary key(run_id, hostname, id));`
+		ts timestamp, description text, script_name text, successful boolean, status text,
+		stdout text, stderr text, exit_code int, signal text, error text, start_time timestamp,
+		end_time timestamp, worker text, attempts int, changed boolean, facts map<text, text>,
+		message text, module_version text, primary key(run_id, hostname, id));`
 	if err = session.Query(q).Exec(); err != nil {
 		t.Fatalf("Error creating table: %v", err)
 	}
@@ -182,12 +348,13 @@ func TestStoreResults(t *testing.T) {
 				ScriptName:  "fake",
 				Attributes:  map[string]string{"fakekey": "fakevalue"},
 			},
-			StdOut:     "",
-			StdErr:     "",
-			Successful: true,
+			StdOut:        "",
+			StdErr:        "",
+			Successful:    true,
+			ModuleVersion: "fakeversion",
 		},
 	}
-	err = m.StoreResults(session, runID, hostname, results)
+	err = s.StoreResults(runID, hostname, results)
 	if err != nil {
 		t.Fatalf("Error storing run: %v", err)
 	}
@@ -196,12 +363,12 @@ func TestStoreResults(t *testing.T) {
 	var id, runIDOut gocql.UUID
 	var hostnameOut string
 	var ts time.Time
-	var scriptName string
+	var scriptName, moduleVersion string
 	var successful bool
-	q = `select id, run_id, hostname, ts, script_name, successful from results_by_run_id
-		where run_id = ? LIMIT 1`
+	q = `select id, run_id, hostname, ts, script_name, successful, module_version
+		from results_by_run_id where run_id = ? LIMIT 1`
 	if err := session.Query(q, runID).Scan(&id, &runIDOut, &hostnameOut, &ts, &scriptName,
-		&successful); err != nil {
+		&successful, &moduleVersion); err != nil {
 		log.Fatalf("Error getting run from DB: %v", err)
 	}
 	if runIDOut != runID {
@@ -216,4 +383,42 @@ func TestStoreResults(t *testing.T) {
 	if !successful {
 		t.Fatalf("Result should have been successful but is not")
 	}
+	if moduleVersion != "fakeversion" {
+		t.Fatalf("Wrong module version: got %s want fakeversion", moduleVersion)
+	}
+}
+
+func TestStoreOutput(t *testing.T) {
+	s, err := NewCassandraStore(dbHosts, keyspace)
+	if err != nil {
+		t.Fatalf("Error connecting to test DB: %v", err)
+	}
+	defer s.Close()
+
+	// Create table
+	q := `create table output_by_run_id_and_hostname(run_id UUID, hostname text, id timeuuid,
+		ts timestamp, description text, stream text, data text,
+		primary key((run_id, hostname), id));`
+	if err := s.session.Query(q).Exec(); err != nil {
+		t.Fatalf("Error creating table: %v", err)
+	}
+
+	// Run test
+	runID := gocql.TimeUUID()
+	for _, data := range []string{"first\n", "second\n"} {
+		err := s.StoreOutput(Output{RunID: runID, Hostname: "testhost", Description: "test_op",
+			Stream: "stdout", Data: data, Timestamp: time.Now()})
+		if err != nil {
+			t.Fatalf("Error storing output: %v", err)
+		}
+	}
+
+	// Verify
+	output, err := s.GetOutput(runID, "testhost")
+	if err != nil {
+		t.Fatalf("Error getting output: %v", err)
+	}
+	if len(output) != 2 || output[0].Data != "first\n" || output[1].Data != "second\n" {
+		t.Fatalf("Wrong output: got %+v", output)
+	}
 }
@@ -0,0 +1,109 @@
+package master
+
+import (
+	"log"
+	"strings"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/worker"
+)
+
+// A hostEvents handles the events which are streamed by a worker while it executes the
+// operations of a host: output is logged line by line and stored as it arrives. Results aren't
+// stored here, since a worker may fail after reporting some of them and the host is then executed
+// again by another worker. Only the results of the final attempt are stored, by runHost.
+type hostEvents struct {
+	m          *Master
+	runID      gocql.UUID
+	hostname   string
+	operations []ops.Operation
+
+	// Output which wasn't logged yet because its line is incomplete, by operation and stream.
+	partial map[outputKey]string
+	// Number of bytes of output stored by operation and stream, for enforcing MaxOutputSize.
+	stored map[outputKey]int
+}
+
+type outputKey struct {
+	index  int
+	stream string
+}
+
+func newHostEvents(m *Master, runID gocql.UUID, hostname string, operations []ops.Operation) *hostEvents {
+	return &hostEvents{
+		m:          m,
+		runID:      runID,
+		hostname:   hostname,
+		operations: operations,
+		partial:    make(map[outputKey]string),
+		stored:     make(map[outputKey]int),
+	}
+}
+
+// Handles a single event. Events for an unknown operation are ignored.
+func (h *hostEvents) handle(e worker.Event) {
+	if e.Index < 0 || e.Index >= len(h.operations) {
+		return
+	}
+	description := h.operations[e.Index].Description
+
+	switch e.Kind {
+	case worker.EventStarted:
+		// The operation may be executed again by another worker after a failure.
+		for _, stream := range []string{"stdout", "stderr"} {
+			delete(h.partial, outputKey{e.Index, stream})
+			delete(h.stored, outputKey{e.Index, stream})
+		}
+		log.Printf("[%s] Started operation %s", h.hostname, description)
+	case worker.EventOutput:
+		h.logOutput(e.Index, e.Stream, e.Data)
+		h.storeOutput(e)
+	case worker.EventFinished:
+		for _, stream := range []string{"stdout", "stderr"} {
+			if p := h.partial[outputKey{e.Index, stream}]; p != "" {
+				log.Printf("[%s] %s (%s): %s", h.hostname, description, stream, p)
+			}
+			delete(h.partial, outputKey{e.Index, stream})
+		}
+		log.Printf("[%s] Finished operation %s: %s", h.hostname, description, e.Result.Status)
+	}
+}
+
+// Logs each complete line of output and keeps the incomplete remainder for later.
+func (h *hostEvents) logOutput(index int, stream, data string) {
+	key := outputKey{index, stream}
+	lines := strings.Split(h.partial[key]+data, "\n")
+	for _, l := range lines[:len(lines)-1] {
+		log.Printf("[%s] %s (%s): %s", h.hostname, h.operations[index].Description, stream, l)
+	}
+	h.partial[key] = lines[len(lines)-1]
+}
+
+// Stores a chunk of output. Once MaxOutputSize bytes of output were stored for an operation's
+// stream, the rest of the stream's output is dropped.
+func (h *hostEvents) storeOutput(e worker.Event) {
+	key := outputKey{e.Index, e.Stream}
+	data := e.Data
+	stored := h.stored[key]
+	max := h.m.MaxOutputSize
+	if max > 0 && stored >= max {
+		return
+	}
+	if max > 0 && stored+len(data) > max {
+		data = truncateOutput(data, max-stored)
+	}
+	h.stored[key] = stored + len(data)
+
+	err := h.m.Store.StoreOutput(Output{
+		RunID:       h.runID,
+		Hostname:    h.hostname,
+		Description: h.operations[e.Index].Description,
+		Stream:      e.Stream,
+		Data:        data,
+		Timestamp:   e.Time,
+	})
+	if err != nil {
+		log.Printf("[%s] Could not store output in DB: %v", h.hostname, err)
+	}
+}
@@ -0,0 +1,143 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/johananl/simple-cm/transport"
+	"github.com/johananl/simple-cm/worker"
+)
+
+// CheckWorkers pings every connected worker and removes the workers which don't respond within
+// timeout from the pool. Workers which are processing hosts aren't removed, since closing their
+// connections would fail the hosts' calls while the workers may still be executing the hosts'
+// operations, and the hosts would then be executed by other workers at the same time. Static
+// workers which were removed, either here or because they failed while processing a host, are
+// reconnected once they become reachable again. Registered workers reconnect by registering again.
+func (m *Master) CheckWorkers(timeout time.Duration) {
+	m.lock.RLock()
+	workers := append([]*WorkerConn{}, m.Workers...)
+	disconnected := append([]string{}, m.disconnected...)
+	m.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *WorkerConn) {
+			defer wg.Done()
+			if err := ping(w.Client, timeout); err != nil {
+				m.removeIdleWorker(w, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, addr := range disconnected {
+		if err := m.AddWorker(addr); err != nil {
+			continue
+		}
+		log.Printf("Reconnected to worker %s", addr)
+
+		m.lock.Lock()
+		for i, a := range m.disconnected {
+			if a == addr {
+				m.disconnected = append(m.disconnected[:i], m.disconnected[i+1:]...)
+				break
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+// CheckWorkersPeriodically calls CheckWorkers every interval until ctx is done. interval is also
+// used as the timeout for a worker's response.
+func (m *Master) CheckWorkersPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.CheckWorkers(interval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// AddDisconnectedWorker remembers the static worker at the given address, which couldn't be
+// connected to, so that CheckWorkers connects to it once it becomes reachable.
+func (m *Master) AddDisconnectedWorker(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.disconnected = append(m.disconnected, addr)
+}
+
+// Removes an unhealthy worker from the pool and closes its connection. A static worker is
+// remembered so that CheckWorkers can reconnect to it.
+func (m *Master) removeWorker(w *WorkerConn, reason error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.removeWorkerLocked(w, reason)
+}
+
+// Removes an unhealthy worker like removeWorker unless the worker is processing hosts.
+func (m *Master) removeIdleWorker(w *WorkerConn, reason error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if w.Outstanding > 0 {
+		log.Printf("Not removing unhealthy worker %s while it is processing %d hosts: %v", w.Addr,
+			w.Outstanding, reason)
+		return
+	}
+	m.removeWorkerLocked(w, reason)
+}
+
+// Removes w from the pool. m.lock must be held.
+func (m *Master) removeWorkerLocked(w *WorkerConn, reason error) {
+	for i, c := range m.Workers {
+		if c != w {
+			continue
+		}
+		log.Printf("Removing unhealthy worker %s: %v", w.Addr, reason)
+		m.Workers = append(m.Workers[:i], m.Workers[i+1:]...)
+		w.Client.Close()
+		if w.Static {
+			m.disconnected = append(m.disconnected, w.Addr)
+		}
+		return
+	}
+}
+
+// Calls Worker.Ping on the given client and waits for the response for at most timeout.
+func ping(c transport.Client, timeout time.Duration) error {
+	in := worker.PingInput{Nonce: time.Now().UnixNano()}
+	var out worker.PingOutput
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := c.Ping(ctx, &in, &out)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("ping timed out after %v", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("ping failed: %v", err)
+	}
+	if out.Nonce != in.Nonce {
+		return errors.New("ping failed: wrong nonce in response")
+	}
+
+	return nil
+}
+
+// Returns whether err, which was returned by a transport.Client call, indicates a failure of the
+// worker or of the connection to it rather than an error returned by the called method.
+func isTransportError(err error) bool {
+	_, ok := err.(transport.RemoteError)
+	return err != nil && !ok
+}
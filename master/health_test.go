@@ -0,0 +1,236 @@
+package master
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/transport"
+	"github.com/johananl/simple-cm/worker"
+)
+
+// A fake worker which succeeds every operation without connecting to the host, reporting them as
+// changed in check mode. If hang is set, Ping and ExecuteStream block until it is closed and
+// Cancel is ignored. If cancel is set, ExecuteStream blocks until Cancel is called and marks the
+// operations as cancelled. hostKey is reported as the host's key fingerprint.
+type fakeWorker struct {
+	hang    chan struct{}
+	cancel  chan string
+	hostKey string
+}
+
+func (w *fakeWorker) Cancel(in *worker.CancelInput, out *worker.CancelOutput) error {
+	if w.cancel != nil && w.hang == nil {
+		w.cancel <- in.ID
+		out.Running = true
+	}
+	return nil
+}
+
+func (w *fakeWorker) Ping(in *worker.PingInput, out *worker.PingOutput) error {
+	if w.hang != nil {
+		<-w.hang
+	}
+	out.Nonce = in.Nonce
+	return nil
+}
+
+func (w *fakeWorker) Execute(in *worker.ExecuteInput, out *worker.ExecuteOutput) error {
+	return w.ExecuteStream(in, out, nil)
+}
+
+// ExecuteStream sends an output event with the operation's description and a finished event for
+// each operation. Results have the version of the operation's module, if the module was sent.
+func (w *fakeWorker) ExecuteStream(in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error {
+	out.HostKeyFingerprint = w.hostKey
+	if w.hang != nil {
+		<-w.hang
+	}
+	if w.cancel != nil {
+		<-w.cancel
+		for _, o := range in.Operations {
+			out.Results = append(out.Results, ops.OperationResult{
+				Operation: o,
+				Status:    ops.StatusCancelled,
+				Error:     "execution cancelled",
+			})
+		}
+		return nil
+	}
+	for i, o := range in.Operations {
+		r := ops.OperationResult{
+			Operation:  o,
+			StdOut:     o.Description + "\n",
+			Successful: true,
+			Status:     ops.StatusOK,
+		}
+		if in.Check {
+			r.Status = ops.StatusChanged
+		}
+		for _, s := range in.Modules {
+			if s.Name == o.ScriptName {
+				r.ModuleVersion = s.Version()
+			}
+		}
+		if events != nil {
+			events(worker.Event{Kind: worker.EventStarted, Index: i})
+			events(worker.Event{Kind: worker.EventOutput, Index: i, Stream: "stdout", Data: r.StdOut})
+			events(worker.Event{Kind: worker.EventFinished, Index: i, Result: r})
+		}
+		out.Results = append(out.Results, r)
+	}
+	return nil
+}
+
+// Starts an RPC server which serves w and returns its address.
+func startFakeWorker(t *testing.T, w *fakeWorker) (string, func()) {
+	s := rpc.NewServer()
+	if err := s.RegisterName("Worker", w); err != nil {
+		t.Fatalf("Error registering fake worker: %v", err)
+	}
+	server := httptest.NewServer(s)
+	return strings.TrimPrefix(server.URL, "http://"), server.Close
+}
+
+func TestCheckWorkers(t *testing.T) {
+	healthyAddr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+	hanging := &fakeWorker{hang: make(chan struct{})}
+	hangingAddr, stop := startFakeWorker(t, hanging)
+	defer stop()
+
+	m := Master{}
+	for _, addr := range []string{healthyAddr, hangingAddr} {
+		if err := m.AddWorker(addr); err != nil {
+			t.Fatalf("Error adding worker: %v", err)
+		}
+	}
+
+	// A worker which is processing a host isn't removed even if it doesn't respond.
+	m.Workers[1].Outstanding++
+	m.CheckWorkers(100 * time.Millisecond)
+	if len(m.Workers) != 2 {
+		t.Fatalf("Busy worker was removed: got %+v", m.Workers)
+	}
+	m.Workers[1].Outstanding--
+
+	m.CheckWorkers(100 * time.Millisecond)
+	if len(m.Workers) != 1 || m.Workers[0].Addr != healthyAddr {
+		t.Fatalf("Wrong workers after health check: got %+v", m.Workers)
+	}
+
+	// The hanging worker recovers and is reconnected.
+	close(hanging.hang)
+	m.CheckWorkers(100 * time.Millisecond)
+	if len(m.Workers) != 2 || len(m.disconnected) != 0 {
+		t.Fatalf("Worker wasn't reconnected: workers %+v, disconnected %v", m.Workers,
+			m.disconnected)
+	}
+}
+
+func TestExecuteRetry(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	m := Master{}
+	for i := 0; i < 2; i++ {
+		if err := m.AddWorker(addr); err != nil {
+			t.Fatalf("Error adding worker: %v", err)
+		}
+	}
+	// Round-robin selects the second worker first, which fails with a transport error.
+	m.Workers[1].Client.Close()
+
+	in := worker.ExecuteInput{
+		Hostname:   "host1",
+		Operations: []ops.Operation{ops.Operation{Description: "op"}},
+	}
+	results := m.execute(context.Background(), in, nil).Results
+	if len(results) != 1 || results[0].Status != ops.StatusOK || results[0].Attempts != 2 ||
+		results[0].Worker != addr {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+	if len(m.Workers) != 1 {
+		t.Fatalf("Failed worker wasn't removed: got %d workers want 1", len(m.Workers))
+	}
+
+	// When all the attempts fail, the operations are marked as errors.
+	m.MaxAttempts = 1
+	m.Workers[0].Client.Close()
+	results = m.execute(context.Background(), in, nil).Results
+	if len(results) != 1 || results[0].Status != ops.StatusError || results[0].Attempts != 1 {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+func TestExecuteStreamTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go transport.ServeStream(l, &fakeWorker{})
+
+	m := Master{Transport: transport.DialStream}
+	if err := m.AddWorker(l.Addr().String()); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+
+	m.CheckWorkers(time.Second)
+	if len(m.Workers) != 1 {
+		t.Fatalf("Healthy worker was removed")
+	}
+
+	in := worker.ExecuteInput{
+		Hostname:   "host1",
+		Operations: []ops.Operation{ops.Operation{Description: "op"}},
+	}
+	results := m.execute(context.Background(), in, nil).Results
+	if len(results) != 1 || results[0].Status != ops.StatusOK || results[0].Attempts != 1 {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+func TestCheckWorkersConnectsDisconnected(t *testing.T) {
+	// A worker which isn't listening yet when the master starts.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	m := Master{}
+	if err := m.AddWorker(addr); err == nil {
+		t.Fatal("Adding an unreachable worker succeeded")
+	}
+	m.AddDisconnectedWorker(addr)
+	m.CheckWorkers(100 * time.Millisecond)
+	if len(m.Workers) != 0 || len(m.disconnected) != 1 {
+		t.Fatalf("Wrong workers: workers %+v, disconnected %v", m.Workers, m.disconnected)
+	}
+
+	// The worker starts listening and is connected.
+	s := rpc.NewServer()
+	if err := s.RegisterName("Worker", &fakeWorker{}); err != nil {
+		t.Fatalf("Error registering fake worker: %v", err)
+	}
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server := httptest.NewUnstartedServer(s)
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	m.CheckWorkers(100 * time.Millisecond)
+	if len(m.Workers) != 1 || !m.Workers[0].Static || len(m.disconnected) != 0 {
+		t.Fatalf("Worker wasn't connected: workers %+v, disconnected %v", m.Workers, m.disconnected)
+	}
+}
@@ -1,97 +1,308 @@
 package master
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/rpc"
+	"sort"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gocql/gocql"
 	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/secrets"
+	"github.com/johananl/simple-cm/transport"
 )
 
 // A Master coordinates Operations among Workers.
 type Master struct {
-	SSHKeysDir     string
-	Workers        []*rpc.Client
-	LastUsedWorker int
-	lock           sync.RWMutex
+	Store Store
+	// MaxOutputSize is the maximum number of bytes of stdout and of stderr which are stored for
+	// each operation result. Longer output is truncated. A value of 0 means no limit.
+	MaxOutputSize int
+	Workers       []*WorkerConn
+	// Selector decides which worker executes the operations of each host. If it is nil, workers
+	// are selected using round-robin.
+	Selector WorkerSelector
+	// MaxAttempts is the maximum number of workers a host's operations are sent to when workers
+	// fail. If it is 0, DefaultMaxAttempts is used.
+	MaxAttempts int
+	// TrustOnFirstUse makes workers accept the SSH host key of a host which has no pinned host key
+	// fingerprint and isn't in the worker's known_hosts file. The key's fingerprint is then pinned
+	// in the store.
+	TrustOnFirstUse bool
+	// Transport connects to workers. If it is nil, transport.DialRPC is used.
+	Transport transport.Dialer
+	// TLSConfig is used for connecting to workers over TLS. If it is nil, workers are connected to
+	// without TLS.
+	TLSConfig *tls.Config
+	// HostTimeout is the maximum time a worker may spend executing the operations of a host. A
+	// value of 0 means no limit.
+	HostTimeout time.Duration
+	// OperationTimeout is the maximum time an operation may execute if the operation doesn't have
+	// its own timeout. A value of 0 means no limit.
+	OperationTimeout time.Duration
+	// ModulesDir is the directory of the modules which the operations use. If it is set, the
+	// modules are sent to workers along with the operations, the attributes of operations are
+	// validated against the manifests of their modules and the defaults of the modules' parameters
+	// are filled in before the operations are sent. Otherwise, workers use their own modules.
+	ModulesDir string
+	// Secrets resolves the SSH keys returned by SSHKey. Workers resolve the credentials of hosts
+	// using their own providers, so the master only needs it for looking keys up itself.
+	Secrets secrets.Provider
+	// Addresses of static workers which were removed because they were unhealthy.
+	disconnected []string
+	lock         sync.RWMutex
 }
 
-// ConnectToDB connects to the given DB and returns a *gocql.Session.
-func (m *Master) ConnectToDB(hosts []string, keyspace string) (*gocql.Session, error) {
-	cluster := gocql.NewCluster(hosts...)
-	cluster.Keyspace = keyspace
-	session, err := cluster.CreateSession()
+// DefaultMaxAttempts is the maximum number of workers a host's operations are sent to if
+// Master.MaxAttempts isn't set.
+const DefaultMaxAttempts = 3
+
+// ErrWorkerNotRegistered is returned when a heartbeat is received from a worker which isn't
+// registered with the master.
+var ErrWorkerNotRegistered = errors.New("worker not registered")
+
+// A WorkerConn is a connection to a worker.
+type WorkerConn struct {
+	// Addr is the <host>:<port> address of the worker.
+	Addr   string
+	Client transport.Client
+	// Static is true for workers which were added using AddWorker rather than registered by the
+	// worker itself. Static workers never expire.
+	Static bool
+	// LastSeen is the time of the last registration or heartbeat received from the worker.
+	LastSeen time.Time
+	// Outstanding is the number of hosts currently being processed by the worker.
+	Outstanding int
+}
+
+// SSHKey gets the name of an SSH private key and returns its contents, as resolved by m.Secrets.
+func (m *Master) SSHKey(key string) (string, error) {
+	if m.Secrets == nil {
+		return "", errors.New("error reading SSH key: no secrets provider configured")
+	}
+	s, err := m.Secrets.Secret(key)
 	if err != nil {
-		return nil, fmt.Errorf("error creating DB session: %v", err)
+		return "", fmt.Errorf("error reading SSH key: %v", err)
 	}
 
-	return session, nil
+	return s, nil
 }
 
-// SSHKey gets the name of an SSH private key and returns its contents.
-func (m *Master) SSHKey(key string) (string, error) {
-	s, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", m.SSHKeysDir, key))
+// GetHosts gets all the hosts from the store and returns a slice of Hosts.
+func (m *Master) GetHosts() ([]ops.Host, error) {
+	return m.Store.GetHosts()
+}
+
+// GetHostOperations resolves the effective operations of the given host from the store and returns
+// them in a slice. The operations of the roles which are assigned to the host come first, in the
+// order the roles were assigned and with the host's attribute overrides applied, followed by the
+// operations of the groups the host belongs to, in the order of the host's groups, followed by the
+// host's own operations.
+func (m *Master) GetHostOperations(h ops.Host) ([]ops.Operation, error) {
+	var operations []ops.Operation
+
+	assignments, err := m.Store.GetHostRoles(h.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assignments {
+		r, err := m.Store.GetRole(a.Role)
+		if err == ErrRoleNotFound {
+			return nil, fmt.Errorf("host is assigned unknown role %q", a.Role)
+		}
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, r.Apply(a)...)
+	}
+
+	for _, g := range h.Groups {
+		groupOperations, err := m.Store.GetGroupOperations(g)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, groupOperations...)
+	}
+
+	hostOperations, err := m.Store.GetOperations(h.Hostname)
 	if err != nil {
-		log.Fatalf("error reading SSH key: %v", err)
+		return nil, err
 	}
 
-	return string(s), nil
+	return append(operations, hostOperations...), nil
+}
+
+// A Variable is a variable which is in effect for a host. Scope and ScopeName identify where the
+// variable was defined: ScopeName is the name of the group or the hostname for ScopeGroup and
+// ScopeHost and is empty for ScopeGlobal.
+type Variable struct {
+	Name      string
+	Value     string
+	Scope     VariableScope
+	ScopeName string
 }
 
-// GetAllHosts gets all the hosts from the DB and returns a slice of Hosts.
-func (m *Master) GetHosts(session *gocql.Session) ([]ops.Host, error) {
-	var hosts []ops.Host
-	var hostname, user, keyName, password string
-	q := `SELECT hostname, user, key_name, password FROM hosts`
-	iter := session.Query(q).Iter()
-	for iter.Scan(&hostname, &user, &keyName, &password) {
-		hosts = append(hosts, ops.Host{
-			Hostname: hostname,
-			User:     user,
-			KeyName:  keyName,
-			Password: password,
-		})
+// GetHostVariables resolves the effective variables of the given host from the store and returns
+// them sorted by name. The global variables are overridden by the variables of the groups the host
+// belongs to, in the order of the host's groups, which are overridden by the host's own variables.
+func (m *Master) GetHostVariables(h ops.Host) ([]Variable, error) {
+	type scope struct {
+		scope VariableScope
+		name  string
 	}
-	if err := iter.Close(); err != nil {
-		return []ops.Host{}, fmt.Errorf("error getting hosts from DB: %v", err)
+	scopes := []scope{{ScopeGlobal, ""}}
+	for _, g := range h.Groups {
+		scopes = append(scopes, scope{ScopeGroup, g})
 	}
+	scopes = append(scopes, scope{ScopeHost, h.Hostname})
 
-	return hosts, nil
+	effective := make(map[string]Variable)
+	for _, s := range scopes {
+		vars, err := m.Store.GetVariables(s.scope, s.name)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vars {
+			effective[k] = Variable{Name: k, Value: v, Scope: s.scope, ScopeName: s.name}
+		}
+	}
+
+	var variables []Variable
+	for _, v := range effective {
+		variables = append(variables, v)
+	}
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+
+	return variables, nil
 }
 
-// GetOperations gets all operations for the given host from the DB and returns them in a slice.
-func (m *Master) GetOperations(session *gocql.Session, hostname string) ([]ops.Operation, error) {
-	var operations []ops.Operation
-	var description, scriptName string
-	var attributes map[string]string
-	q := `SELECT description, script_name, attributes FROM operations where hostname = ?`
-	iter := session.Query(q, hostname).Iter()
-	for iter.Scan(&description, &scriptName, &attributes) {
-		o := ops.Operation{
-			Description: description,
-			ScriptName:  scriptName,
-			Attributes:  attributes,
+// VariableValues returns the values of the given variables by name.
+func VariableValues(variables []Variable) map[string]string {
+	values := make(map[string]string)
+	for _, v := range variables {
+		values[v.Name] = v.Value
+	}
+	return values
+}
+
+// AddWorker connects to the worker at the given <host>:<port> address and adds it to the workers
+// which are used for executing operations.
+func (m *Master) AddWorker(addr string) error {
+	c, err := m.dial(addr)
+	if err != nil {
+		return fmt.Errorf("error dialing worker %v: %v", addr, err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Workers = append(m.Workers, &WorkerConn{Addr: addr, Client: c, Static: true})
+
+	return nil
+}
+
+// Connects to the worker at the given address using the master's transport.
+func (m *Master) dial(addr string) (transport.Client, error) {
+	dial := m.Transport
+	if dial == nil {
+		dial = transport.DialRPC
+	}
+
+	return dial(addr, m.TLSConfig)
+}
+
+// RegisterWorker connects to a worker which announced itself at the given <host>:<port> address
+// and adds it to the workers which are used for executing operations. Registering a worker which
+// is already connected only refreshes its LastSeen time.
+func (m *Master) RegisterWorker(addr string) error {
+	if m.Heartbeat(addr) == nil {
+		return nil
+	}
+
+	c, err := m.dial(addr)
+	if err != nil {
+		return fmt.Errorf("error dialing worker %v: %v", addr, err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// The worker may have been registered concurrently while dialing.
+	for _, w := range m.Workers {
+		if w.Addr == addr {
+			c.Close()
+			w.LastSeen = time.Now()
+			return nil
 		}
-		operations = append(operations, o)
 	}
-	if err := iter.Close(); err != nil {
-		return []ops.Operation{}, fmt.Errorf("error getting operations from DB: %v", err)
+	m.Workers = append(m.Workers, &WorkerConn{Addr: addr, Client: c, LastSeen: time.Now()})
+	log.Printf("Registered worker %s", addr)
+
+	return nil
+}
+
+// Heartbeat refreshes the LastSeen time of the worker at the given address. If the worker isn't
+// registered, ErrWorkerNotRegistered is returned, in which case the worker should register again.
+func (m *Master) Heartbeat(addr string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, w := range m.Workers {
+		if w.Addr == addr {
+			w.LastSeen = time.Now()
+			return nil
+		}
 	}
 
-	return operations, nil
+	return ErrWorkerNotRegistered
 }
 
-// SelectWorker returns workers using a simple round-robin algorithm.
-//
-// NOTE: More sophisticated algorithms could of course be used to select workers. Round-robin is a
-// very simple one. A "policy" argument could be added to this method where the caller could
-// specify which policy they want to use for distributing the load across multiple workers.
-func (m *Master) SelectWorker() (*rpc.Client, error) {
+// ExpireWorkers removes registered workers from which no registration or heartbeat has been
+// received within ttl and closes their connections. Static workers are never removed. The
+// addresses of the removed workers are returned.
+func (m *Master) ExpireWorkers(ttl time.Duration) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var expired []string
+	var workers []*WorkerConn
+	for _, w := range m.Workers {
+		if w.Static || time.Since(w.LastSeen) <= ttl {
+			workers = append(workers, w)
+			continue
+		}
+		w.Client.Close()
+		expired = append(expired, w.Addr)
+	}
+	m.Workers = workers
+
+	return expired
+}
+
+// ExpireWorkersPeriodically calls ExpireWorkers every ttl/2 until ctx is done.
+func (m *Master) ExpireWorkersPeriodically(ctx context.Context, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, addr := range m.ExpireWorkers(ttl) {
+				log.Printf("Removed worker %s: no heartbeat received for %v", addr, ttl)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SelectWorker returns the worker which should execute the operations of the given host
+// according to the master's Selector. The worker's Outstanding count is incremented, and the
+// caller must call ReleaseWorker once the worker has finished processing the host.
+func (m *Master) SelectWorker(hostname string) (*WorkerConn, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -99,53 +310,85 @@ func (m *Master) SelectWorker() (*rpc.Client, error) {
 		return nil, errors.New("no workers connected")
 	}
 
-	if m.LastUsedWorker == len(m.Workers)-1 {
-		// Last used worker is the last one in the slice - start over from index 0
-		log.Println("Selected worker 0")
-		m.LastUsedWorker = 0
-		return m.Workers[0], nil
+	if m.Selector == nil {
+		m.Selector = &RoundRobinSelector{}
 	}
 
-	selected := m.LastUsedWorker + 1
-	log.Printf("Selected worker %d", selected)
+	selected := m.Selector.Select(m.Workers, hostname)
+	w := m.Workers[selected]
+	log.Printf("[%s] Selected worker %d (%s)", hostname, selected, w.Addr)
+	w.Outstanding++
 
-	m.LastUsedWorker++
+	return w, nil
+}
 
-	return m.Workers[selected], nil
+// ReleaseWorker indicates that a worker returned by SelectWorker has finished processing a host.
+func (m *Master) ReleaseWorker(w *WorkerConn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	w.Outstanding--
 }
 
-// StoreRun stores a new run in the DB.
-func (m *Master) StoreRun(session *gocql.Session, id gocql.UUID, ts time.Time) error {
-	log.Printf("Saving new run '%s' to DB", id.String())
-	q := `INSERT INTO runs (id, create_time) values (?, ?)`
-	if err := session.Query(q, id, ts).Exec(); err != nil {
-		return fmt.Errorf("error storing run in DB: %v", err)
-	}
-	return nil
+// StoreRun stores a new run in the store.
+func (m *Master) StoreRun(r Run) error {
+	log.Printf("Saving new run '%s' to DB", r.ID.String())
+	return m.Store.StoreRun(r)
+}
+
+// FinishRun marks a stored run as completed.
+func (m *Master) FinishRun(r Run) error {
+	log.Printf("Saving completion of run '%s' to DB", r.ID.String())
+	return m.Store.FinishRun(r)
 }
 
-// StoreResults stores the results of a run in the DB.
-// TODO Store stdout and stderr in DB.
-func (m *Master) StoreResults(session *gocql.Session, runID gocql.UUID, hostname string, results []ops.OperationResult) error {
+// GetRun returns the run with the given ID from the store.
+func (m *Master) GetRun(id gocql.UUID) (Run, error) {
+	return m.Store.GetRun(id)
+}
+
+// GetRuns returns up to limit runs from the store, most recent first. A limit of 0 means no limit.
+func (m *Master) GetRuns(limit int) ([]Run, error) {
+	return m.Store.GetRuns(limit)
+}
+
+// GetResults returns the results of a run from the store. If hostname isn't empty, only the
+// results for that host are returned.
+func (m *Master) GetResults(runID gocql.UUID, hostname string) ([]Result, error) {
+	return m.Store.GetResults(runID, hostname)
+}
+
+// StoreResults stores the results of a run in the store. The output of each result is truncated
+// to MaxOutputSize bytes.
+func (m *Master) StoreResults(runID gocql.UUID, hostname string, results []ops.OperationResult) error {
 	log.Printf("Saving %d results for host '%s' to DB", len(results), hostname)
-	for _, r := range results {
-		// Insert result atomically to two tables
-		b := session.NewBatch(gocql.UnloggedBatch)
 
-		now := time.Now()
+	truncated := make([]ops.OperationResult, len(results))
+	for i, r := range results {
+		r.StdOut = truncateOutput(r.StdOut, m.MaxOutputSize)
+		r.StdErr = truncateOutput(r.StdErr, m.MaxOutputSize)
+		truncated[i] = r
+	}
 
-		q1 := `INSERT INTO results_by_run_id (id, run_id, hostname, ts, script_name, successful)
-			values (uuid(), ?, ?, ?, ?, ?)`
-		b.Query(q1, runID, hostname, now, r.Operation.ScriptName, r.Successful)
+	return m.Store.StoreResults(runID, hostname, truncated)
+}
 
-		q2 := `INSERT INTO results_by_run_id_and_hostname
-			(id, run_id, hostname, ts, script_name, successful)
-			values (uuid(), ?, ?, ?, ?, ?)`
-		b.Query(q2, runID, hostname, now, r.Operation.ScriptName, r.Successful)
+// GetOutput returns the output stored for a host in a run, oldest first.
+func (m *Master) GetOutput(runID gocql.UUID, hostname string) ([]Output, error) {
+	return m.Store.GetOutput(runID, hostname)
+}
 
-		if err := session.ExecuteBatch(b); err != nil {
-			return fmt.Errorf("error storing results in DB: %v", err)
-		}
+// Truncates s to at most max bytes, not counting a marker which is appended to indicate how many
+// bytes were dropped. The string is never cut in the middle of a UTF-8 sequence. A max of 0 means
+// no limit.
+func truncateOutput(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
 	}
-	return nil
+
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+
+	return fmt.Sprintf("%s\n[output truncated: %d bytes dropped]", s[:cut], len(s)-cut)
 }
@@ -3,27 +3,31 @@ package master
 import (
 	"io/ioutil"
 	"log"
+	"net/http/httptest"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/johananl/simple-cm/secrets"
 )
 
 func TestSSHKey(t *testing.T) {
-	m := Master{SSHKeysDir: "./"}
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m := Master{Secrets: secrets.DirProvider{Dir: dir}}
 
 	// TODO Generate a real SSH key
-	fn := "./test_key"
 	contents := "secretstuff"
-	err := ioutil.WriteFile(fn, []byte(contents), 0644)
+	err = ioutil.WriteFile(filepath.Join(dir, "test_key"), []byte(contents), 0644)
 	if err != nil {
 		t.Fatalf("error writing dummy key: %v", err)
 	}
-	defer func() {
-		err := os.Remove(fn)
-		if err != nil {
-			t.Logf("could not clean up key after testing: %v", err)
-		}
-	}()
 
 	k, err := m.SSHKey("test_key")
 	if err != nil {
@@ -33,19 +37,26 @@ func TestSSHKey(t *testing.T) {
 	if k != contents {
 		t.Fatalf("wrong contents read from key: got %v want %v", k, contents)
 	}
+
+	if _, err := m.SSHKey("nosuchkey"); err == nil {
+		t.Fatalf("expected an error reading a missing key")
+	}
+	if _, err := (&Master{}).SSHKey("test_key"); err == nil {
+		t.Fatalf("expected an error reading a key without a secrets provider")
+	}
 }
 
 func TestSelectWorker(t *testing.T) {
-	w := []*rpc.Client{
-		&rpc.Client{},
-		&rpc.Client{},
-		&rpc.Client{},
-		&rpc.Client{},
-		&rpc.Client{},
+	w := []*WorkerConn{
+		&WorkerConn{},
+		&WorkerConn{},
+		&WorkerConn{},
+		&WorkerConn{},
+		&WorkerConn{},
 	}
 	m := Master{
-		Workers:        w,
-		LastUsedWorker: 0,
+		Workers:  w,
+		Selector: &RoundRobinSelector{},
 	}
 
 	var want int
@@ -56,7 +67,7 @@ func TestSelectWorker(t *testing.T) {
 			want = i + 1
 		}
 
-		c, err := m.SelectWorker()
+		c, err := m.SelectWorker("")
 		if err != nil {
 			log.Fatalf("Error selecting worker: %v", err)
 		}
@@ -65,3 +76,74 @@ func TestSelectWorker(t *testing.T) {
 		}
 	}
 }
+
+func TestRegisterWorker(t *testing.T) {
+	// rpc.Server accepts HTTP CONNECT requests on any path.
+	server := httptest.NewServer(rpc.NewServer())
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	m := Master{}
+	if err := m.Heartbeat(addr); err != ErrWorkerNotRegistered {
+		t.Fatalf("Wrong heartbeat error for unregistered worker: got %v want %v", err,
+			ErrWorkerNotRegistered)
+	}
+
+	// Registering twice shouldn't add the worker twice.
+	for i := 0; i < 2; i++ {
+		if err := m.RegisterWorker(addr); err != nil {
+			t.Fatalf("Error registering worker: %v", err)
+		}
+	}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	if len(m.Workers) != 2 {
+		t.Fatalf("Wrong number of workers: got %d want 2", len(m.Workers))
+	}
+	if err := m.Heartbeat(addr); err != nil {
+		t.Fatalf("Error sending heartbeat: %v", err)
+	}
+
+	// Only the registered worker expires.
+	m.Selector = &RoundRobinSelector{last: 1}
+	m.Workers[0].LastSeen = time.Now().Add(-time.Minute)
+	expired := m.ExpireWorkers(30 * time.Second)
+	if len(expired) != 1 || expired[0] != addr {
+		t.Fatalf("Wrong expired workers: got %v want [%s]", expired, addr)
+	}
+	if len(m.Workers) != 1 || !m.Workers[0].Static {
+		t.Fatalf("Wrong workers after expiry: got %+v", m.Workers)
+	}
+
+	// The last used worker is now past the end of the slice.
+	c, err := m.SelectWorker("")
+	if err != nil {
+		t.Fatalf("Error selecting worker: %v", err)
+	}
+	if c != m.Workers[0] {
+		t.Fatalf("Wrong worker selected: got %v want %v", c, m.Workers[0])
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"hello", 0, "hello"},
+		{"hello", 5, "hello"},
+		{"hello world", 5, "hello\n[output truncated: 6 bytes dropped]"},
+		// Don't split the 2-byte "é"
+		{"caf\u00e9!", 4, "caf\n[output truncated: 3 bytes dropped]"},
+	}
+
+	for _, test := range tests {
+		got := truncateOutput(test.in, test.max)
+		if got != test.want {
+			t.Fatalf("wrong output for %q with max %d: got %q want %q", test.in, test.max, got,
+				test.want)
+		}
+	}
+}
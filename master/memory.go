@@ -0,0 +1,293 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// MemoryStore is a Store which keeps everything in memory. It is meant for tests and for local
+// dry runs which shouldn't require a DB. Nothing is persisted once the process exits.
+type MemoryStore struct {
+	hosts      map[string]ops.Host
+	operations map[string][]ops.Operation
+	// Operations by group name.
+	groupOperations map[string][]ops.Operation
+	roles           map[string]ops.Role
+	hostRoles       map[string][]ops.RoleAssignment
+	variables       map[variableScopeKey]map[string]string
+	runs            map[gocql.UUID]Run
+	results         map[gocql.UUID][]Result
+	output          map[gocql.UUID][]Output
+	lock            sync.RWMutex
+}
+
+// Identifies the variables of a scope.
+type variableScopeKey struct {
+	scope VariableScope
+	name  string
+}
+
+// Returns the key of the given scope. The name of the global scope is ignored.
+func newVariableScopeKey(scope VariableScope, scopeName string) variableScopeKey {
+	if scope == ScopeGlobal {
+		scopeName = ""
+	}
+	return variableScopeKey{scope: scope, name: scopeName}
+}
+
+// NewMemoryStore returns an empty *MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		hosts:           make(map[string]ops.Host),
+		operations:      make(map[string][]ops.Operation),
+		groupOperations: make(map[string][]ops.Operation),
+		roles:           make(map[string]ops.Role),
+		hostRoles:       make(map[string][]ops.RoleAssignment),
+		variables:       make(map[variableScopeKey]map[string]string),
+		runs:            make(map[gocql.UUID]Run),
+		results:         make(map[gocql.UUID][]Result),
+		output:          make(map[gocql.UUID][]Output),
+	}
+}
+
+// AddHost adds a host to the inventory. An existing host with the same hostname is replaced.
+func (s *MemoryStore) AddHost(h ops.Host) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.hosts[h.Hostname] = h
+	return nil
+}
+
+// AddOperation adds an operation for the given host.
+func (s *MemoryStore) AddOperation(hostname string, o ops.Operation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.operations[hostname] = append(s.operations[hostname], o)
+	return nil
+}
+
+// AddGroupOperation adds an operation for the hosts in the given group.
+func (s *MemoryStore) AddGroupOperation(group string, o ops.Operation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.groupOperations[group] = append(s.groupOperations[group], o)
+	return nil
+}
+
+// AddRole adds a role, replacing an existing role with the same name.
+func (s *MemoryStore) AddRole(r ops.Role) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.roles[r.Name] = r
+	return nil
+}
+
+// AddHostRole assigns a role to a host after the roles which are already assigned to it.
+func (s *MemoryStore) AddHostRole(hostname string, a ops.RoleAssignment) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.hostRoles[hostname] = append(s.hostRoles[hostname], a)
+	return nil
+}
+
+// SetVariable sets a variable in the given scope, replacing its existing value.
+func (s *MemoryStore) SetVariable(scope VariableScope, scopeName, name, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	k := newVariableScopeKey(scope, scopeName)
+	if s.variables[k] == nil {
+		s.variables[k] = make(map[string]string)
+	}
+	s.variables[k][name] = value
+	return nil
+}
+
+// GetHosts returns all the hosts sorted by hostname.
+func (s *MemoryStore) GetHosts() ([]ops.Host, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var hosts []ops.Host
+	for _, h := range s.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Hostname < hosts[j].Hostname })
+
+	return hosts, nil
+}
+
+// SetHostKeyFingerprint pins the SSH host key fingerprint of the given host.
+func (s *MemoryStore) SetHostKeyFingerprint(hostname, fingerprint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.hosts[hostname]
+	if !ok {
+		return fmt.Errorf("no such host: %s", hostname)
+	}
+	h.HostKeyFingerprint = fingerprint
+	s.hosts[hostname] = h
+	return nil
+}
+
+// GetOperations returns all the operations for the given host in the order they were added.
+func (s *MemoryStore) GetOperations(hostname string) ([]ops.Operation, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]ops.Operation(nil), s.operations[hostname]...), nil
+}
+
+// GetGroupOperations returns all the operations for the given group in the order they were added.
+func (s *MemoryStore) GetGroupOperations(group string) ([]ops.Operation, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]ops.Operation(nil), s.groupOperations[group]...), nil
+}
+
+// GetHostRoles returns the roles which are assigned to the given host in the order they were
+// assigned.
+func (s *MemoryStore) GetHostRoles(hostname string) ([]ops.RoleAssignment, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]ops.RoleAssignment(nil), s.hostRoles[hostname]...), nil
+}
+
+// GetRole returns the role with the given name or ErrRoleNotFound if there is no such role.
+func (s *MemoryStore) GetRole(name string) (ops.Role, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	r, ok := s.roles[name]
+	if !ok {
+		return ops.Role{}, ErrRoleNotFound
+	}
+	return r, nil
+}
+
+// GetVariables returns the variables which are defined in the given scope.
+func (s *MemoryStore) GetVariables(scope VariableScope, scopeName string) (map[string]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	vars := make(map[string]string)
+	for k, v := range s.variables[newVariableScopeKey(scope, scopeName)] {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// StoreRun stores a new run.
+func (s *MemoryStore) StoreRun(r Run) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.runs[r.ID] = Run{ID: r.ID, CreateTime: r.CreateTime, Check: r.Check}
+	return nil
+}
+
+// FinishRun updates a stored run once it has completed.
+func (s *MemoryStore) FinishRun(r Run) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.runs[r.ID] = r
+	return nil
+}
+
+// StoreResults stores the results of a run.
+func (s *MemoryStore) StoreResults(runID gocql.UUID, hostname string, results []ops.OperationResult) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for _, r := range results {
+		s.results[runID] = append(s.results[runID], Result{
+			OperationResult: r,
+			RunID:           runID,
+			Hostname:        hostname,
+			Timestamp:       now,
+		})
+	}
+	return nil
+}
+
+// GetRun returns the run with the given ID.
+func (s *MemoryStore) GetRun(id gocql.UUID) (Run, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	r, ok := s.runs[id]
+	if !ok {
+		return Run{}, ErrRunNotFound
+	}
+	return r, nil
+}
+
+// GetRuns returns up to limit runs, most recent first.
+func (s *MemoryStore) GetRuns(limit int) ([]Run, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var runs []Run
+	for _, r := range s.runs {
+		runs = append(runs, r)
+	}
+	return sortRuns(runs, limit), nil
+}
+
+// GetResults returns the results of a run, optionally only for the given host.
+func (s *MemoryStore) GetResults(runID gocql.UUID, hostname string) ([]Result, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var results []Result
+	for _, r := range s.results[runID] {
+		if hostname == "" || r.Hostname == hostname {
+			results = append(results, r)
+		}
+	}
+	sortResults(results)
+	return results, nil
+}
+
+// StoreOutput stores a chunk of an operation's output.
+func (s *MemoryStore) StoreOutput(o Output) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.output[o.RunID] = append(s.output[o.RunID], o)
+	return nil
+}
+
+// GetOutput returns the output stored for a host in a run, oldest first.
+func (s *MemoryStore) GetOutput(runID gocql.UUID, hostname string) ([]Output, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var output []Output
+	for _, o := range s.output[runID] {
+		if o.Hostname == hostname {
+			output = append(output, o)
+		}
+	}
+	return output, nil
+}
+
+// Close is a no-op.
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	m := Master{Store: s}
+
+	s.AddHost(ops.Host{Hostname: "host2", User: "root"})
+	s.AddHost(ops.Host{Hostname: "host1", User: "root", PasswordName: "host_password",
+		Groups: []string{"base"}})
+	o := ops.Operation{
+		Description: "verify_test_file_exists",
+		ScriptName:  "file_exists",
+		Attributes:  map[string]string{"path": "/etc/passwd"},
+	}
+	s.AddOperation("host1", o)
+	groupOp := ops.Operation{Description: "verify_hosts_exists", ScriptName: "file_exists"}
+	s.AddGroupOperation("base", groupOp)
+	s.AddRole(ops.Role{
+		Name:       "dns",
+		Attributes: map[string]string{"path": "/etc/hosts"},
+		Operations: []ops.Operation{{Description: "verify_dns", ScriptName: "file_contains"}},
+	})
+	s.AddHostRole("host1", ops.RoleAssignment{Role: "dns",
+		Attributes: map[string]string{"text": "1.1.1.1"}})
+	roleOp := ops.Operation{
+		Description: "verify_dns",
+		ScriptName:  "file_contains",
+		Attributes:  map[string]string{"path": "/etc/hosts", "text": "1.1.1.1"},
+	}
+
+	hosts, err := m.GetHosts()
+	if err != nil {
+		t.Fatalf("Error getting hosts: %v", err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("Wrong number of hosts returned: got %d want %d", len(hosts), 2)
+	}
+	if hosts[0].Hostname != "host1" || hosts[1].Hostname != "host2" {
+		t.Fatalf("Wrong hosts returned: got %v", hosts)
+	}
+
+	// The operations of the host's roles come first, followed by those of its groups.
+	operations, err := m.GetHostOperations(hosts[0])
+	if err != nil {
+		t.Fatalf("Error getting operations: %v", err)
+	}
+	if want := []ops.Operation{roleOp, groupOp, o}; !reflect.DeepEqual(operations, want) {
+		t.Fatalf("Wrong operations returned: got %v want %v", operations, want)
+	}
+	operations, _ = m.GetHostOperations(hosts[1])
+	if len(operations) != 0 {
+		t.Fatalf("Wrong operations returned: got %v want none", operations)
+	}
+
+	s.AddHostRole("host2", ops.RoleAssignment{Role: "nosuchrole"})
+	if _, err := m.GetHostOperations(hosts[1]); err == nil {
+		t.Fatalf("Expected an error for an unknown role")
+	}
+
+	runID := gocql.TimeUUID()
+	if err := m.StoreRun(Run{ID: runID, CreateTime: time.Now()}); err != nil {
+		t.Fatalf("Error storing run: %v", err)
+	}
+	results := []ops.OperationResult{{Operation: o, StdOut: "out", Successful: true}}
+	if err := m.StoreResults(runID, "host1", results); err != nil {
+		t.Fatalf("Error storing results: %v", err)
+	}
+
+	got, err := m.GetResults(runID, "host1")
+	if err != nil {
+		t.Fatalf("Error getting results: %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].OperationResult, results[0]) {
+		t.Fatalf("Wrong results stored: got %v want %v", got, results)
+	}
+	if got[0].RunID != runID || got[0].Hostname != "host1" {
+		t.Fatalf("Wrong run ID or hostname: got %v, %s", got[0].RunID, got[0].Hostname)
+	}
+
+	got, _ = m.GetResults(runID, "host2")
+	if len(got) != 0 {
+		t.Fatalf("Wrong number of results for host2: got %d want 0", len(got))
+	}
+
+	end := time.Now()
+	if err := m.FinishRun(Run{ID: runID, CreateTime: end.Add(-time.Second), EndTime: end}); err != nil {
+		t.Fatalf("Error finishing run: %v", err)
+	}
+	runs, err := m.GetRuns(0)
+	if err != nil {
+		t.Fatalf("Error getting runs: %v", err)
+	}
+	if len(runs) != 1 || runs[0].ID != runID || !runs[0].EndTime.Equal(end) {
+		t.Fatalf("Wrong runs: got %v", runs)
+	}
+}
+
+func TestGetHostVariables(t *testing.T) {
+	s := NewMemoryStore()
+	m := Master{Store: s}
+
+	s.SetVariable(ScopeGlobal, "", "ntp_server", "pool.ntp.org")
+	s.SetVariable(ScopeGlobal, "", "dns_server", "1.1.1.1")
+	s.SetVariable(ScopeGlobal, "", "port", "80")
+	s.SetVariable(ScopeGroup, "web", "port", "8080")
+	s.SetVariable(ScopeGroup, "prod", "port", "8443")
+	s.SetVariable(ScopeGroup, "prod", "ntp_server", "ntp.prod")
+	s.SetVariable(ScopeHost, "host1", "ntp_server", "ntp.host1")
+	s.SetVariable(ScopeHost, "host2", "dns_server", "8.8.8.8")
+
+	// Later groups override earlier groups and the host overrides its groups.
+	vars, err := m.GetHostVariables(ops.Host{Hostname: "host1", Groups: []string{"web", "prod"}})
+	if err != nil {
+		t.Fatalf("Error getting variables: %v", err)
+	}
+	want := []Variable{
+		{Name: "dns_server", Value: "1.1.1.1", Scope: ScopeGlobal},
+		{Name: "ntp_server", Value: "ntp.host1", Scope: ScopeHost, ScopeName: "host1"},
+		{Name: "port", Value: "8443", Scope: ScopeGroup, ScopeName: "prod"},
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Fatalf("Wrong variables: got %v want %v", vars, want)
+	}
+
+	wantValues := map[string]string{
+		"dns_server": "1.1.1.1",
+		"ntp_server": "ntp.host1",
+		"port":       "8443",
+	}
+	if values := VariableValues(vars); !reflect.DeepEqual(values, wantValues) {
+		t.Fatalf("Wrong variable values: got %v want %v", values, wantValues)
+	}
+}
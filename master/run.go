@@ -0,0 +1,522 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/worker"
+)
+
+// DefaultConcurrency is the maximum number of hosts which are processed in parallel during a run
+// if RunSpec doesn't specify otherwise.
+const DefaultConcurrency = 10
+
+// RunSpec specifies how a run should be executed.
+type RunSpec struct {
+	// ID is the ID to assign to the run. If it is zero, a new time-based ID is generated. Setting
+	// the ID allows the caller to know it before the run completes.
+	ID gocql.UUID
+	// Concurrency is the maximum number of hosts to process in parallel.
+	Concurrency int
+	// Check executes the operations in check mode, in which modules report what they would
+	// change without changing anything.
+	Check bool
+	// Target selects the hosts to execute the run on. The zero Target selects every host in the
+	// inventory.
+	Target Target
+}
+
+// Run executes the operations of every host selected by spec's target using the connected workers
+// and stores the results. Run blocks until all the hosts have been processed and returns the
+// completed run.
+//
+// Multiple runs may execute concurrently on the same Master. Cancelling ctx stops processing
+// hosts which haven't been dispatched to a worker yet and cancels the executions which are in
+// progress on the workers, whose remaining operations are marked with StatusCancelled. The run is
+// still marked as completed and ctx's error is returned.
+func (m *Master) Run(ctx context.Context, spec RunSpec) (Run, error) {
+	run := Run{ID: spec.ID, Check: spec.Check}
+	if run.ID == (gocql.UUID{}) {
+		run.ID = gocql.TimeUUID()
+	}
+	concurrency := spec.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	// Read hosts from DB
+	hosts, err := m.GetHosts()
+	if err != nil {
+		return run, fmt.Errorf("could not get hosts from DB: %v", err)
+	}
+
+	log.Printf("%d hosts retrieved from DB", len(hosts))
+
+	if !spec.Target.IsZero() {
+		if hosts, err = spec.Target.Select(hosts); err != nil {
+			return run, err
+		}
+		log.Printf("%d hosts selected by %s", len(hosts), spec.Target)
+	}
+
+	// Store new run in DB
+	run.CreateTime = time.Now()
+	if err := m.StoreRun(run); err != nil {
+		return run, fmt.Errorf("could not store run in DB: %v", err)
+	}
+
+	// Process multiple hosts in parallel
+	log.Printf("Executing operations on a maximum of %d hosts in parallel", concurrency)
+	if run.Check {
+		log.Printf("Run %s is executed in check mode, so no changes are made", run.ID)
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	run.Counts = make(map[ops.Status]int)
+hosts:
+	for _, h := range hosts {
+		// Acquire semaphore slot
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			log.Printf("Run %s cancelled: %v", run.ID, ctx.Err())
+			break hosts
+		}
+		wg.Add(1)
+		go func(host ops.Host) {
+			defer func() {
+				// Release semaphore slot
+				<-sem
+				wg.Done()
+			}()
+
+			results := m.runHost(ctx, run, host)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, r := range results {
+				run.Counts[r.Status]++
+			}
+		}(h)
+	}
+	wg.Wait()
+
+	run.EndTime = time.Now()
+	if err := m.FinishRun(run); err != nil {
+		log.Printf("Could not store run completion in DB: %v", err)
+	}
+	log.Printf("Run %s completed: %s", run.ID, FormatCounts(run.Counts))
+
+	return run, ctx.Err()
+}
+
+// The description of the result which is stored for a host whose operations couldn't be read.
+const getOperationsDescription = "get operations"
+
+// Executes the operations of a single host as part of a run, stores the results and returns them.
+func (m *Master) runHost(ctx context.Context, run Run, host ops.Host) []ops.OperationResult {
+	// Get operations for host
+	operations, err := m.GetHostOperations(host)
+	if err != nil {
+		log.Printf("[%s] Could not get operations from DB: %v", host.Hostname, err)
+		// The host's operations are unknown, so a single result reports the error.
+		return m.failHost(run, host.Hostname, failedResults(
+			[]ops.Operation{{Description: getOperationsDescription}}, 0, ops.StatusError,
+			fmt.Errorf("could not get operations: %v", err)))
+	}
+
+	log.Printf("[%s] Retrieved %d operations", host.Hostname, len(operations))
+
+	vars, err := m.GetHostVariables(host)
+	if err != nil {
+		log.Printf("[%s] Could not get variables from DB: %v", host.Hostname, err)
+		return m.failHost(run, host.Hostname, failedResults(operations, 0, ops.StatusError,
+			fmt.Errorf("could not get variables: %v", err)))
+	}
+
+	// Send the operations in execution order, which is also the order of the results.
+	order, err := ops.Plan(operations)
+	if err != nil {
+		log.Printf("[%s] Invalid operations: %v", host.Hostname, err)
+		return m.failHost(run, host.Hostname, failedResults(operations, 0, ops.StatusError,
+			fmt.Errorf("invalid operation dependencies: %v", err)))
+	}
+	planned := make([]ops.Operation, len(order))
+	for n, i := range order {
+		planned[n] = operations[i]
+	}
+	operations = planned
+
+	for i := range operations {
+		if operations[i].Timeout == 0 {
+			operations[i].Timeout = m.OperationTimeout
+		}
+	}
+
+	// Operations whose modules are missing or whose attributes are invalid aren't sent to a worker,
+	// and neither are the operations which depend on them. The other operations are sent.
+	modules, invalid := m.modules(host, operations, VariableValues(vars))
+	results, send := skipInvalid(host.Hostname, operations, invalid)
+	if len(send) == 0 {
+		return m.failHost(run, host.Hostname, results)
+	}
+	if len(send) < len(operations) {
+		if err := m.StoreResults(run.ID, host.Hostname, failedOnly(results, send)); err != nil {
+			log.Printf("[%s] Could not store results in DB: %v", host.Hostname, err)
+		}
+		valid := make([]ops.Operation, len(send))
+		for n, i := range send {
+			valid[n] = operations[i]
+		}
+		operations = valid
+	}
+
+	// Execute operations
+	in := worker.ExecuteInput{
+		Hostname:           host.Hostname,
+		User:               host.User,
+		KeyName:            host.KeyName,
+		PasswordName:       host.PasswordName,
+		Operations:         operations,
+		HostKeyFingerprint: host.HostKeyFingerprint,
+		TrustOnFirstUse:    m.TrustOnFirstUse,
+		ID:                 gocql.TimeUUID().String(),
+		Timeout:            m.HostTimeout,
+		Check:              run.Check,
+		Variables:          VariableValues(vars),
+		Modules:            modules,
+	}
+	if m.HostTimeout > 0 {
+		// The worker enforces the host's timeout. This deadline only guards against workers which
+		// don't respond.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.HostTimeout+cancelGracePeriod)
+		defer cancel()
+	}
+	events := newHostEvents(m, run.ID, host.Hostname, operations)
+	out := m.execute(ctx, in, events.handle)
+
+	// Pin the host key if it was trusted on first use
+	if m.TrustOnFirstUse && host.HostKeyFingerprint == "" && out.HostKeyFingerprint != "" {
+		log.Printf("[%s] Trusting host key %s on first use", host.Hostname,
+			out.HostKeyFingerprint)
+		err = m.Store.SetHostKeyFingerprint(host.Hostname, out.HostKeyFingerprint)
+		if err != nil {
+			log.Printf("[%s] Could not store host key fingerprint in DB: %v", host.Hostname, err)
+		}
+	}
+
+	// Store the results of the final attempt
+	if err := m.StoreResults(run.ID, host.Hostname, out.Results); err != nil {
+		log.Printf("[%s] Could not store results in DB: %v", host.Hostname, err)
+	}
+
+	for n, r := range out.Results {
+		if n < len(send) {
+			results[send[n]] = r
+		}
+	}
+	logResults(host.Hostname, results)
+
+	return results
+}
+
+// Returns a result for each of the given operations, which must be in execution order, along with
+// the indices of the operations which can be sent to a worker. Operations which are invalid and
+// operations which depend on an operation which isn't sent get a failed result. The results of the
+// operations which are sent are placeholders until the worker reports them.
+func skipInvalid(hostname string, operations []ops.Operation, invalid map[int]error) ([]ops.OperationResult, []int) {
+	results := make([]ops.OperationResult, len(operations))
+	var send []int
+	for i, o := range operations {
+		if err, ok := invalid[i]; ok {
+			log.Printf("[%s] Not executing operation %s: %v", hostname, o.Description, err)
+			results[i] = failedResults([]ops.Operation{o}, 0, ops.StatusError, err)[0]
+			continue
+		}
+		if d := worker.FailedDependency(o, operations[:i], results[:i]); d != "" {
+			log.Printf("[%s] Skipping operation %s since %s is invalid", hostname, o.Description, d)
+			results[i] = failedResults([]ops.Operation{o}, 0, ops.StatusSkipped,
+				fmt.Errorf("dependency %s didn't succeed", d))[0]
+			continue
+		}
+		results[i] = ops.OperationResult{Operation: o, Successful: true}
+		send = append(send, i)
+	}
+	return results, send
+}
+
+// Returns the results whose indices aren't in sent.
+func failedOnly(results []ops.OperationResult, sent []int) []ops.OperationResult {
+	var failed []ops.OperationResult
+	n := 0
+	for i, r := range results {
+		if n < len(sent) && sent[n] == i {
+			n++
+			continue
+		}
+		failed = append(failed, r)
+	}
+	return failed
+}
+
+// Reads the modules of the given operations of host from m.ModulesDir, validates the attributes of
+// the operations against the manifests of their modules and fills in the defaults of the modules'
+// parameters. The modules must support the host's operating system, if it is known. Returns the
+// sources of the modules, which are sent to the worker along with the operations, and the errors
+// of the invalid operations by the index of the operation. If m.ModulesDir isn't set, workers use
+// their own modules and no validation is done.
+func (m *Master) modules(host ops.Host, operations []ops.Operation, vars map[string]string) ([]ops.ModuleSource, map[int]error) {
+	var sources []ops.ModuleSource
+	invalid := make(map[int]error)
+	if m.ModulesDir == "" {
+		return sources, invalid
+	}
+
+	modules := make(map[string]*ops.Module)
+	for i, o := range operations {
+		mod, ok := modules[o.ScriptName]
+		if !ok {
+			s, err := ops.ReadModule(m.ModulesDir, o.ScriptName)
+			if err != nil {
+				invalid[i] = err
+				continue
+			}
+			if mod, err = s.Parse(); err != nil {
+				invalid[i] = fmt.Errorf("module %s: %v", o.ScriptName, err)
+				continue
+			}
+			modules[o.ScriptName] = mod
+			sources = append(sources, s)
+		}
+		if mod.Manifest == nil {
+			continue
+		}
+		if hostOS := host.Labels[ops.OSLabel]; !mod.Manifest.SupportsOS(hostOS) {
+			invalid[i] = fmt.Errorf("module %s doesn't support OS %s", o.ScriptName, hostOS)
+			continue
+		}
+		var err error
+		if operations[i], err = mod.Manifest.Apply(o, vars); err != nil {
+			invalid[i] = err
+		}
+	}
+	return sources, invalid
+}
+
+// Stores and logs the results of a host whose operations weren't sent to a worker and returns
+// them.
+func (m *Master) failHost(run Run, hostname string, results []ops.OperationResult) []ops.OperationResult {
+	if err := m.StoreResults(run.ID, hostname, results); err != nil {
+		log.Printf("[%s] Could not store results in DB: %v", hostname, err)
+	}
+	logResults(hostname, results)
+	return results
+}
+
+// The time to wait for a worker to report the results of an execution after it was cancelled.
+var cancelGracePeriod = 10 * time.Second
+
+// Sends the operations of a host to a worker and returns the results. If the worker fails, it is
+// removed from the pool and the operations are sent to another worker, up to MaxAttempts times. If
+// no worker succeeds, every operation is marked with StatusError. If the transport supports it,
+// events is called for the events the worker sends while executing the operations.
+//
+// Once ctx is done, the execution is cancelled on the worker. If the worker doesn't report the
+// results within cancelGracePeriod, every operation is marked with StatusCancelled, or with
+// StatusTimeout if ctx's deadline was exceeded.
+func (m *Master) execute(ctx context.Context, in worker.ExecuteInput, events func(worker.Event)) worker.ExecuteOutput {
+	maxAttempts := m.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			status, reason := m.interrupted(ctx)
+			return worker.ExecuteOutput{Results: failedResults(in.Operations, attempt-1, status,
+				reason)}
+		}
+
+		w, err := m.SelectWorker(in.Hostname)
+		if err != nil {
+			log.Printf("[%s] Could not select worker: %v", in.Hostname, err)
+			return worker.ExecuteOutput{Results: failedResults(in.Operations, attempt-1,
+				ops.StatusError, fmt.Errorf("could not select worker: %v", err))}
+		}
+
+		out, err := m.call(ctx, w, in, attempt, events)
+		m.ReleaseWorker(w)
+		if err == nil {
+			for i := range out.Results {
+				out.Results[i].Worker = w.Addr
+				out.Results[i].Attempts = attempt
+			}
+			return out
+		}
+
+		if ctx.Err() != nil {
+			status, reason := m.interrupted(ctx)
+			log.Printf("[%s] Execution on worker %s interrupted: %v", in.Hostname, w.Addr, reason)
+			return worker.ExecuteOutput{Results: failedResults(in.Operations, attempt, status,
+				reason)}
+		}
+
+		log.Printf("[%s] Error executing operations on worker %s: %v", in.Hostname, w.Addr, err)
+		if !isTransportError(err) || attempt >= maxAttempts {
+			return worker.ExecuteOutput{Results: failedResults(in.Operations, attempt,
+				ops.StatusError,
+				fmt.Errorf("error executing operations on worker %s: %v", w.Addr, err))}
+		}
+
+		m.removeWorker(w, err)
+		log.Printf("[%s] Retrying on another worker (attempt %d of %d)", in.Hostname, attempt+1,
+			maxAttempts)
+	}
+}
+
+// Sends the operations of a host to a single worker and waits for the results. If ctx is done
+// before the worker responds, the execution is cancelled on the worker and the worker is given
+// cancelGracePeriod to respond, after which the call is abandoned and ctx's error is returned.
+// Events which arrive after the call returns are dropped.
+func (m *Master) call(ctx context.Context, w *WorkerConn, in worker.ExecuteInput, attempt int, events func(worker.Event)) (worker.ExecuteOutput, error) {
+	var lock sync.Mutex
+	abandoned := false
+	handle := func(e worker.Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		if abandoned || events == nil {
+			return
+		}
+		if e.Kind == worker.EventFinished {
+			e.Result.Worker = w.Addr
+			e.Result.Attempts = attempt
+		}
+		events(e)
+	}
+
+	callCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type response struct {
+		out worker.ExecuteOutput
+		err error
+	}
+	done := make(chan response, 1)
+	go func() {
+		var r response
+		r.err = w.Client.Execute(callCtx, &in, &r.out, handle)
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-ctx.Done():
+	}
+
+	log.Printf("[%s] Cancelling execution on worker %s: %v", in.Hostname, w.Addr, ctx.Err())
+	cancelCtx, cancelTimeout := context.WithTimeout(context.Background(), cancelGracePeriod)
+	defer cancelTimeout()
+	err := w.Client.Cancel(cancelCtx, &worker.CancelInput{ID: in.ID}, &worker.CancelOutput{})
+	if err != nil {
+		log.Printf("[%s] Could not cancel execution on worker %s: %v", in.Hostname, w.Addr, err)
+	}
+
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-cancelCtx.Done():
+	}
+
+	lock.Lock()
+	abandoned = true
+	lock.Unlock()
+	return worker.ExecuteOutput{}, ctx.Err()
+}
+
+// Returns the status and error of operations which weren't executed because ctx is done.
+func (m *Master) interrupted(ctx context.Context) (ops.Status, error) {
+	if ctx.Err() == context.DeadlineExceeded && m.HostTimeout > 0 {
+		return ops.StatusTimeout, fmt.Errorf("host timed out after %v", m.HostTimeout)
+	}
+	return ops.StatusCancelled, errors.New("execution cancelled")
+}
+
+// Returns a result with the given status for each of the given operations, for when the operations
+// couldn't be executed by any worker.
+func failedResults(operations []ops.Operation, attempts int, status ops.Status, err error) []ops.OperationResult {
+	var results []ops.OperationResult
+	now := time.Now()
+	for _, o := range operations {
+		results = append(results, ops.OperationResult{
+			Operation: o,
+			Status:    status,
+			ExitCode:  -1,
+			Error:     err.Error(),
+			StartTime: now,
+			EndTime:   now,
+			Attempts:  attempts,
+		})
+	}
+	return results
+}
+
+// Logs a summary of the results of a host.
+func logResults(hostname string, results []ops.OperationResult) {
+	// Analyze results
+	var good, bad []ops.OperationResult
+	for _, i := range results {
+		if i.Successful {
+			good = append(good, i)
+		} else {
+			bad = append(bad, i)
+		}
+	}
+
+	// TODO Set colors for success / fail
+	if len(good) > 0 {
+		s := fmt.Sprintf("[%s] Completed operations:\n", hostname)
+		for _, i := range good {
+			s = s + fmt.Sprintf("* %s (%s, %v)\n", i.Operation.Description, i.Status, i.Duration())
+			if i.Message != "" {
+				s = s + fmt.Sprintf("message: %s\n", i.Message)
+			}
+			if i.StdOut != "" {
+				s = s + fmt.Sprintf("stdout:\n%v", formatScriptOutput(i.StdOut))
+			}
+			if i.StdErr != "" {
+				s = s + fmt.Sprintf("stderr:\n%v", formatScriptOutput(i.StdErr))
+			}
+		}
+		log.Print(s)
+	}
+
+	if len(bad) > 0 {
+		s := fmt.Sprintf("[%s] Failed operations:\n", hostname)
+		for _, i := range bad {
+			s = s + fmt.Sprintf("* %s (%s: %s)\n", i.Operation.Description, i.Status,
+				i.FailureReason())
+			if i.StdOut != "" {
+				s = s + fmt.Sprintf("stdout:\n%v", formatScriptOutput(i.StdOut))
+			}
+			if i.StdErr != "" {
+				s = s + fmt.Sprintf("stderr:\n%v", formatScriptOutput(i.StdErr))
+			}
+		}
+		log.Print(s)
+	}
+}
+
+// Formats a script's output for visual clarity.
+func formatScriptOutput(s string) string {
+	return "===================================================================\n" +
+		s +
+		"===================================================================\n"
+}
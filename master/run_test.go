@@ -0,0 +1,555 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/transport"
+	"github.com/johananl/simple-cm/worker"
+)
+
+func TestRunTrustOnFirstUse(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{hostKey: "SHA256:fake"})
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddHost(ops.Host{Hostname: "host2", User: "root", HostKeyFingerprint: "SHA256:pinned"})
+	s.AddOperation("host1", ops.Operation{Description: "op"})
+	s.AddOperation("host2", ops.Operation{Description: "op"})
+
+	m := Master{Store: s, TrustOnFirstUse: true}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	if _, err := m.Run(context.Background(), RunSpec{}); err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	// Only the key of the host which had no pinned key is pinned.
+	hosts, _ := m.GetHosts()
+	want := []string{"SHA256:fake", "SHA256:pinned"}
+	for i, h := range hosts {
+		if h.HostKeyFingerprint != want[i] {
+			t.Fatalf("Wrong fingerprint for %s: got %q want %q", h.Hostname, h.HostKeyFingerprint,
+				want[i])
+		}
+	}
+}
+
+func TestRunStreamsOutput(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go transport.ServeStream(l, &fakeWorker{})
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op1"})
+	s.AddOperation("host1", ops.Operation{Description: "op2"})
+
+	m := Master{Store: s, Transport: transport.DialStream}
+	if err := m.AddWorker(l.Addr().String()); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	output, err := m.GetOutput(run.ID, "host1")
+	if err != nil {
+		t.Fatalf("Error getting output: %v", err)
+	}
+	if len(output) != 2 || output[0].Description != "op1" || output[0].Data != "op1\n" ||
+		output[1].Stream != "stdout" {
+		t.Fatalf("Wrong output: got %+v", output)
+	}
+
+	results, err := m.GetResults(run.ID, "host1")
+	if err != nil {
+		t.Fatalf("Error getting results: %v", err)
+	}
+	if len(results) != 2 || results[0].Attempts != 1 || results[0].Worker == "" {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+// A fake worker which streams the result of the first operation of a host followed by a chunk of
+// output, and then blocks until release is closed.
+type partialWorker struct {
+	fakeWorker
+	release chan struct{}
+}
+
+func (w *partialWorker) ExecuteStream(in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error {
+	r := ops.OperationResult{Operation: in.Operations[0], Successful: true, Status: ops.StatusOK}
+	events(worker.Event{Kind: worker.EventStarted, Index: 0})
+	events(worker.Event{Kind: worker.EventFinished, Index: 0, Result: r})
+	events(worker.Event{Kind: worker.EventOutput, Index: 1, Stream: "stdout", Data: "partial"})
+	<-w.release
+	return errors.New("not reached")
+}
+
+func TestRunRetryAfterPartialStream(t *testing.T) {
+	var addrs []string
+	partial := &partialWorker{release: make(chan struct{})}
+	defer close(partial.release)
+	for _, h := range []transport.Handler{&fakeWorker{}, partial} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer l.Close()
+		go transport.ServeStream(l, h)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op1"})
+	s.AddOperation("host1", ops.Operation{Description: "op2"})
+
+	m := Master{Store: s, Transport: transport.DialStream}
+	for _, addr := range addrs {
+		if err := m.AddWorker(addr); err != nil {
+			t.Fatalf("Error adding worker: %v", err)
+		}
+	}
+
+	// Round-robin selects the partial worker first. Its connection fails once the master handled
+	// the result of op1, which is known once the output which follows it was stored, so the host
+	// is executed again by the other worker.
+	m.lock.RLock()
+	client := m.Workers[1].Client
+	m.lock.RUnlock()
+	go func() {
+		for {
+			s.lock.RLock()
+			n := len(s.output)
+			s.lock.RUnlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		client.Close()
+	}()
+	run, err := m.Run(context.Background(), RunSpec{})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	// Only the results of the final attempt are stored.
+	results, err := m.GetResults(run.ID, "host1")
+	if err != nil {
+		t.Fatalf("Error getting results: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Wrong number of results: got %+v", results)
+	}
+	for _, r := range results {
+		if r.Attempts != 2 || r.Worker != addrs[0] {
+			t.Fatalf("Wrong result: got %+v", r)
+		}
+	}
+	if run, _ = m.GetRun(run.ID); run.Counts[ops.StatusOK] != 2 {
+		t.Fatalf("Wrong counts: got %v", run.Counts)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	w := &fakeWorker{cancel: make(chan string)}
+	addr, stop := startFakeWorker(t, w)
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op"})
+
+	m := Master{Store: s}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitBusy(t, &m)
+		cancel()
+	}()
+	run, err := m.Run(ctx, RunSpec{})
+	if err != context.Canceled {
+		t.Fatalf("Wrong error: got %v want %v", err, context.Canceled)
+	}
+
+	// The worker was asked to cancel the execution and reported the results.
+	results, _ := m.GetResults(run.ID, "host1")
+	if len(results) != 1 || results[0].Status != ops.StatusCancelled || results[0].Worker != addr {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+func TestRunHostTimeout(t *testing.T) {
+	defer func(d time.Duration) { cancelGracePeriod = d }(cancelGracePeriod)
+	cancelGracePeriod = 50 * time.Millisecond
+
+	// The worker doesn't respond, so the master gives up on it.
+	w := &fakeWorker{hang: make(chan struct{})}
+	addr, stop := startFakeWorker(t, w)
+	defer stop()
+	defer close(w.hang)
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op1"})
+	s.AddOperation("host1", ops.Operation{Description: "op2", Timeout: time.Second})
+
+	m := Master{Store: s, HostTimeout: 50 * time.Millisecond, OperationTimeout: time.Minute}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	results, _ := m.GetResults(run.ID, "host1")
+	if len(results) != 2 || results[0].Status != ops.StatusTimeout || results[0].Attempts != 1 {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+	// Operations without a timeout get the master's default.
+	if results[0].Operation.Timeout != time.Minute || results[1].Operation.Timeout != time.Second {
+		t.Fatalf("Wrong operation timeouts: got %v and %v", results[0].Operation.Timeout,
+			results[1].Operation.Timeout)
+	}
+}
+
+// Waits until a worker is processing a host.
+func waitBusy(t *testing.T, m *Master) {
+	for i := 0; i < 100; i++ {
+		m.lock.RLock()
+		busy := len(m.Workers) > 0 && m.Workers[0].Outstanding > 0
+		m.lock.RUnlock()
+		if busy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("No worker became busy")
+}
+
+func TestRunOrder(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddHost(ops.Host{Hostname: "host2", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "restart", Order: 1,
+		DependsOn: []string{"configure"}})
+	s.AddOperation("host1", ops.Operation{Description: "configure", Order: 2})
+	s.AddOperation("host1", ops.Operation{Description: "install"})
+	s.AddOperation("host2", ops.Operation{Description: "op", DependsOn: []string{"missing"}})
+
+	m := Master{Store: s}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	// Operations are sent to the worker in execution order.
+	results, _ := m.GetResults(run.ID, "host1")
+	var order []string
+	for _, r := range results {
+		order = append(order, r.Operation.Description)
+	}
+	if strings.Join(order, ",") != "install,configure,restart" {
+		t.Fatalf("Wrong execution order: got %v", order)
+	}
+
+	// Operations with invalid dependencies aren't sent to a worker.
+	results, _ = m.GetResults(run.ID, "host2")
+	want := "invalid operation dependencies: operation op depends on unknown operation missing"
+	if len(results) != 1 || results[0].Status != ops.StatusError || results[0].Error != want ||
+		results[0].Worker != "" {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op"})
+
+	m := Master{Store: s}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{Check: true})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	stored, err := m.GetRun(run.ID)
+	if err != nil || !stored.Check {
+		t.Fatalf("Check mode wasn't stored: got %+v, %v", stored, err)
+	}
+	results, _ := m.GetResults(run.ID, "host1")
+	if len(results) != 1 || results[0].Status != ops.StatusChanged {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+func TestRunCounts(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddHost(ops.Host{Hostname: "host2", User: "root"})
+	s.AddOperation("host1", ops.Operation{Description: "op1"})
+	s.AddOperation("host1", ops.Operation{Description: "op2", DependsOn: []string{"op3"}})
+	s.AddOperation("host2", ops.Operation{Description: "op1"})
+
+	m := Master{Store: s}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{Check: true})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	// The dependency of op2 doesn't exist, so all of host1's operations are marked as errors.
+	want := map[ops.Status]int{ops.StatusError: 2, ops.StatusChanged: 1}
+	stored, err := m.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("Error getting run: %v", err)
+	}
+	if !reflect.DeepEqual(stored.Counts, want) {
+		t.Fatalf("Wrong counts: got %v, want %v", stored.Counts, want)
+	}
+	if got := FormatCounts(stored.Counts); got != "1 changed, 2 error" {
+		t.Fatalf("Wrong formatted counts: got %q", got)
+	}
+}
+
+func TestRunTarget(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root", Labels: map[string]string{"env": "prod"},
+		Groups: []string{"web"}})
+	s.AddHost(ops.Host{Hostname: "host2", User: "root", Labels: map[string]string{"env": "staging"},
+		Groups: []string{"web"}})
+	s.AddHost(ops.Host{Hostname: "host3", User: "root", Labels: map[string]string{"env": "prod"}})
+	s.AddGroupOperation("web", ops.Operation{Description: "group_op"})
+	s.AddOperation("host1", ops.Operation{Description: "host_op"})
+	s.AddOperation("host3", ops.Operation{Description: "host_op"})
+
+	m := Master{Store: s}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	target, err := ParseLimit("env=prod,web")
+	if err != nil {
+		t.Fatalf("Error parsing limit: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{Target: target})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	// Only host1 matches, and the group's operation is executed before the host's own operation.
+	results, _ := m.GetResults(run.ID, "")
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Hostname+"/"+r.Operation.Description)
+	}
+	if want := []string{"host1/group_op", "host1/host_op"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong results: got %v want %v", got, want)
+	}
+
+	_, err = m.Run(context.Background(), RunSpec{Target: Target{Hostnames: []string{"host4"}}})
+	if err == nil || !strings.Contains(err.Error(), "host4") {
+		t.Fatalf("Expected an error for an unknown host, got %v", err)
+	}
+}
+
+func TestRunModules(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating modules dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := `{"os": ["linux"], "parameters": {"path": {"required": true}, ` +
+		`"mode": {"type": "int", "default": 644}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.json"), []byte(manifest), 0644); err != nil {
+		t.Fatalf("Error writing manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("ls {{.path}}"), 0644); err != nil {
+		t.Fatalf("Error writing module: %v", err)
+	}
+	source, err := ops.ReadModule(dir, "file")
+	if err != nil {
+		t.Fatalf("Error reading module: %v", err)
+	}
+
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddHost(ops.Host{Hostname: "host2", User: "root"})
+	s.AddHost(ops.Host{Hostname: "host3", User: "root", Labels: map[string]string{"os": "windows"}})
+	s.AddOperation("host1", ops.Operation{Description: "op1", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}})
+	s.AddOperation("host2", ops.Operation{Description: "op1", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}})
+	s.AddOperation("host2", ops.Operation{Description: "op2", ScriptName: "file",
+		Attributes: map[string]string{"mode": "rw"}})
+	s.AddOperation("host2", ops.Operation{Description: "op3", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}, DependsOn: []string{"op2"}})
+	s.AddOperation("host2", ops.Operation{Description: "op4", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}, DependsOn: []string{"op1"}})
+	s.AddOperation("host3", ops.Operation{Description: "op1", ScriptName: "file",
+		Attributes: map[string]string{"path": "/etc/hosts"}})
+	s.AddOperation("host3", ops.Operation{Description: "op2", ScriptName: "missing"})
+
+	m := Master{Store: s, ModulesDir: dir}
+	if err := m.AddWorker(addr); err != nil {
+		t.Fatalf("Error adding worker: %v", err)
+	}
+	run, err := m.Run(context.Background(), RunSpec{})
+	if err != nil {
+		t.Fatalf("Error executing run: %v", err)
+	}
+
+	// Modules are sent to the worker along with the operations, whose defaults are filled in.
+	results, _ := m.GetResults(run.ID, "host1")
+	if len(results) != 1 || results[0].Status != ops.StatusOK ||
+		results[0].Operation.Attributes["mode"] != "644" ||
+		results[0].ModuleVersion != source.Version() {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+
+	// Operations with invalid attributes and the operations which depend on them aren't sent to
+	// the worker, but the other operations of the host are.
+	results, _ = m.GetResults(run.ID, "host2")
+	statuses := make(map[string]ops.Status)
+	errs := make(map[string]string)
+	for _, r := range results {
+		statuses[r.Operation.Description] = r.Status
+		errs[r.Operation.Description] = r.Error
+	}
+	want := map[string]ops.Status{
+		"op1": ops.StatusOK,
+		"op2": ops.StatusError,
+		"op3": ops.StatusSkipped,
+		"op4": ops.StatusOK,
+	}
+	if len(results) != len(want) || !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+	wantErr := `invalid attributes: parameter mode must be of type int, got "rw"; missing required ` +
+		"parameter path"
+	if errs["op2"] != wantErr || errs["op3"] != "dependency op2 didn't succeed" {
+		t.Fatalf("Wrong errors: got %v", errs)
+	}
+
+	results, _ = m.GetResults(run.ID, "host3")
+	if len(results) != 2 || results[0].Error != "module file doesn't support OS windows" ||
+		results[1].Error != "module missing not found" {
+		t.Fatalf("Wrong results: got %+v", results)
+	}
+}
+
+// A Store whose GetVariables fails.
+type failingVariablesStore struct {
+	Store
+}
+
+func (s failingVariablesStore) GetVariables(scope VariableScope, scopeName string) (map[string]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRunStoreErrors(t *testing.T) {
+	addr, stop := startFakeWorker(t, &fakeWorker{})
+	defer stop()
+
+	// host1 is assigned a role which doesn't exist, so its operations can't be read.
+	s := NewMemoryStore()
+	s.AddHost(ops.Host{Hostname: "host1", User: "root"})
+	s.AddHostRole("host1", ops.RoleAssignment{Role: "nosuchrole"})
+	s.AddHost(ops.Host{Hostname: "host2", User: "root"})
+	s.AddOperation("host2", ops.Operation{Description: "op1"})
+	s.AddOperation("host2", ops.Operation{Description: "op2"})
+
+	type result struct {
+		description string
+		status      ops.Status
+		err         string
+	}
+	noOperations := []result{{getOperationsDescription, ops.StatusError,
+		`could not get operations: host is assigned unknown role "nosuchrole"`}}
+
+	for _, tc := range []struct {
+		name  string
+		store Store
+		want  map[string][]result
+	}{
+		{"operations", s, map[string][]result{
+			"host1": noOperations,
+			"host2": {{"op1", ops.StatusOK, ""}, {"op2", ops.StatusOK, ""}},
+		}},
+		{"variables", failingVariablesStore{s}, map[string][]result{
+			"host1": noOperations,
+			"host2": {
+				{"op1", ops.StatusError, "could not get variables: connection refused"},
+				{"op2", ops.StatusError, "could not get variables: connection refused"},
+			},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := Master{Store: tc.store}
+			if err := m.AddWorker(addr); err != nil {
+				t.Fatalf("Error adding worker: %v", err)
+			}
+			run, err := m.Run(context.Background(), RunSpec{})
+			if err != nil {
+				t.Fatalf("Error executing run: %v", err)
+			}
+
+			for hostname, want := range tc.want {
+				results, err := m.GetResults(run.ID, hostname)
+				if err != nil {
+					t.Fatalf("Error getting results: %v", err)
+				}
+				var got []result
+				for _, r := range results {
+					got = append(got, result{r.Operation.Description, r.Status, r.Error})
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("Wrong results for %s: got %v want %v", hostname, got, want)
+				}
+			}
+		})
+	}
+}
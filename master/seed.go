@@ -0,0 +1,472 @@
+package master
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// An InventoryWriter allows adding hosts and operations to the inventory. Stores which don't have
+// an external management tool (such as cqlsh) implement it so that they can be seeded.
+type InventoryWriter interface {
+	AddHost(h ops.Host) error
+	AddOperation(hostname string, o ops.Operation) error
+	AddGroupOperation(group string, o ops.Operation) error
+	// AddRole adds a role, replacing an existing role with the same name.
+	AddRole(r ops.Role) error
+	// AddHostRole assigns a role to a host after the roles which are already assigned to it.
+	AddHostRole(hostname string, a ops.RoleAssignment) error
+	// SetVariable sets a variable in the given scope, replacing its existing value.
+	SetVariable(scope VariableScope, scopeName, name, value string) error
+}
+
+var insertRe = regexp.MustCompile(`(?is)^insert\s+into\s+(?:\w+\.)?(\w+)\s*\(([^)]*)\)\s*values\s*\((.*)\)$`)
+
+// ImportCQL reads CQL statements from r and adds the hosts, operations, roles and variables
+// inserted by them to w. This allows seeding an embedded DB from the same seed files which are used
+// for ScyllaDB (see db/seed.cql). Only INSERT statements into the inventory tables (hosts, the
+// operations tables, the roles tables and the variables tables) are imported - any other statement
+// (e.g. keyspace and table definitions) is ignored. The number of imported rows is returned.
+//
+// Roles and role assignments are added once all the statements have been read, since the rows
+// which make up a role may appear in any order. Their order is determined by the position column.
+func ImportCQL(w InventoryWriter, r io.Reader) (int, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("error reading CQL: %v", err)
+	}
+
+	stmts, err := splitCQL(string(b))
+	if err != nil {
+		return 0, err
+	}
+
+	roles := make(map[string]*ops.Role)
+	var roleOperations []cqlRoleOperation
+	var hostRoles []cqlHostRole
+
+	n := 0
+	for _, stmt := range stmts {
+		m := insertRe.FindStringSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		table := strings.ToLower(m[1])
+		switch table {
+		case "hosts", "operations", "group_operations", "roles", "role_operations", "host_roles",
+			"global_variables", "group_variables", "host_variables":
+		default:
+			continue
+		}
+
+		var cols []string
+		for _, c := range strings.Split(m[2], ",") {
+			cols = append(cols, strings.ToLower(strings.TrimSpace(c)))
+		}
+		vals, err := parseCQLValues(m[3])
+		if err != nil {
+			return n, fmt.Errorf("error parsing statement %q: %v", stmt, err)
+		}
+		if len(cols) != len(vals) {
+			return n, fmt.Errorf("column count doesn't match value count in statement %q", stmt)
+		}
+		row := make(map[string]interface{})
+		for i, c := range cols {
+			row[c] = vals[i]
+		}
+
+		switch table {
+		case "hosts":
+			labels, _ := row["labels"].(map[string]string)
+			groups, _ := row["groups"].([]string)
+			err = w.AddHost(ops.Host{
+				Hostname:           cqlString(row["hostname"]),
+				User:               cqlString(row["user"]),
+				KeyName:            cqlString(row["key_name"]),
+				PasswordName:       cqlString(row["password_name"]),
+				HostKeyFingerprint: cqlString(row["host_key_fingerprint"]),
+				Labels:             labels,
+				Groups:             groups,
+			})
+		case "operations":
+			var o ops.Operation
+			if o, err = cqlOperation(row); err != nil {
+				return n, err
+			}
+			err = w.AddOperation(cqlString(row["hostname"]), o)
+		case "group_operations":
+			var o ops.Operation
+			if o, err = cqlOperation(row); err != nil {
+				return n, err
+			}
+			err = w.AddGroupOperation(cqlString(row["group_name"]), o)
+		case "roles":
+			name := cqlString(row["name"])
+			attributes, _ := row["attributes"].(map[string]string)
+			if r, ok := roles[name]; ok {
+				r.Attributes = attributes
+			} else {
+				roles[name] = &ops.Role{Name: name, Attributes: attributes}
+			}
+		case "role_operations":
+			ro := cqlRoleOperation{role: cqlString(row["role"])}
+			if ro.position, err = cqlInt(row, "position"); err != nil {
+				return n, err
+			}
+			if ro.operation, err = cqlOperation(row); err != nil {
+				return n, err
+			}
+			roleOperations = append(roleOperations, ro)
+		case "host_roles":
+			attributes, _ := row["attributes"].(map[string]string)
+			hr := cqlHostRole{
+				hostname: cqlString(row["hostname"]),
+				role:     ops.RoleAssignment{Role: cqlString(row["role"]), Attributes: attributes},
+			}
+			if hr.position, err = cqlInt(row, "position"); err != nil {
+				return n, err
+			}
+			hostRoles = append(hostRoles, hr)
+		case "global_variables":
+			err = w.SetVariable(ScopeGlobal, "", cqlString(row["name"]), cqlString(row["value"]))
+		case "group_variables":
+			err = w.SetVariable(ScopeGroup, cqlString(row["group_name"]), cqlString(row["name"]),
+				cqlString(row["value"]))
+		case "host_variables":
+			err = w.SetVariable(ScopeHost, cqlString(row["hostname"]), cqlString(row["name"]),
+				cqlString(row["value"]))
+		}
+		if err != nil {
+			return n, fmt.Errorf("error importing row into %s: %v", table, err)
+		}
+		n++
+	}
+
+	// Add the roles, including roles which only have operations.
+	sort.SliceStable(roleOperations, func(i, j int) bool {
+		return roleOperations[i].position < roleOperations[j].position
+	})
+	for _, ro := range roleOperations {
+		r, ok := roles[ro.role]
+		if !ok {
+			r = &ops.Role{Name: ro.role}
+			roles[ro.role] = r
+		}
+		r.Operations = append(r.Operations, ro.operation)
+	}
+	var names []string
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := w.AddRole(*roles[name]); err != nil {
+			return n, fmt.Errorf("error importing role %s: %v", name, err)
+		}
+	}
+
+	sort.SliceStable(hostRoles, func(i, j int) bool {
+		return hostRoles[i].position < hostRoles[j].position
+	})
+	for _, hr := range hostRoles {
+		if err := w.AddHostRole(hr.hostname, hr.role); err != nil {
+			return n, fmt.Errorf("error importing role assignment of %s: %v", hr.hostname, err)
+		}
+	}
+
+	return n, nil
+}
+
+// A row of the role_operations table.
+type cqlRoleOperation struct {
+	role      string
+	position  int
+	operation ops.Operation
+}
+
+// A row of the host_roles table.
+type cqlHostRole struct {
+	hostname string
+	position int
+	role     ops.RoleAssignment
+}
+
+// Converts a row of one of the operations tables to an Operation.
+func cqlOperation(row map[string]interface{}) (ops.Operation, error) {
+	attributes, _ := row["attributes"].(map[string]string)
+	dependsOn, _ := row["depends_on"].([]string)
+	timeout, err := cqlInt(row, "timeout")
+	if err != nil {
+		return ops.Operation{}, err
+	}
+	order, err := cqlInt(row, "execution_order")
+	if err != nil {
+		return ops.Operation{}, err
+	}
+
+	return ops.Operation{
+		Description: cqlString(row["description"]),
+		ScriptName:  cqlString(row["script_name"]),
+		Attributes:  attributes,
+		Timeout:     time.Duration(timeout) * time.Second,
+		Order:       order,
+		DependsOn:   dependsOn,
+	}, nil
+}
+
+// Splits a CQL script into statements, dropping comments. Semicolons and comment markers inside
+// string literals are preserved.
+func splitCQL(s string) ([]string, error) {
+	var stmts []string
+	var cur strings.Builder
+	inString := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inString:
+			cur.WriteByte(c)
+			if c == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					// Escaped quote
+					cur.WriteByte(s[i+1])
+					i++
+				} else {
+					inString = false
+				}
+			}
+		case c == '\'':
+			inString = true
+			cur.WriteByte(c)
+		case c == '-' && i+1 < len(s) && s[i+1] == '-', c == '/' && i+1 < len(s) && s[i+1] == '/':
+			// Skip until end of line
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == ';':
+			if stmt := strings.TrimSpace(cur.String()); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			cur.Reset()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if inString {
+		return nil, fmt.Errorf("unterminated string literal")
+	}
+	if stmt := strings.TrimSpace(cur.String()); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+
+	return stmts, nil
+}
+
+// A minimal parser for the CQL literals which appear in seed files.
+type cqlParser struct {
+	s   string
+	pos int
+}
+
+// Parses a comma-separated list of CQL literals. Strings are returned as strings, maps as
+// map[string]string, sets and lists as []string and function calls such as uuid() as nil.
+// Numbers and booleans are returned in their textual form.
+func parseCQLValues(s string) ([]interface{}, error) {
+	p := &cqlParser{s: s}
+	var vals []interface{}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+
+		p.skipSpace()
+		if p.pos == len(p.s) {
+			return vals, nil
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *cqlParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *cqlParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.s) || p.s[p.pos] != c {
+		return fmt.Errorf("expected %q at offset %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *cqlParser) value() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("unexpected end of input")
+	}
+
+	switch p.s[p.pos] {
+	case '\'':
+		return p.str()
+	case '{':
+		return p.collection()
+	case '[':
+		return p.list()
+	}
+
+	// Unquoted token: a number, a boolean, null or a function call such as uuid().
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(",)}]: \t\r\n", p.s[p.pos]) == -1 {
+		if p.s[p.pos] == '(' {
+			end := strings.IndexByte(p.s[p.pos:], ')')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated function call at offset %d", start)
+			}
+			p.pos += end + 1
+			return nil, nil
+		}
+		p.pos++
+	}
+	tok := p.s[start:p.pos]
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos], p.pos)
+	}
+	if strings.EqualFold(tok, "null") {
+		return nil, nil
+	}
+
+	return tok, nil
+}
+
+func (p *cqlParser) str() (string, error) {
+	var b strings.Builder
+	p.pos++ // Opening quote
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		if c != '\'' {
+			b.WriteByte(c)
+			continue
+		}
+		if p.pos < len(p.s) && p.s[p.pos] == '\'' {
+			b.WriteByte('\'')
+			p.pos++
+			continue
+		}
+		return b.String(), nil
+	}
+
+	return "", fmt.Errorf("unterminated string literal")
+}
+
+// Parses a map ({k: v, ...}) or a set ({v, ...}).
+func (p *cqlParser) collection() (interface{}, error) {
+	p.pos++ // Opening brace
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return map[string]string{}, nil
+	}
+
+	var m map[string]string
+	var set []string
+	for {
+		k, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ':' {
+			if set != nil {
+				return nil, fmt.Errorf("mixed map and set literal at offset %d", p.pos)
+			}
+			p.pos++
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[cqlString(k)] = cqlString(v)
+		} else {
+			if m != nil {
+				return nil, fmt.Errorf("mixed map and set literal at offset %d", p.pos)
+			}
+			set = append(set, cqlString(k))
+		}
+
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == '}' {
+			p.pos++
+			break
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+
+	if m != nil {
+		return m, nil
+	}
+	return set, nil
+}
+
+func (p *cqlParser) list() (interface{}, error) {
+	p.pos++ // Opening bracket
+	var l []string
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == ']' {
+		p.pos++
+		return l, nil
+	}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, cqlString(v))
+
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ']' {
+			p.pos++
+			return l, nil
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Returns the integer value of the given column of a row, or 0 if the column isn't set.
+func cqlInt(row map[string]interface{}, column string) (int, error) {
+	s := cqlString(row[column])
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", column, s, err)
+	}
+	return i, nil
+}
+
+// Returns the string form of a parsed CQL value, or an empty string for non-scalar values.
+func cqlString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,167 @@
+package master
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestImportCQL(t *testing.T) {
+	f, err := os.Open("../db/seed.cql")
+	if err != nil {
+		t.Fatalf("Error opening seed file: %v", err)
+	}
+	defer f.Close()
+
+	s := NewMemoryStore()
+	n, err := ImportCQL(s, f)
+	if err != nil {
+		t.Fatalf("Error importing seed: %v", err)
+	}
+	if n != 16 {
+		t.Fatalf("Wrong number of rows imported: got %d want %d", n, 16)
+	}
+
+	hosts, _ := s.GetHosts()
+	if len(hosts) != 5 {
+		t.Fatalf("Wrong number of hosts: got %d want %d", len(hosts), 5)
+	}
+	want := ops.Host{
+		Hostname:     "host1",
+		User:         "root",
+		PasswordName: "host_password",
+		Labels:       map[string]string{"env": "prod", "role": "web"},
+		Groups:       []string{"webservers"},
+	}
+	if !reflect.DeepEqual(hosts[0], want) {
+		t.Fatalf("Wrong host: got %v want %v", hosts[0], want)
+	}
+
+	m := Master{Store: s}
+	operations, _ := m.GetHostOperations(hosts[4])
+	if len(operations) != 5 {
+		t.Fatalf("Wrong number of operations: got %d want %d", len(operations), 5)
+	}
+	wantOp := ops.Operation{
+		Description: "verify_test_file_contains_1.1.1.1",
+		ScriptName:  "file_contains",
+		Attributes:  map[string]string{"path": "/etc/hosts", "text": "1.1.1.1 cloudflare-dns"},
+	}
+	// The operations of the base role come before the host's own operations.
+	if !reflect.DeepEqual(operations[1], wantOp) {
+		t.Fatalf("Wrong operation: got %v want %v", operations[1], wantOp)
+	}
+	wantOp = ops.Operation{
+		Description: "this_operation_should_be_skipped",
+		ScriptName:  "file_exists",
+		Attributes:  map[string]string{"path": "/etc/hosts"},
+		Order:       1,
+		DependsOn:   []string{"this_operation_should_fail"},
+	}
+	if !reflect.DeepEqual(operations[4], wantOp) {
+		t.Fatalf("Wrong operation: got %v want %v", operations[4], wantOp)
+	}
+}
+
+func TestImportCQLRoles(t *testing.T) {
+	// Rows are ordered by position rather than by the order of the statements.
+	cql := `
+		insert into host_roles (hostname, position, role, attributes) values ('h1', 1, 'web', {'port': '8080'});
+		insert into host_roles (hostname, position, role) values ('h1', 0, 'base');
+		insert into role_operations (role, position, description, script_name) values ('web', 1, 'second', 'file_exists');
+		insert into role_operations (role, position, description, script_name) values ('web', 0, 'first', 'file_exists');
+		insert into roles (name, attributes) values ('web', {'port': '80'});
+		insert into roles (name) values ('base');`
+
+	s := NewMemoryStore()
+	n, err := ImportCQL(s, strings.NewReader(cql))
+	if err != nil {
+		t.Fatalf("Error importing CQL: %v", err)
+	}
+	if n != 6 {
+		t.Fatalf("Wrong number of rows imported: got %d want %d", n, 6)
+	}
+
+	assignments, _ := s.GetHostRoles("h1")
+	want := []ops.RoleAssignment{
+		{Role: "base"},
+		{Role: "web", Attributes: map[string]string{"port": "8080"}},
+	}
+	if !reflect.DeepEqual(assignments, want) {
+		t.Fatalf("Wrong role assignments: got %v want %v", assignments, want)
+	}
+
+	r, err := s.GetRole("web")
+	if err != nil {
+		t.Fatalf("Error getting role: %v", err)
+	}
+	if r.Attributes["port"] != "80" || len(r.Operations) != 2 ||
+		r.Operations[0].Description != "first" || r.Operations[1].Description != "second" {
+		t.Fatalf("Wrong role: got %+v", r)
+	}
+	if _, err := s.GetRole("base"); err != nil {
+		t.Fatalf("Error getting role: %v", err)
+	}
+}
+
+func TestImportCQLVariables(t *testing.T) {
+	cql := `
+		insert into global_variables (name, value) values ('ntp_server', 'pool.ntp.org');
+		insert into group_variables (group_name, name, value) values ('web', 'port', '8080');
+		insert into host_variables (hostname, name, value) values ('h1', 'ntp_server', 'ntp.h1');`
+
+	s := NewMemoryStore()
+	n, err := ImportCQL(s, strings.NewReader(cql))
+	if err != nil {
+		t.Fatalf("Error importing CQL: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Wrong number of rows imported: got %d want %d", n, 3)
+	}
+
+	for _, tc := range []struct {
+		scope VariableScope
+		name  string
+		want  map[string]string
+	}{
+		{ScopeGlobal, "", map[string]string{"ntp_server": "pool.ntp.org"}},
+		{ScopeGroup, "web", map[string]string{"port": "8080"}},
+		{ScopeHost, "h1", map[string]string{"ntp_server": "ntp.h1"}},
+	} {
+		vars, _ := s.GetVariables(tc.scope, tc.name)
+		if !reflect.DeepEqual(vars, tc.want) {
+			t.Fatalf("Wrong %s variables: got %v want %v", tc.scope, vars, tc.want)
+		}
+	}
+}
+
+func TestImportCQLLiterals(t *testing.T) {
+	cql := `-- A comment; with a semicolon
+		INSERT INTO operations (id, hostname, description, script_name, attributes, timeout)
+		VALUES (uuid(), 'h1', 'it''s -- not a comment', 'file_contains', {'text': 'a;b', 'path': '/tmp/x'}, 30);
+		create table ignored(id int, primary key(id));`
+
+	s := NewMemoryStore()
+	n, err := ImportCQL(s, strings.NewReader(cql))
+	if err != nil {
+		t.Fatalf("Error importing CQL: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Wrong number of rows imported: got %d want %d", n, 1)
+	}
+
+	operations, _ := s.GetOperations("h1")
+	want := ops.Operation{
+		Description: "it's -- not a comment",
+		ScriptName:  "file_contains",
+		Attributes:  map[string]string{"text": "a;b", "path": "/tmp/x"},
+		Timeout:     30 * time.Second,
+	}
+	if len(operations) != 1 || !reflect.DeepEqual(operations[0], want) {
+		t.Fatalf("Wrong operations: got %v want %v", operations, []ops.Operation{want})
+	}
+}
@@ -0,0 +1,159 @@
+package master
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worker selection policies which can be passed to NewWorkerSelector.
+const (
+	SelectRoundRobin       = "round-robin"
+	SelectLeastOutstanding = "least-outstanding"
+	SelectRandom           = "random"
+	SelectConsistentHash   = "consistent-hash"
+)
+
+// A WorkerSelector decides which worker executes the operations of a host.
+//
+// Select is called with the master's lock held, so implementations don't need to synchronize
+// access to their own state. workers is never empty.
+type WorkerSelector interface {
+	// Select returns the index in workers of the worker which should execute the operations of
+	// the given host.
+	Select(workers []*WorkerConn, hostname string) int
+}
+
+// NewWorkerSelector returns a WorkerSelector which implements the given policy.
+func NewWorkerSelector(policy string) (WorkerSelector, error) {
+	switch policy {
+	case SelectRoundRobin:
+		return &RoundRobinSelector{}, nil
+	case SelectLeastOutstanding:
+		return LeastOutstandingSelector{}, nil
+	case SelectRandom:
+		return NewRandomSelector(), nil
+	case SelectConsistentHash:
+		return &ConsistentHashSelector{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown worker selection policy %q", policy)
+}
+
+// RoundRobinSelector selects workers in turn.
+type RoundRobinSelector struct {
+	last int
+}
+
+// Select implements WorkerSelector.
+func (s *RoundRobinSelector) Select(workers []*WorkerConn, hostname string) int {
+	// Workers may have been removed since the last selection, in which case last may be past the
+	// end of the slice.
+	if s.last >= len(workers)-1 {
+		// Last used worker is the last one in the slice - start over from index 0
+		s.last = 0
+		return 0
+	}
+
+	s.last++
+	return s.last
+}
+
+// LeastOutstandingSelector selects the worker with the fewest hosts currently being processed.
+// Ties are broken in favor of the worker which comes first.
+type LeastOutstandingSelector struct{}
+
+// Select implements WorkerSelector.
+func (LeastOutstandingSelector) Select(workers []*WorkerConn, hostname string) int {
+	selected := 0
+	for i, w := range workers {
+		if w.Outstanding < workers[selected].Outstanding {
+			selected = i
+		}
+	}
+
+	return selected
+}
+
+// RandomSelector selects a worker at random.
+type RandomSelector struct {
+	rand *rand.Rand
+}
+
+// NewRandomSelector returns a *RandomSelector seeded with the current time.
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Select implements WorkerSelector.
+func (s *RandomSelector) Select(workers []*WorkerConn, hostname string) int {
+	return s.rand.Intn(len(workers))
+}
+
+// The number of points each worker occupies on the hash ring. More points spread the hosts more
+// evenly across the workers.
+const hashRingReplicas = 100
+
+// ConsistentHashSelector maps every host to a worker using consistent hashing of the hostname
+// over the workers' addresses. As long as the set of workers doesn't change, a host is always
+// executed by the same worker, which keeps worker-side state such as SSH connections and caches
+// warm. When a worker is added or removed, only about 1/n of the hosts move to a different worker.
+type ConsistentHashSelector struct {
+	// The addresses the ring was built for, used to detect changes in the set of workers.
+	key  string
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
+// Select implements WorkerSelector.
+func (s *ConsistentHashSelector) Select(workers []*WorkerConn, hostname string) int {
+	addrs := make([]string, len(workers))
+	for i, w := range workers {
+		addrs[i] = w.Addr
+	}
+	if key := strings.Join(addrs, ","); key != s.key {
+		s.build(addrs)
+		s.key = key
+	}
+
+	// Find the first point on the ring at or after the host's hash, wrapping around.
+	h := hash(hostname)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+
+	for j, addr := range addrs {
+		if addr == s.ring[i].addr {
+			return j
+		}
+	}
+
+	// Not reached since the ring is built from addrs.
+	return 0
+}
+
+// Builds the hash ring for the given worker addresses.
+func (s *ConsistentHashSelector) build(addrs []string) {
+	s.ring = make([]ringPoint, 0, len(addrs)*hashRingReplicas)
+	for _, addr := range addrs {
+		for i := 0; i < hashRingReplicas; i++ {
+			s.ring = append(s.ring, ringPoint{hash: hash(addr + "#" + strconv.Itoa(i)), addr: addr})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
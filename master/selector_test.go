@@ -0,0 +1,98 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testWorkers(n int) []*WorkerConn {
+	var workers []*WorkerConn
+	for i := 0; i < n; i++ {
+		workers = append(workers, &WorkerConn{Addr: fmt.Sprintf("worker%d:8888", i)})
+	}
+	return workers
+}
+
+func TestNewWorkerSelector(t *testing.T) {
+	for _, p := range []string{SelectRoundRobin, SelectLeastOutstanding, SelectRandom,
+		SelectConsistentHash} {
+		s, err := NewWorkerSelector(p)
+		if err != nil {
+			t.Fatalf("Error creating %s selector: %v", p, err)
+		}
+		if i := s.Select(testWorkers(3), "host1"); i < 0 || i >= 3 {
+			t.Fatalf("%s selector returned an invalid index: %d", p, i)
+		}
+	}
+
+	if _, err := NewWorkerSelector("nope"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy")
+	}
+}
+
+func TestLeastOutstandingSelector(t *testing.T) {
+	workers := testWorkers(3)
+	workers[0].Outstanding = 2
+	workers[1].Outstanding = 1
+	workers[2].Outstanding = 1
+
+	if got := (LeastOutstandingSelector{}).Select(workers, "host1"); got != 1 {
+		t.Fatalf("Wrong worker selected: got %d want 1", got)
+	}
+}
+
+func TestLeastOutstandingThroughMaster(t *testing.T) {
+	m := Master{Workers: testWorkers(2), Selector: LeastOutstandingSelector{}}
+
+	// Hosts are spread across the workers while they are busy.
+	a, _ := m.SelectWorker("host1")
+	b, _ := m.SelectWorker("host2")
+	if a == b {
+		t.Fatalf("Both hosts were assigned to %s", a.Addr)
+	}
+
+	// Once released, the first worker is preferred again.
+	m.ReleaseWorker(a)
+	m.ReleaseWorker(b)
+	c, _ := m.SelectWorker("host3")
+	if c != m.Workers[0] || c.Outstanding != 1 {
+		t.Fatalf("Wrong worker selected: got %+v want %+v", c, m.Workers[0])
+	}
+}
+
+func TestConsistentHashSelector(t *testing.T) {
+	s := &ConsistentHashSelector{}
+	workers := testWorkers(5)
+
+	var hosts []string
+	for i := 0; i < 100; i++ {
+		hosts = append(hosts, fmt.Sprintf("host%d", i))
+	}
+
+	assigned := make(map[string]string)
+	used := make(map[string]bool)
+	for _, h := range hosts {
+		assigned[h] = workers[s.Select(workers, h)].Addr
+		used[assigned[h]] = true
+	}
+	if len(used) != len(workers) {
+		t.Fatalf("Hosts were assigned to %d workers, want %d", len(used), len(workers))
+	}
+
+	// The same host is always assigned to the same worker.
+	for _, h := range hosts {
+		if got := workers[s.Select(workers, h)].Addr; got != assigned[h] {
+			t.Fatalf("%s moved from %s to %s", h, assigned[h], got)
+		}
+	}
+
+	// Removing a worker only moves the hosts which were assigned to it.
+	removed := workers[2].Addr
+	remaining := append(append([]*WorkerConn{}, workers[:2]...), workers[3:]...)
+	for _, h := range hosts {
+		got := remaining[s.Select(remaining, h)].Addr
+		if assigned[h] != removed && got != assigned[h] {
+			t.Fatalf("%s moved from %s to %s although its worker wasn't removed", h, assigned[h], got)
+		}
+	}
+}
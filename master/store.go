@@ -0,0 +1,175 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// A Store persists the inventory as well as the runs and their results. The Master performs all
+// of its DB access through a Store, which allows replacing the DB backend and running the Master
+// without a live DB.
+type Store interface {
+	// GetHosts returns all the hosts in the inventory.
+	GetHosts() ([]ops.Host, error)
+	// GetOperations returns all the operations for the given host, excluding the operations of
+	// the groups it belongs to.
+	GetOperations(hostname string) ([]ops.Operation, error)
+	// GetGroupOperations returns all the operations for the hosts in the given group.
+	GetGroupOperations(group string) ([]ops.Operation, error)
+	// GetHostRoles returns the roles which are assigned to the given host, in the order they
+	// were assigned.
+	GetHostRoles(hostname string) ([]ops.RoleAssignment, error)
+	// GetRole returns the role with the given name or ErrRoleNotFound if there is no such role.
+	GetRole(name string) (ops.Role, error)
+	// GetVariables returns the variables which are defined in the given scope. scopeName is the
+	// name of the group or the hostname for ScopeGroup and ScopeHost and is ignored for
+	// ScopeGlobal.
+	GetVariables(scope VariableScope, scopeName string) (map[string]string, error)
+	// SetHostKeyFingerprint pins the SSH host key fingerprint of the given host, which is then
+	// used for verifying the host's key instead of the workers' known_hosts files.
+	SetHostKeyFingerprint(hostname, fingerprint string) error
+	// StoreRun stores a new run.
+	StoreRun(r Run) error
+	// FinishRun updates a stored run once it has completed.
+	FinishRun(r Run) error
+	// StoreResults stores the results of the operations which were executed on a host as part of
+	// a run.
+	StoreResults(runID gocql.UUID, hostname string, results []ops.OperationResult) error
+	// GetRun returns the run with the given ID or ErrRunNotFound if there is no such run.
+	GetRun(id gocql.UUID) (Run, error)
+	// GetRuns returns up to limit runs, most recent first. A limit of 0 means no limit.
+	GetRuns(limit int) ([]Run, error)
+	// GetResults returns the results of a run. If hostname isn't empty, only the results for
+	// that host are returned. Results are sorted by hostname and then by start time.
+	GetResults(runID gocql.UUID, hostname string) ([]Result, error)
+	// StoreOutput stores a chunk of the output of an operation which is executing as part of a
+	// run.
+	StoreOutput(o Output) error
+	// GetOutput returns the output which was stored for a host in a run, oldest first.
+	GetOutput(runID gocql.UUID, hostname string) ([]Output, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// ErrRunNotFound is returned when a requested run doesn't exist.
+var ErrRunNotFound = errors.New("run not found")
+
+// ErrRoleNotFound is returned when a requested role doesn't exist.
+var ErrRoleNotFound = errors.New("role not found")
+
+// A VariableScope is the scope in which a variable is defined. The variables of a host are the
+// global variables, overridden by the variables of the host's groups, overridden by the host's own
+// variables.
+type VariableScope string
+
+// Variable scopes, from the lowest precedence to the highest.
+const (
+	ScopeGlobal VariableScope = "global"
+	ScopeGroup  VariableScope = "group"
+	ScopeHost   VariableScope = "host"
+)
+
+// A Run is a single execution of operations against the hosts in the inventory. EndTime is zero
+// while the run is in progress.
+type Run struct {
+	ID         gocql.UUID
+	CreateTime time.Time
+	EndTime    time.Time
+	// Check is true for runs which were executed in check mode.
+	Check bool
+	// Counts is the number of operation results of each status, which is set once the run has
+	// completed.
+	Counts map[ops.Status]int
+}
+
+// FormatCounts formats the number of results of each status, e.g. "2 changed, 1 failed, 3 ok".
+func FormatCounts(counts map[ops.Status]int) string {
+	var statuses []string
+	for s := range counts {
+		statuses = append(statuses, string(s))
+	}
+	sort.Strings(statuses)
+
+	var parts []string
+	for _, s := range statuses {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[ops.Status(s)], s))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// A Result is an operation result which was stored as part of a run.
+type Result struct {
+	ops.OperationResult
+	RunID     gocql.UUID
+	Hostname  string
+	Timestamp time.Time
+}
+
+// An Output is a chunk of an operation's output which was stored while the operation was
+// executing. Stream is either "stdout" or "stderr".
+type Output struct {
+	RunID       gocql.UUID
+	Hostname    string
+	Description string
+	Stream      string
+	Data        string
+	Timestamp   time.Time
+}
+
+// Sorts runs from the most recent to the oldest and returns up to limit of them.
+func sortRuns(runs []Run, limit int) []Run {
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreateTime.After(runs[j].CreateTime) })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs
+}
+
+// Sorts results by hostname and then by start time.
+func sortResults(results []Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Hostname != results[j].Hostname {
+			return results[i].Hostname < results[j].Hostname
+		}
+		return results[i].StartTime.Before(results[j].StartTime)
+	})
+}
+
+// Supported DB drivers.
+const (
+	DriverCassandra = "cassandra"
+	DriverBolt      = "bolt"
+	DriverMemory    = "memory"
+)
+
+// StoreConfig specifies which Store to open and how to connect to it.
+type StoreConfig struct {
+	// Driver is one of DriverCassandra, DriverBolt or DriverMemory.
+	Driver string
+	// Hosts is a list of DB nodes to connect to. Used by DriverCassandra.
+	Hosts []string
+	// Keyspace is the keyspace to use. Used by DriverCassandra.
+	Keyspace string
+	// Path is the path of the DB file. Used by DriverBolt.
+	Path string
+}
+
+// OpenStore opens the Store specified by the given config.
+func OpenStore(c StoreConfig) (Store, error) {
+	switch c.Driver {
+	case DriverCassandra:
+		return NewCassandraStore(c.Hosts, c.Keyspace)
+	case DriverBolt:
+		return NewBoltStore(c.Path)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	}
+
+	return nil, fmt.Errorf("unknown DB driver %q", c.Driver)
+}
@@ -0,0 +1,144 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+// A Target selects the hosts in the inventory which a run executes on. A host is selected if it
+// matches all of the target's criteria. The zero Target selects every host.
+type Target struct {
+	// Hostnames limits the run to the hosts with the given hostnames. Each of them must exist in
+	// the inventory.
+	Hostnames []string
+	// Labels limits the run to the hosts which have all of the given labels.
+	Labels map[string]string
+	// Groups limits the run to the hosts which belong to all of the given groups.
+	Groups []string
+}
+
+// ParseLimit parses a comma-separated list of labels and groups, e.g. "env=prod,role=web,dbs",
+// into a Target. A key=value term requires hosts to have the label key with the value value and
+// any other term requires hosts to belong to the group with that name.
+func ParseLimit(limit string) (Target, error) {
+	var t Target
+	if strings.TrimSpace(limit) == "" {
+		return t, nil
+	}
+
+	for _, term := range strings.Split(limit, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return Target{}, fmt.Errorf("invalid limit %q: empty term", limit)
+		}
+
+		i := strings.Index(term, "=")
+		if i == -1 {
+			t.Groups = append(t.Groups, term)
+			continue
+		}
+		key, value := strings.TrimSpace(term[:i]), strings.TrimSpace(term[i+1:])
+		if key == "" {
+			return Target{}, fmt.Errorf("invalid limit %q: label without a key in %q", limit, term)
+		}
+		if t.Labels == nil {
+			t.Labels = make(map[string]string)
+		}
+		if v, ok := t.Labels[key]; ok && v != value {
+			return Target{}, fmt.Errorf("invalid limit %q: conflicting values for label %q",
+				limit, key)
+		}
+		t.Labels[key] = value
+	}
+
+	return t, nil
+}
+
+// IsZero returns true if t selects every host.
+func (t Target) IsZero() bool {
+	return len(t.Hostnames) == 0 && len(t.Labels) == 0 && len(t.Groups) == 0
+}
+
+// Matches returns true if t selects h.
+func (t Target) Matches(h ops.Host) bool {
+	if len(t.Hostnames) > 0 && !contains(t.Hostnames, h.Hostname) {
+		return false
+	}
+	for k, v := range t.Labels {
+		if hv, ok := h.Labels[k]; !ok || hv != v {
+			return false
+		}
+	}
+	for _, g := range t.Groups {
+		if !contains(h.Groups, g) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Select returns the hosts which t selects, in the order they appear in hosts. An error is
+// returned if any of t's hostnames isn't in hosts.
+func (t Target) Select(hosts []ops.Host) ([]ops.Host, error) {
+	known := make(map[string]bool)
+	for _, h := range hosts {
+		known[h.Hostname] = true
+	}
+	var unknown []string
+	for _, h := range t.Hostnames {
+		if !known[h] {
+			unknown = append(unknown, h)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+	}
+
+	var selected []ops.Host
+	for _, h := range hosts {
+		if t.Matches(h) {
+			selected = append(selected, h)
+		}
+	}
+
+	return selected, nil
+}
+
+// String formats t for logging, e.g. "hosts host1,host2 and env=prod,web".
+func (t Target) String() string {
+	if t.IsZero() {
+		return "all hosts"
+	}
+
+	var terms []string
+	var keys []string
+	for k := range t.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		terms = append(terms, k+"="+t.Labels[k])
+	}
+	terms = append(terms, t.Groups...)
+
+	switch {
+	case len(t.Hostnames) == 0:
+		return strings.Join(terms, ",")
+	case len(terms) == 0:
+		return "hosts " + strings.Join(t.Hostnames, ",")
+	}
+	return "hosts " + strings.Join(t.Hostnames, ",") + " and " + strings.Join(terms, ",")
+}
+
+func contains(l []string, s string) bool {
+	for _, i := range l {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+
+	ops "github.com/johananl/simple-cm/operations"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		limit string
+		want  Target
+		err   bool
+	}{
+		{limit: "", want: Target{}},
+		{limit: "web", want: Target{Groups: []string{"web"}}},
+		{
+			limit: "env=prod, role=web,dbs",
+			want: Target{
+				Labels: map[string]string{"env": "prod", "role": "web"},
+				Groups: []string{"dbs"},
+			},
+		},
+		{limit: "env=", want: Target{Labels: map[string]string{"env": ""}}},
+		{limit: "env=prod,", err: true},
+		{limit: "=prod", err: true},
+		{limit: "env=prod,env=staging", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseLimit(test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected an error for %q, got %+v", test.limit, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.limit, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Wrong target for %q: got %+v want %+v", test.limit, got, test.want)
+		}
+	}
+}
+
+func TestTargetSelect(t *testing.T) {
+	hosts := []ops.Host{
+		{Hostname: "host1", Labels: map[string]string{"env": "prod"}, Groups: []string{"web"}},
+		{Hostname: "host2", Labels: map[string]string{"env": "staging"}, Groups: []string{"web"}},
+		{Hostname: "host3", Labels: map[string]string{"env": "prod"}, Groups: []string{"db"}},
+		{Hostname: "host4"},
+	}
+
+	tests := []struct {
+		target Target
+		want   []string
+	}{
+		{target: Target{}, want: []string{"host1", "host2", "host3", "host4"}},
+		{
+			target: Target{Labels: map[string]string{"env": "prod"}},
+			want:   []string{"host1", "host3"},
+		},
+		{target: Target{Groups: []string{"web"}}, want: []string{"host1", "host2"}},
+		{
+			target: Target{Labels: map[string]string{"env": "prod"}, Groups: []string{"web"}},
+			want:   []string{"host1"},
+		},
+		{target: Target{Hostnames: []string{"host4", "host2"}}, want: []string{"host2", "host4"}},
+		{
+			target: Target{Hostnames: []string{"host1", "host2"}, Groups: []string{"db"}},
+			want:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		selected, err := test.target.Select(hosts)
+		if err != nil {
+			t.Errorf("Error selecting hosts by %s: %v", test.target, err)
+			continue
+		}
+		var got []string
+		for _, h := range selected {
+			got = append(got, h.Hostname)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Wrong hosts selected by %s: got %v want %v", test.target, got, test.want)
+		}
+	}
+
+	if _, err := (Target{Hostnames: []string{"host1", "nosuchhost"}}).Select(hosts); err == nil {
+		t.Errorf("Expected an error for an unknown host")
+	}
+}
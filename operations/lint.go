@@ -0,0 +1,175 @@
+package operations
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"text/template/parse"
+)
+
+// Attributes returns the sorted names of the attributes the module references as fields of the
+// template's data, e.g. .path, and which therefore must be set by every operation which uses the
+// module, either as attributes of the operation or as variables of its host. Attributes which are
+// only accessed using the index function, e.g. {{index . "port" | default "80"}}, are optional and
+// aren't returned. Neither are the reserved keys of the ScriptContext.
+func (m *Module) Attributes() []string {
+	refs := make(map[string]bool)
+	for _, t := range m.tmpl.Templates() {
+		if t.Tree != nil {
+			walkReferences(t.Tree.Root, true, refs)
+		}
+	}
+	for _, k := range []string{keyHostname, keyVariables, keyFacts} {
+		delete(refs, k)
+	}
+
+	var attributes []string
+	for k := range refs {
+		attributes = append(attributes, k)
+	}
+	sort.Strings(attributes)
+	return attributes
+}
+
+// Matches text which looks like an action with single braces, e.g. {.seconds}.
+var singleBraceRe = regexp.MustCompile(`(^|[^{])\{\s*\.[A-Za-z_]\w*\s*\}`)
+
+// Lint returns descriptions of likely mistakes in the module which aren't template syntax errors,
+// such as references to attributes which are written with single braces instead of double braces
+// and are therefore rendered literally.
+func (m *Module) Lint() []string {
+	var problems []string
+	for _, t := range m.tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		walkText(t.Tree.Root, func(n *parse.TextNode) {
+			for _, match := range singleBraceRe.FindAllStringSubmatch(string(n.Text), -1) {
+				problems = append(problems, fmt.Sprintf(
+					"%q looks like an action with single braces and is rendered literally",
+					match[0][len(match[1]):]))
+			}
+		})
+	}
+	return problems
+}
+
+// Adds the names of the data fields which are referenced by n to refs. root is true if dot is the
+// template's data in n, i.e. n isn't in the body of a range or a with action.
+func walkReferences(n parse.Node, root bool, refs map[string]bool) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkReferences(c, root, refs)
+		}
+	case *parse.ActionNode:
+		walkReferences(n.Pipe, root, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walkReferences(c, root, refs)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			walkReferences(a, root, refs)
+		}
+	case *parse.ChainNode:
+		walkReferences(n.Node, root, refs)
+	case *parse.FieldNode:
+		if root {
+			refs[n.Ident[0]] = true
+		}
+	case *parse.VariableNode:
+		// $ is the template's data regardless of dot.
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			refs[n.Ident[1]] = true
+		}
+	case *parse.IfNode:
+		walkReferences(n.Pipe, root, refs)
+		walkReferences(n.List, root, refs)
+		walkReferences(n.ElseList, root, refs)
+	case *parse.RangeNode:
+		walkReferences(n.Pipe, root, refs)
+		walkReferences(n.List, false, refs)
+		walkReferences(n.ElseList, root, refs)
+	case *parse.WithNode:
+		walkReferences(n.Pipe, root, refs)
+		walkReferences(n.List, false, refs)
+		walkReferences(n.ElseList, root, refs)
+	case *parse.TemplateNode:
+		walkReferences(n.Pipe, root, refs)
+	}
+}
+
+// Adds the names of the functions which are called in n to funcs.
+func walkFuncs(n parse.Node, funcs map[string]bool) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkFuncs(c, funcs)
+		}
+	case *parse.ActionNode:
+		walkFuncs(n.Pipe, funcs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walkFuncs(c, funcs)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			walkFuncs(a, funcs)
+		}
+	case *parse.ChainNode:
+		walkFuncs(n.Node, funcs)
+	case *parse.IdentifierNode:
+		funcs[n.Ident] = true
+	case *parse.IfNode:
+		walkFuncs(n.Pipe, funcs)
+		walkFuncs(n.List, funcs)
+		walkFuncs(n.ElseList, funcs)
+	case *parse.RangeNode:
+		walkFuncs(n.Pipe, funcs)
+		walkFuncs(n.List, funcs)
+		walkFuncs(n.ElseList, funcs)
+	case *parse.WithNode:
+		walkFuncs(n.Pipe, funcs)
+		walkFuncs(n.List, funcs)
+		walkFuncs(n.ElseList, funcs)
+	case *parse.TemplateNode:
+		walkFuncs(n.Pipe, funcs)
+	}
+}
+
+// Calls f for every text node in n.
+func walkText(n parse.Node, f func(*parse.TextNode)) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkText(c, f)
+		}
+	case *parse.TextNode:
+		f(n)
+	case *parse.IfNode:
+		walkText(n.List, f)
+		walkText(n.ElseList, f)
+	case *parse.RangeNode:
+		walkText(n.List, f)
+		walkText(n.ElseList, f)
+	case *parse.WithNode:
+		walkText(n.List, f)
+		walkText(n.ElseList, f)
+	}
+}
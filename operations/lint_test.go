@@ -0,0 +1,59 @@
+package operations
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestModuleAttributes(t *testing.T) {
+	tmpl := `{{if check}}{{.a}}{{end}} {{.b.c | shellQuote}} {{index . "optional"}} ` +
+		`{{range .list}}{{.elem}} {{$.d}}{{end}} {{with .e}}{{.f}}{{end}} {{.Vars.x}} {{.Hostname}}`
+	ioutil.WriteFile("test.txt", []byte(tmpl), 0644)
+	defer os.Remove("test.txt")
+
+	m, err := LoadModule(".", "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b", "d", "e", "list"}
+	if got := m.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong attributes: got %v want %v", got, want)
+	}
+}
+
+func TestModuleLint(t *testing.T) {
+	ioutil.WriteFile("test.txt", []byte("sleep {.seconds}\n{{if check}}{ .path }{{end}} {{.ok}}"), 0644)
+	defer os.Remove("test.txt")
+
+	m, err := LoadModule(".", "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := m.Lint()
+	if len(problems) != 2 || !strings.Contains(problems[0], "{.seconds}") ||
+		!strings.Contains(problems[1], "{ .path }") {
+		t.Fatalf("wrong problems: got %q", problems)
+	}
+}
+
+func TestBundledModules(t *testing.T) {
+	files, err := ioutil.ReadDir("../modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ManifestExt) {
+			continue
+		}
+		m, err := LoadModule("../modules", f.Name())
+		if err != nil {
+			t.Fatalf("error loading %s: %v", f.Name(), err)
+		}
+		if problems := m.Lint(); len(problems) > 0 {
+			t.Fatalf("problems in %s: %q", f.Name(), problems)
+		}
+	}
+}
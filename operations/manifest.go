@@ -0,0 +1,181 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ManifestExt is the extension of module manifests. The manifest of a module is stored next to the
+// module, e.g. modules/file_exists.json is the manifest of modules/file_exists.
+const ManifestExt = ".json"
+
+// OSLabel is the label of hosts which holds the host's operating system, e.g. "os": "linux".
+const OSLabel = "os"
+
+// A Manifest describes a module and declares the parameters it accepts. Manifests are optional:
+// the attributes of operations which use a module without a manifest aren't validated.
+//
+// OS lists the operating systems the module supports, as matched against the OSLabel of hosts.
+// An empty list means any operating system. Check declares that the module supports check mode,
+// e.g. because it reads CheckEnv or doesn't change anything (see Module.SupportsCheck).
+type Manifest struct {
+	Description string               `json:"description"`
+	OS          []string             `json:"os"`
+	Check       bool                 `json:"check"`
+	Parameters  map[string]Parameter `json:"parameters"`
+}
+
+// A Parameter is an attribute which a module accepts. Type is one of the parameter types and
+// defaults to ParamString. Default is the value of the parameter if it isn't set by the operation
+// or by a variable of the host. A Required parameter without a default must be set.
+type Parameter struct {
+	Type        string      `json:"type"`
+	Default     interface{} `json:"default"`
+	Required    bool        `json:"required"`
+	Description string      `json:"description"`
+}
+
+// Parameter types.
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamBool   = "bool"
+	// ParamList is a JSON array which is typed when rendering (see ParseValue).
+	ParamList = "list"
+	// ParamMap is a JSON object which is typed when rendering (see ParseValue).
+	ParamMap = "map"
+)
+
+// LoadManifest reads the manifest of the module with the given name in moduleDir. It returns nil
+// if the module has no manifest.
+func LoadManifest(moduleDir, name string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(moduleDir, name+ManifestExt))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	return parseManifest(b)
+}
+
+// Parses and validates the content of a manifest.
+func parseManifest(b []byte) (*Manifest, error) {
+	var m Manifest
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %v", err)
+	}
+	for name, p := range m.Parameters {
+		switch p.Type {
+		case "":
+			p.Type = ParamString
+			m.Parameters[name] = p
+		case ParamString, ParamInt, ParamBool, ParamList, ParamMap:
+		default:
+			return nil, fmt.Errorf("invalid manifest: parameter %s has unknown type %q", name,
+				p.Type)
+		}
+		if p.Default == nil {
+			continue
+		}
+		if err := p.check(attributeValue(p.Default)); err != nil {
+			return nil, fmt.Errorf("invalid manifest: default of parameter %s %v", name, err)
+		}
+	}
+
+	return &m, nil
+}
+
+// Apply validates the attributes of o against the manifest and returns o with the defaults of the
+// parameters which are set neither by o's attributes nor by vars filled in. Values from vars are
+// validated as well, since the module is rendered with them. An error which lists every problem is
+// returned if a required parameter isn't set or a value doesn't match its parameter's type.
+func (m *Manifest) Apply(o Operation, vars map[string]string) (Operation, error) {
+	var names []string
+	for name := range m.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attributes := MergeAttributes(o.Attributes)
+	var problems []string
+	for _, name := range names {
+		p := m.Parameters[name]
+		v, ok := attributes[name]
+		if !ok {
+			v, ok = vars[name]
+		}
+		if !ok {
+			switch {
+			case p.Default != nil:
+				attributes[name] = attributeValue(p.Default)
+			case p.Required:
+				problems = append(problems, fmt.Sprintf("missing required parameter %s", name))
+			}
+			continue
+		}
+		if err := p.check(v); err != nil {
+			problems = append(problems, fmt.Sprintf("parameter %s %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return o, fmt.Errorf("invalid attributes: %s", strings.Join(problems, "; "))
+	}
+
+	o.Attributes = attributes
+	return o, nil
+}
+
+// SupportsOS returns true if the module supports the given operating system. Any operating system
+// is supported if the manifest doesn't list any or if hostOS is empty, i.e. unknown.
+func (m *Manifest) SupportsOS(hostOS string) bool {
+	if len(m.OS) == 0 || hostOS == "" {
+		return true
+	}
+	for _, s := range m.OS {
+		if strings.EqualFold(s, hostOS) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that v is a valid value for the parameter.
+func (p Parameter) check(v string) error {
+	ok := true
+	switch p.Type {
+	case ParamInt:
+		_, err := strconv.Atoi(v)
+		ok = err == nil
+	case ParamBool:
+		_, err := strconv.ParseBool(v)
+		ok = err == nil
+	case ParamList:
+		_, ok = ParseValue(v).(List)
+	case ParamMap:
+		_, ok = ParseValue(v).(Map)
+	}
+	if !ok {
+		return fmt.Errorf("must be of type %s, got %q", p.Type, v)
+	}
+	return nil
+}
+
+// Returns the attribute value of a decoded JSON value: strings are used as is and any other value
+// is kept in its JSON encoding.
+func attributeValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
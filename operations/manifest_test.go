@@ -0,0 +1,76 @@
+package operations
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestApply(t *testing.T) {
+	manifest := `{
+		"description": "Test module",
+		"os": ["linux"],
+		"parameters": {
+			"path": {"required": true},
+			"port": {"type": "int", "default": 80},
+			"servers": {"type": "list", "default": ["a", "b"]},
+			"force": {"type": "bool"}
+		}
+	}`
+	ioutil.WriteFile("test.txt.json", []byte(manifest), 0644)
+	defer os.Remove("test.txt.json")
+
+	m, err := LoadManifest(".", "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Parameters["path"].Type != ParamString || !m.SupportsOS("Linux") || m.SupportsOS("windows") {
+		t.Fatalf("wrong manifest: got %+v", m)
+	}
+
+	// Defaults are filled in only for parameters which are set neither by the operation nor by a
+	// variable.
+	o := Operation{Description: "op", ScriptName: "test.txt",
+		Attributes: map[string]string{"path": "/tmp/x"}}
+	got, err := m.Apply(o, map[string]string{"port": "8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"path": "/tmp/x", "servers": `["a","b"]`}
+	if !reflect.DeepEqual(got.Attributes, want) {
+		t.Fatalf("wrong attributes: got %v want %v", got.Attributes, want)
+	}
+	if len(o.Attributes) != 1 {
+		t.Fatalf("operation was modified: got %v", o.Attributes)
+	}
+
+	o.Attributes = map[string]string{"port": "http", "force": "yes", "servers": "a,b"}
+	_, err = m.Apply(o, map[string]string{})
+	for _, s := range []string{"missing required parameter path", "parameter force", "parameter port",
+		"parameter servers"} {
+		if err == nil || !strings.Contains(err.Error(), s) {
+			t.Fatalf("expected error to contain %q, got %v", s, err)
+		}
+	}
+}
+
+func TestLoadManifestInvalid(t *testing.T) {
+	defer os.Remove("test.txt.json")
+
+	if m, err := LoadManifest(".", "test.txt"); m != nil || err != nil {
+		t.Fatalf("expected no manifest, got %v, %v", m, err)
+	}
+	for _, manifest := range []string{
+		`{"parameters": {"a": {"type": "float"}}}`,
+		`{"parameters": {"a": {"type": "int", "default": "x"}}}`,
+		`{"params": {}}`,
+		`not json`,
+	} {
+		ioutil.WriteFile("test.txt.json", []byte(manifest), 0644)
+		if _, err := LoadManifest(".", "test.txt"); err == nil {
+			t.Fatalf("expected an error for manifest %s", manifest)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// A Module is a parsed module template along with its manifest, which is nil if the module has no
+// manifest. Version identifies the content of the module (see ModuleSource.Version).
+type Module struct {
+	Name     string
+	Version  string
+	Manifest *Manifest
+	tmpl     *template.Template
+}
+
+// LoadModule parses the module with the given name in moduleDir and its manifest (see
+// ModuleSource.Parse).
+func LoadModule(moduleDir, name string) (*Module, error) {
+	s, err := ReadModule(moduleDir, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.Parse()
+}
+
+// Script returns the script of o, rendered from the module in the context c with the functions of
+// ScriptContext. A Module may be used for rendering by several goroutines at once.
+func (m *Module) Script(o *Operation, c ScriptContext) (string, error) {
+	// Functions are bound to the context, so they are set on a copy of the shared template.
+	tmpl, err := m.tmpl.Clone()
+	if err != nil {
+		return "", fmt.Errorf("error copying script template: %v", err)
+	}
+
+	b := bytes.Buffer{}
+	if err := tmpl.Funcs(c.funcs()).Execute(&b, c.data(o, m.Manifest)); err != nil {
+		return "", fmt.Errorf("error templating script: %v", err)
+	}
+	return b.String(), nil
+}
+
+// SupportsCheck returns whether the module may be executed in check mode, in which it must not
+// change anything. This is the case if its manifest declares it or if its template calls the check
+// function. Operations whose module doesn't support check mode aren't executed in check mode.
+func (m *Module) SupportsCheck() bool {
+	if m.Manifest != nil && m.Manifest.Check {
+		return true
+	}
+	funcs := make(map[string]bool)
+	for _, t := range m.tmpl.Templates() {
+		if t.Tree != nil {
+			walkFuncs(t.Tree.Root, funcs)
+		}
+	}
+	return funcs["check"]
+}
+
+// ModuleResult is the result a module may report by printing it as a JSON object on the last line
+// of its stdout, e.g.:
+//
+//	{"changed": true, "facts": {"version": "1.2.3"}, "msg": "Upgraded package"}
+//
+// Changed reports a change as an alternative to exiting with ChangedExitCode. Facts are values
+// which the module discovered on the host. Values which aren't JSON strings are kept in their JSON
+// encoding. Msg is a human-readable summary of what the module did.
+type ModuleResult struct {
+	Changed bool
+	Facts   map[string]string
+	Msg     string
+}
+
+// ParseModuleResult extracts the ModuleResult from the stdout of a module. It returns the result,
+// stdout without the result's line and true if the last non-empty line of stdout is a JSON object
+// which contains only the fields of a ModuleResult. Otherwise, stdout is returned unchanged along
+// with false.
+func ParseModuleResult(stdout string) (ModuleResult, string, bool) {
+	trimmed := strings.TrimRight(stdout, "\n")
+	i := strings.LastIndex(trimmed, "\n")
+	line := strings.TrimSpace(trimmed[i+1:])
+	if !strings.HasPrefix(line, "{") {
+		return ModuleResult{}, stdout, false
+	}
+
+	var raw struct {
+		Changed bool                       `json:"changed"`
+		Facts   map[string]json.RawMessage `json:"facts"`
+		Msg     string                     `json:"msg"`
+	}
+	d := json.NewDecoder(strings.NewReader(line))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&raw); err != nil || d.More() {
+		return ModuleResult{}, stdout, false
+	}
+
+	r := ModuleResult{Changed: raw.Changed, Msg: raw.Msg}
+	if len(raw.Facts) > 0 {
+		r.Facts = make(map[string]string)
+	}
+	for k, v := range raw.Facts {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			r.Facts[k] = s
+			continue
+		}
+		var b bytes.Buffer
+		json.Compact(&b, v)
+		r.Facts[k] = b.String()
+	}
+
+	return r, trimmed[:i+1], true
+}
@@ -0,0 +1,88 @@
+package operations
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseModuleResult(t *testing.T) {
+	tests := []struct {
+		stdout     string
+		want       ModuleResult
+		wantStdout string
+		wantOK     bool
+	}{
+		{
+			stdout: "installing\n" +
+				`{"changed": true, "facts": {"version": "1.2.3", "ports": [80, 443]}, "msg": "done"}` +
+				"\n",
+			want: ModuleResult{
+				Changed: true,
+				Facts:   map[string]string{"version": "1.2.3", "ports": "[80,443]"},
+				Msg:     "done",
+			},
+			wantStdout: "installing\n",
+			wantOK:     true,
+		},
+		{
+			stdout:     `{"msg": "nothing to do"}`,
+			want:       ModuleResult{Msg: "nothing to do"},
+			wantStdout: "",
+			wantOK:     true,
+		},
+		// Output which isn't a module result is left alone.
+		{stdout: "hello\n", wantStdout: "hello\n"},
+		{stdout: `{"name": "config"}` + "\n", wantStdout: `{"name": "config"}` + "\n"},
+		{stdout: `{"changed": true} trailing`, wantStdout: `{"changed": true} trailing`},
+		{stdout: "{\n  \"changed\": true\n}\n", wantStdout: "{\n  \"changed\": true\n}\n"},
+	}
+
+	for _, test := range tests {
+		r, stdout, ok := ParseModuleResult(test.stdout)
+		if ok != test.wantOK || stdout != test.wantStdout || !reflect.DeepEqual(r, test.want) {
+			t.Errorf("Wrong result for %q: got %+v, %q, %v want %+v, %q, %v", test.stdout, r,
+				stdout, ok, test.want, test.wantStdout, test.wantOK)
+		}
+	}
+}
+
+func TestSupportsCheck(t *testing.T) {
+	for _, tc := range []struct {
+		script   string
+		manifest string
+		want     bool
+	}{
+		{"touch /tmp/x", "", false},
+		{"touch /tmp/x", `{"check": false}`, false},
+		{"[ -n \"$SIMPLECM_CHECK\" ] || touch /tmp/x", `{"check": true}`, true},
+		{"{{if not check}}touch /tmp/x{{end}}", "", true},
+		{`{{define "t"}}{{if check}}exit 80{{end}}{{end}}{{template "t"}}`, "", true},
+		// A field named check isn't the check function.
+		{"echo {{.check}}", "", false},
+	} {
+		s := ModuleSource{Name: "test", Script: []byte(tc.script)}
+		if tc.manifest != "" {
+			s.Manifest = []byte(tc.manifest)
+		}
+		m, err := s.Parse()
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", tc.script, err)
+		}
+		if got := m.SupportsCheck(); got != tc.want {
+			t.Errorf("Wrong check support for %q with manifest %q: got %t want %t", tc.script,
+				tc.manifest, got, tc.want)
+		}
+	}
+}
+
+func TestScriptMissingAttribute(t *testing.T) {
+	ioutil.WriteFile("test.txt", []byte("touch {{.path}}"), 0644)
+	defer os.Remove("test.txt")
+
+	o := Operation{ScriptName: "test.txt"}
+	if s, err := o.Script(".", ScriptContext{}); err == nil {
+		t.Fatalf("expected an error for a missing attribute, got %q", s)
+	}
+}
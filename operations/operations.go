@@ -1,56 +1,167 @@
 package operations
 
 import (
-	"bytes"
 	"fmt"
-	"html/template"
 	"log"
+	"time"
 )
 
 // Host is a remote host against which Operations can be executed. The host should be reachable at
-// Hostname over SSH using user User with the private SSH key named Key.
+// Hostname over SSH using user User with the private SSH key named KeyName and/or the password
+// named PasswordName.
 type Host struct {
 	Hostname string
 	User     string
-	// NOTE: SSH credentials keys are transmitted from master to worker unencrypted over the
-	// network. This is highly unsecured and should not be used as-is in production. Possible
-	// solutions:
-	// - Encrypt the communication between master and worker.
-	// - Store the keys in a secure, reference the key name from master and have worker pull it.
-	KeyName  string
-	Password string
+	// KeyName and PasswordName are the names of secrets which are resolved by the workers. The
+	// credentials themselves are never stored in the inventory or sent by the master.
+	KeyName      string
+	PasswordName string
+	// HostKeyFingerprint is the SHA256 fingerprint of the host's SSH key (e.g. "SHA256:...") as
+	// printed by ssh-keygen -l. If set, the host must present this key.
+	HostKeyFingerprint string
+	// Labels are arbitrary key/value pairs (e.g. "env": "prod") which runs can be limited by.
+	Labels map[string]string
+	// Groups are the names of the groups the host belongs to. The operations of a group are
+	// executed on every host in the group in addition to the host's own operations.
+	Groups []string
 }
 
-// Operation represents an operation to be performed on a remote host.
+// Operation represents an operation to be performed on a remote host. If Timeout isn't 0, the
+// operation's script is killed once it has been running for longer than Timeout.
+//
+// The operations of a host are executed in ascending Order. DependsOn lists the descriptions of
+// operations of the same host which must be executed before this operation and succeed for it to
+// be executed at all (see Plan). If several operations have a description, all of them must
+// succeed.
 type Operation struct {
 	Description string
 	ScriptName  string
 	Attributes  map[string]string
+	Timeout     time.Duration
+	Order       int
+	DependsOn   []string
 }
 
-// Script return the script which needs to be run in order to execute an Operation.
+// CheckEnv is the environment variable which is set to 1 when an operation is executed in check
+// mode. The module template's check function returns true in check mode as well. In check mode,
+// modules shouldn't change anything and should exit with ChangedExitCode if they would have. Only
+// modules which declare that they support check mode are executed in check mode.
+const CheckEnv = "SIMPLECM_CHECK"
+
+// ChangedExitCode is the exit code with which a module reports that it changed something, or
+// would have changed something in check mode. A module which exits with a zero exit code is
+// assumed to have found everything in the desired state.
+const ChangedExitCode = 80
+
+// Script return the script which needs to be run in order to execute an Operation. Modules are
+// text templates which are rendered in the context c with the functions of ScriptContext. Rendering
+// fails if the module references an attribute which isn't set (see LoadModule).
 // TODO Improve handling of module dir path
-func (o *Operation) Script(moduleDir string) (string, error) {
+func (o *Operation) Script(moduleDir string, c ScriptContext) (string, error) {
 	log.Printf("Reading script at %s", o.ScriptName)
-	// Template script with attributes
-	tmpl, err := template.ParseFiles(fmt.Sprintf("%s/%s", moduleDir, o.ScriptName))
+	m, err := LoadModule(moduleDir, o.ScriptName)
 	if err != nil {
-		return "", fmt.Errorf("error parsing script template: %v", err)
+		return "", err
 	}
+	return m.Script(o, c)
+}
 
-	b := bytes.Buffer{}
-	err = tmpl.Execute(&b, o.Attributes)
-	if err != nil {
-		return "", fmt.Errorf("error templagint script: %v", err)
+// MergeAttributes merges the given attribute maps into a new map. Attributes of later maps take
+// precedence over attributes of earlier maps.
+func MergeAttributes(maps ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
 	}
-
-	return string(b.Bytes()), nil
+	return merged
 }
 
-// OperationResult represents the result of an Operation.
+// Status describes the outcome of an Operation.
+type Status string
+
+const (
+	// StatusOK means the operation's script ran and exited with a zero exit code.
+	StatusOK Status = "ok"
+	// StatusChanged means the operation's script ran and exited with ChangedExitCode, i.e. it
+	// changed something on the host, or would have in check mode.
+	StatusChanged Status = "changed"
+	// StatusFailed means the operation's script ran on the host but exited with a non-zero exit
+	// code or was killed by a signal.
+	StatusFailed Status = "failed"
+	// StatusUnreachable means the operation's script couldn't be run or its exit status couldn't
+	// be received because of a transport error, e.g. when the host can't be reached over SSH.
+	StatusUnreachable Status = "unreachable"
+	// StatusError means the operation couldn't be executed because of a problem which isn't
+	// related to the host, e.g. an invalid SSH key or a module which can't be rendered.
+	StatusError Status = "error"
+	// StatusHostKeyMismatch means the host presented an SSH host key which doesn't match its
+	// pinned fingerprint or its entry in the worker's known_hosts file. This may indicate a
+	// man-in-the-middle attack.
+	StatusHostKeyMismatch Status = "host_key_mismatch"
+	// StatusTimeout means the operation's script was killed because the operation's or the host's
+	// timeout expired, or the operation wasn't executed because the host's timeout had expired.
+	StatusTimeout Status = "timeout"
+	// StatusCancelled means the operation's script was killed or the operation wasn't executed
+	// because the run was cancelled.
+	StatusCancelled Status = "cancelled"
+	// StatusSkipped means the operation wasn't executed because an operation it depends on didn't
+	// succeed.
+	StatusSkipped Status = "skipped"
+	// StatusUnsupported means the operation wasn't executed because it was executed in check mode
+	// and its module doesn't support check mode.
+	StatusUnsupported Status = "unsupported"
+)
+
+// OperationResult represents the result of an Operation. StartTime and EndTime are the wall-clock
+// times on the worker between which the operation was executed.
+//
+// ExitCode is the exit code of the operation's script, or -1 if the script didn't exit normally.
+// If the script was killed by a signal, Signal contains the signal's name (e.g. "KILL"). Error
+// describes why the operation couldn't be executed or completed when Status is StatusUnreachable,
+// StatusError, StatusTimeout, StatusCancelled, StatusSkipped or StatusUnsupported.
+//
+// Changed is true if Status is StatusChanged. Facts and Message are reported by the module using
+// a ModuleResult. ModuleVersion is the version of the module which was executed (see
+// ModuleSource.Version). It is empty if the operation wasn't executed.
+//
+// Worker and Attempts are set by the master: Worker is the address of the worker which executed
+// the operation and Attempts is the number of times the operation's host was sent to a worker,
+// which is more than 1 if workers failed while processing the host.
 type OperationResult struct {
 	Operation  Operation
 	StdOut     string
 	StdErr     string
 	Successful bool
+	Status     Status
+	Changed    bool
+	Facts      map[string]string
+	Message    string
+	ExitCode   int
+	Signal     string
+	Error      string
+	StartTime  time.Time
+	EndTime    time.Time
+	Worker     string
+	Attempts   int
+
+	ModuleVersion string
+}
+
+// Duration returns the wall-clock time it took to execute the operation.
+func (r *OperationResult) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// FailureReason returns a short human-readable description of why the operation failed.
+func (r *OperationResult) FailureReason() string {
+	switch {
+	case r.Error != "":
+		return r.Error
+	case r.Signal != "":
+		return fmt.Sprintf("killed by signal %s", r.Signal)
+	default:
+		return fmt.Sprintf("exit code %d", r.ExitCode)
+	}
 }
@@ -3,11 +3,12 @@ package operations
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestScript(t *testing.T) {
-	fakeScript := "this is a fake script: {{.what}} {{.ever}}"
+	fakeScript := "this is a fake script: {{.what}} {{.ever}} {{.ntp}}"
 	ioutil.WriteFile("test.txt", []byte(fakeScript), 0644)
 	defer func() {
 		os.Remove("test.txt")
@@ -22,13 +23,50 @@ func TestScript(t *testing.T) {
 		},
 	}
 
-	s, err := o.Script(".")
+	// The operation's attributes take precedence over the host's variables.
+	vars := map[string]string{"ever": "never", "ntp": "pool.ntp.org"}
+	s, err := o.Script(".", ScriptContext{Variables: vars})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	want := "this is a fake script: what ever"
+	want := "this is a fake script: what ever pool.ntp.org"
 	if s != want {
 		t.Fatalf("wrong content: got %s want %s", s, want)
 	}
 }
+
+func TestScriptCheck(t *testing.T) {
+	fakeScript := "{{if check}}would {{end}}touch {{.path}}"
+	ioutil.WriteFile("test.txt", []byte(fakeScript), 0644)
+	defer os.Remove("test.txt")
+
+	o := Operation{ScriptName: "test.txt", Attributes: map[string]string{"path": "/tmp/x"}}
+	for check, want := range map[bool]string{false: "touch /tmp/x", true: "would touch /tmp/x"} {
+		s, err := o.Script(".", ScriptContext{Check: check})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != want {
+			t.Fatalf("wrong content for check %v: got %s want %s", check, s, want)
+		}
+	}
+}
+
+func TestModulesCheck(t *testing.T) {
+	// The bundled modules don't change files in check mode.
+	o := Operation{ScriptName: "file_exists", Attributes: map[string]string{"path": "/tmp/x"}}
+	if s, _ := o.Script("../modules", ScriptContext{Check: true}); strings.Contains(s, "touch") {
+		t.Fatalf("file_exists changes files in check mode:\n%s", s)
+	}
+	o = Operation{
+		ScriptName: "file_contains",
+		Attributes: map[string]string{"path": "/tmp/x", "text": "hello"},
+	}
+	if s, _ := o.Script("../modules", ScriptContext{Check: true}); strings.Contains(s, ">>") {
+		t.Fatalf("file_contains changes files in check mode:\n%s", s)
+	}
+	if s, _ := o.Script("../modules", ScriptContext{}); !strings.Contains(s, ">>") {
+		t.Fatalf("file_contains doesn't change files:\n%s", s)
+	}
+}
@@ -0,0 +1,75 @@
+package operations
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Plan returns the order in which the operations of a host should be executed, as indices into
+// operations. Operations are executed in ascending Order, except that an operation is only
+// executed after all the operations it depends on. Operations with the same Order are executed in
+// the order they are given.
+//
+// An error is returned if an operation depends on an operation which doesn't exist or if the
+// dependencies contain a cycle.
+func Plan(operations []Operation) ([]int, error) {
+	byDescription := make(map[string][]int)
+	for i, o := range operations {
+		byDescription[o.Description] = append(byDescription[o.Description], i)
+	}
+
+	// The number of dependencies of each operation which weren't planned yet and the operations
+	// which depend on each operation.
+	pending := make([]int, len(operations))
+	dependents := make([][]int, len(operations))
+	for i, o := range operations {
+		for _, d := range o.DependsOn {
+			deps, ok := byDescription[d]
+			if !ok {
+				return nil, fmt.Errorf("operation %s depends on unknown operation %s",
+					o.Description, d)
+			}
+			for _, j := range deps {
+				if j == i {
+					return nil, fmt.Errorf("operation %s depends on itself", o.Description)
+				}
+				pending[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	// Repeatedly pick the operation with the lowest Order whose dependencies were all planned.
+	// Hosts have few operations, so this doesn't need to be efficient.
+	var order []int
+	planned := make([]bool, len(operations))
+	for len(order) < len(operations) {
+		next := -1
+		for i, o := range operations {
+			if planned[i] || pending[i] > 0 {
+				continue
+			}
+			if next == -1 || o.Order < operations[next].Order {
+				next = i
+			}
+		}
+		if next == -1 {
+			var cycle []string
+			for i, o := range operations {
+				if !planned[i] {
+					cycle = append(cycle, o.Description)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between operations %s",
+				strings.Join(cycle, ", "))
+		}
+
+		planned[next] = true
+		order = append(order, next)
+		for _, i := range dependents[next] {
+			pending[i]--
+		}
+	}
+
+	return order, nil
+}
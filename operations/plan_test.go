@@ -0,0 +1,64 @@
+package operations
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	operations := []Operation{
+		{Description: "restart_service", DependsOn: []string{"write_config"}},
+		{Description: "write_config", Order: 2, DependsOn: []string{"install_package"}},
+		{Description: "install_package", Order: 5},
+		{Description: "check_disk", Order: 1},
+		{Description: "check_memory", Order: 1},
+	}
+	order, err := Plan(operations)
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	want := []int{3, 4, 2, 1, 0}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("Wrong order: got %v want %v", order, want)
+	}
+
+	// Planning an already planned list doesn't change it.
+	var planned []Operation
+	for _, i := range order {
+		planned = append(planned, operations[i])
+	}
+	order, err = Plan(planned)
+	if err != nil || !reflect.DeepEqual(order, []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("Wrong order for planned operations: got %v, %v", order, err)
+	}
+}
+
+func TestPlanErrors(t *testing.T) {
+	tests := []struct {
+		operations []Operation
+		want       string
+	}{
+		{
+			[]Operation{{Description: "a", DependsOn: []string{"b"}}},
+			"operation a depends on unknown operation b",
+		},
+		{
+			[]Operation{{Description: "a", DependsOn: []string{"a"}}},
+			"operation a depends on itself",
+		},
+		{
+			[]Operation{
+				{Description: "a"},
+				{Description: "b", DependsOn: []string{"c"}},
+				{Description: "c", DependsOn: []string{"b"}},
+			},
+			"dependency cycle between operations b, c",
+		},
+	}
+
+	for _, test := range tests {
+		if _, err := Plan(test.operations); err == nil || err.Error() != test.want {
+			t.Errorf("Wrong error: got %v want %q", err, test.want)
+		}
+	}
+}
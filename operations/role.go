@@ -0,0 +1,28 @@
+package operations
+
+// A Role is a reusable, ordered list of operations which can be assigned to many hosts. The role's
+// Attributes are defaults for the attributes of all of its operations.
+type Role struct {
+	Name       string
+	Attributes map[string]string
+	Operations []Operation
+}
+
+// A RoleAssignment assigns a role to a host. Attributes override the attributes of the role's
+// operations on that host.
+type RoleAssignment struct {
+	Role       string
+	Attributes map[string]string
+}
+
+// Apply returns the role's operations as they should be executed on a host which the role is
+// assigned to using a. Each operation's attributes are the role's default attributes, overridden
+// by the operation's own attributes, overridden by a's attributes.
+func (r Role) Apply(a RoleAssignment) []Operation {
+	operations := make([]Operation, len(r.Operations))
+	for i, o := range r.Operations {
+		o.Attributes = MergeAttributes(r.Attributes, o.Attributes, a.Attributes)
+		operations[i] = o
+	}
+	return operations
+}
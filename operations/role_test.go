@@ -0,0 +1,43 @@
+package operations
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoleApply(t *testing.T) {
+	r := Role{
+		Name:       "web",
+		Attributes: map[string]string{"path": "/etc/hosts", "text": "default"},
+		Operations: []Operation{
+			{Description: "verify_hosts_exists", ScriptName: "file_exists"},
+			{
+				Description: "verify_hosts_contains",
+				ScriptName:  "file_contains",
+				Attributes:  map[string]string{"text": "1.1.1.1 cloudflare-dns"},
+			},
+		},
+	}
+
+	got := r.Apply(RoleAssignment{Role: "web", Attributes: map[string]string{"path": "/tmp/hosts"}})
+	want := []Operation{
+		{
+			Description: "verify_hosts_exists",
+			ScriptName:  "file_exists",
+			Attributes:  map[string]string{"path": "/tmp/hosts", "text": "default"},
+		},
+		{
+			Description: "verify_hosts_contains",
+			ScriptName:  "file_contains",
+			Attributes:  map[string]string{"path": "/tmp/hosts", "text": "1.1.1.1 cloudflare-dns"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong operations: got %v want %v", got, want)
+	}
+
+	// The role itself isn't modified.
+	if len(r.Operations[0].Attributes) != 0 || r.Operations[1].Attributes["path"] != "" {
+		t.Fatalf("Role was modified: got %v", r.Operations)
+	}
+}
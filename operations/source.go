@@ -0,0 +1,70 @@
+package operations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// A ModuleSource is the content of a module and of its manifest, which is nil if the module has no
+// manifest. The master sends the sources of the modules which operations use to workers along with
+// the operations, so workers don't need modules of their own.
+type ModuleSource struct {
+	Name     string
+	Script   []byte
+	Manifest []byte
+}
+
+// ReadModule reads the source of the module with the given name in moduleDir.
+func ReadModule(moduleDir, name string) (ModuleSource, error) {
+	script, err := ioutil.ReadFile(filepath.Join(moduleDir, name))
+	if os.IsNotExist(err) {
+		return ModuleSource{}, fmt.Errorf("module %s not found", name)
+	}
+	if err != nil {
+		return ModuleSource{}, fmt.Errorf("error reading module: %v", err)
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(moduleDir, name+ManifestExt))
+	if err != nil && !os.IsNotExist(err) {
+		return ModuleSource{}, fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	return ModuleSource{Name: name, Script: script, Manifest: manifest}, nil
+}
+
+// Version returns the version of the module, which is the hex-encoded SHA256 hash of the module's
+// script and manifest. Any change to either of them changes the version.
+func (s ModuleSource) Version() string {
+	h := sha256.New()
+	h.Write(s.Script)
+	// Separates the script from the manifest, so moving bytes between them changes the hash.
+	h.Write([]byte{0})
+	h.Write(s.Manifest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Parse parses the module's script and manifest. Modules are rendered with missingkey=error, so
+// rendering fails if the module references an attribute which isn't set.
+func (s ModuleSource) Parse() (*Module, error) {
+	tmpl, err := template.New(filepath.Base(s.Name)).
+		Funcs(ScriptContext{}.funcs()).
+		Option("missingkey=error").
+		Parse(string(s.Script))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing script template: %v", err)
+	}
+
+	var manifest *Manifest
+	if s.Manifest != nil {
+		if manifest, err = parseManifest(s.Manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Module{Name: s.Name, Version: s.Version(), Manifest: manifest, tmpl: tmpl}, nil
+}
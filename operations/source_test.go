@@ -0,0 +1,50 @@
+package operations
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestModuleSource(t *testing.T) {
+	ioutil.WriteFile("test.txt", []byte("echo {{.text | shellQuote}}"), 0644)
+	defer os.Remove("test.txt")
+
+	s, err := ReadModule(".", "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Manifest != nil {
+		t.Fatalf("unexpected manifest: got %q", s.Manifest)
+	}
+	version := s.Version()
+
+	ioutil.WriteFile("test.txt.json", []byte(`{"parameters": {"text": {"default": "hi"}}}`), 0644)
+	defer os.Remove("test.txt.json")
+	if s, err = ReadModule(".", "test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version() == version || len(s.Version()) != 64 {
+		t.Fatalf("wrong version: got %s, version without the manifest %s", s.Version(), version)
+	}
+
+	m, err := s.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != s.Version() || m.Manifest == nil {
+		t.Fatalf("wrong module: got %+v", m)
+	}
+	o, err := m.Manifest.Apply(Operation{ScriptName: "test.txt"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script, err := m.Script(&o, ScriptContext{}); err != nil || script != "echo 'hi'" {
+		t.Fatalf("wrong script: got %q, %v", script, err)
+	}
+
+	if _, err := ReadModule(".", "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected an error for a missing module, got %v", err)
+	}
+}
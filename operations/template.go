@@ -0,0 +1,208 @@
+package operations
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// A ScriptContext is the context in which the script of an operation is rendered.
+//
+// Check is true when the operation is executed in check mode. Hostname is the host the operation
+// is executed on. Variables are the host's variables and Facts are the facts which were reported by
+// the operations which were already executed on the host.
+type ScriptContext struct {
+	Check     bool
+	Hostname  string
+	Variables map[string]string
+	Facts     map[string]string
+}
+
+// Keys of the template data which are reserved for the ScriptContext. They take precedence over
+// attributes and variables with the same names.
+const (
+	keyHostname  = "Hostname"
+	keyVariables = "Vars"
+	keyFacts     = "Facts"
+)
+
+// Returns the data the script of o is rendered with in the context c: the operation's attributes,
+// which take precedence over the host's variables, along with the host's variables and facts
+// under their reserved keys. Values are strings, except for the attributes which manifest declares
+// as lists or maps, which are typed (see ParseValue). manifest may be nil.
+func (c ScriptContext) data(o *Operation, manifest *Manifest) map[string]interface{} {
+	attributes := MergeAttributes(c.Variables, o.Attributes)
+	data := make(map[string]interface{}, len(attributes)+3)
+	for k, v := range attributes {
+		data[k] = v
+		if manifest == nil {
+			continue
+		}
+		if p := manifest.Parameters[k]; p.Type == ParamList || p.Type == ParamMap {
+			data[k] = ParseValue(v)
+		}
+	}
+	data[keyHostname] = c.Hostname
+	data[keyVariables] = MergeAttributes(c.Variables)
+	data[keyFacts] = MergeAttributes(c.Facts)
+	return data
+}
+
+// Returns the functions which are available to module templates when rendering in the context c.
+func (c ScriptContext) funcs() template.FuncMap {
+	return template.FuncMap{
+		"check":        func() bool { return c.Check },
+		"shellQuote":   shellQuote,
+		"default":      defaultValue,
+		"join":         join,
+		"base64":       base64Encode,
+		"toJSON":       toJSON,
+		"fromJSON":     fromJSON,
+		"regexReplace": regexReplace,
+	}
+}
+
+// A List is a typed JSON array. It renders in its JSON encoding and can be iterated over using
+// range.
+type List []interface{}
+
+func (l List) String() string {
+	s, _ := toJSON(l)
+	return s
+}
+
+// A Map is a typed JSON object. It renders in its JSON encoding and its values can be accessed by
+// key, e.g. {{.ports.http}}.
+type Map map[string]interface{}
+
+func (m Map) String() string {
+	s, _ := toJSON(m)
+	return s
+}
+
+// ParseValue returns the typed value of a list or map attribute: a value which is a JSON array or
+// object is returned as a List or a Map respectively and any other value is returned as is. Only
+// the attributes which a module's manifest declares as lists or maps are typed, so that values
+// which merely look like JSON are rendered unchanged.
+func ParseValue(v string) interface{} {
+	t := strings.TrimSpace(v)
+	if !strings.HasPrefix(t, "[") && !strings.HasPrefix(t, "{") {
+		return v
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(t), &decoded); err != nil {
+		return v
+	}
+	return typed(decoded)
+}
+
+// Converts the arrays and objects in a decoded JSON value to Lists and Maps.
+func typed(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		l := make(List, len(v))
+		for i, e := range v {
+			l[i] = typed(e)
+		}
+		return l
+	case map[string]interface{}:
+		m := make(Map, len(v))
+		for k, e := range v {
+			m[k] = typed(e)
+		}
+		return m
+	}
+	return v
+}
+
+// Returns the string form of a template value.
+func toString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// Quotes a value for use as a single word in a shell script.
+func shellQuote(v interface{}) string {
+	return "'" + strings.Replace(toString(v), "'", `'\''`, -1) + "'"
+}
+
+// Returns v, or def if v is empty. Meant to be used in pipelines, e.g. {{.port | default "80"}}.
+// Since modules are rendered with missingkey=error, attributes which may be missing altogether
+// should be accessed using index, e.g. {{index . "port" | default "80"}}.
+func defaultValue(def, v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return def
+	case string:
+		if v == "" {
+			return def
+		}
+	case List:
+		if len(v) == 0 {
+			return def
+		}
+	case Map:
+		if len(v) == 0 {
+			return def
+		}
+	}
+	return v
+}
+
+// Joins the elements of a list using sep. A value which isn't a list is returned as is.
+func join(sep string, v interface{}) string {
+	var elems []string
+	switch v := v.(type) {
+	case List:
+		for _, e := range v {
+			elems = append(elems, toString(e))
+		}
+	case []string:
+		elems = v
+	default:
+		return toString(v)
+	}
+	return strings.Join(elems, sep)
+}
+
+// Returns the base64 encoding of v.
+func base64Encode(v interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(toString(v)))
+}
+
+// Returns the JSON encoding of v.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Decodes the JSON encoding of v, e.g. {{range .servers | fromJSON}}. Arrays and objects are
+// returned as Lists and Maps.
+func fromJSON(v interface{}) (interface{}, error) {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(toString(v)), &decoded); err != nil {
+		return nil, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	return typed(decoded), nil
+}
+
+// Replaces the matches of the regular expression pattern in v with repl, which may refer to
+// submatches (see regexp.Regexp.ReplaceAllString).
+func regexReplace(pattern, repl string, v interface{}) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(toString(v), repl), nil
+}
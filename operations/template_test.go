@@ -0,0 +1,124 @@
+package operations
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScriptNoEscaping(t *testing.T) {
+	ioutil.WriteFile("test.txt", []byte(`echo "{{.text}}" && grep {{.text | shellQuote}}`), 0644)
+	defer os.Remove("test.txt")
+
+	o := Operation{ScriptName: "test.txt", Attributes: map[string]string{"text": `it's a "b" & c`}}
+	s, err := o.Script(".", ScriptContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `echo "it's a "b" & c" && grep 'it'\''s a "b" & c'`
+	if s != want {
+		t.Fatalf("wrong content: got %s want %s", s, want)
+	}
+}
+
+func TestScriptContext(t *testing.T) {
+	tmpl := `{{.Hostname}} {{.Vars.ntp}} {{.Facts.version}} {{index . "port" | default "80"}} ` +
+		`{{.servers}} {{fromJSON .servers | join ","}} {{(fromJSON .ports).http}} ` +
+		`{{range fromJSON .servers}}[{{.}}]{{end}} {{.path | regexReplace "^/etc/" "/tmp/"}} ` +
+		`{{.user | base64}} {{.Vars | toJSON}} {{.Facts.ok | fromJSON}}`
+	ioutil.WriteFile("test.txt", []byte(tmpl), 0644)
+	defer os.Remove("test.txt")
+
+	o := Operation{ScriptName: "test.txt", Attributes: map[string]string{
+		"servers": `["a", "b"]`,
+		"ports":   `{"http": 8080}`,
+		"path":    "/etc/hosts",
+		"user":    "root",
+		"ntp":     "overridden",
+	}}
+	c := ScriptContext{
+		Hostname:  "host1",
+		Variables: map[string]string{"ntp": "pool.ntp.org"},
+		Facts:     map[string]string{"version": "1.2.3", "ok": "true"},
+	}
+	s, err := o.Script(".", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `host1 pool.ntp.org 1.2.3 80 ["a", "b"] a,b 8080 [a][b] /tmp/hosts cm9vdA== ` +
+		`{"ntp":"pool.ntp.org"} true`
+	if s != want {
+		t.Fatalf("wrong content:\ngot  %s\nwant %s", s, want)
+	}
+
+	ioutil.WriteFile("test.txt", []byte(`{{fromJSON .servers}}`), 0644)
+	o.Attributes["servers"] = "[not json"
+	if _, err := o.Script(".", c); err == nil || !strings.Contains(err.Error(), "error decoding JSON") {
+		t.Fatalf("wrong error for invalid JSON: got %v", err)
+	}
+}
+
+func TestScriptManifestTypes(t *testing.T) {
+	tmpl := `{{range .servers}}[{{.}}]{{end}} {{.ports.http}} {{.ports}} {{.text}}`
+	manifest := `{"parameters": {"servers": {"type": "list"}, "ports": {"type": "map"}, "text": {}}}`
+	ioutil.WriteFile("test.txt", []byte(tmpl), 0644)
+	defer os.Remove("test.txt")
+	ioutil.WriteFile("test.txt"+ManifestExt, []byte(manifest), 0644)
+	defer os.Remove("test.txt" + ManifestExt)
+
+	// Only the attributes which are declared as lists or maps are typed.
+	o := Operation{ScriptName: "test.txt", Attributes: map[string]string{
+		"servers": `["a", "b"]`,
+		"ports":   `{"http": 8080}`,
+		"text":    `{"b": 1, "a": 2}`,
+	}}
+	s, err := o.Script(".", ScriptContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[a][b] 8080 {"http":8080} {"b": 1, "a": 2}`
+	if s != want {
+		t.Fatalf("wrong content:\ngot  %s\nwant %s", s, want)
+	}
+}
+
+func TestScriptJSONLookingString(t *testing.T) {
+	// Values which look like JSON are rendered unchanged, whether they are attributes or
+	// variables.
+	text := `{"b": 1, "a": 2}`
+	for _, tc := range []struct {
+		attributes map[string]string
+		variables  map[string]string
+	}{
+		{map[string]string{"path": "/tmp/f", "text": text}, nil},
+		{map[string]string{"path": "/tmp/f"}, map[string]string{"text": text}},
+	} {
+		o := Operation{ScriptName: "file_contains", Attributes: tc.attributes}
+		s, err := o.Script("../modules", ScriptContext{Variables: tc.variables})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `grep -q -- '` + text + `' '/tmp/f'`; !strings.Contains(s, want) {
+			t.Fatalf("wrong content: got %s want it to contain %s", s, want)
+		}
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want interface{}
+	}{
+		{"plain", "plain"},
+		{"1.1.1.1 cloudflare-dns", "1.1.1.1 cloudflare-dns"},
+		{"[not json", "[not json"},
+		{`["a", 1]`, List{"a", 1.0}},
+		{`{"a": {"b": ["c"]}}`, Map{"a": Map{"b": List{"c"}}}},
+	} {
+		if got := ParseValue(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseValue(%q): got %#v want %#v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package secrets resolves credentials such as SSH keys and passwords by name, so that only the
+// names of credentials need to be stored in the inventory and sent from the master to the workers.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by a Provider when it has no secret with the requested name.
+var ErrNotFound = errors.New("secret not found")
+
+// A Provider resolves secrets by name.
+type Provider interface {
+	// Secret returns the value of the secret with the given name, or ErrNotFound if the provider
+	// has no such secret.
+	Secret(name string) (string, error)
+}
+
+// DirProvider reads secrets from files in a directory. The name of a secret is the name of its
+// file, which allows mounting e.g. a Kubernetes secret as the directory. The trailing newline of a
+// single-line file is removed, as by TrimNewline.
+type DirProvider struct {
+	Dir string
+}
+
+// Secret implements Provider.
+func (p DirProvider) Secret(name string) (string, error) {
+	// Names come from the inventory, so don't allow them to point outside the directory.
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+
+	s, err := ioutil.ReadFile(filepath.Join(p.Dir, name))
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading secret %q: %v", name, err)
+	}
+
+	return TrimNewline(string(s)), nil
+}
+
+// TrimNewline removes the trailing newline of a single-line secret, which is typically added when a
+// password is written to a file or piped to a command. Multi-line secrets such as SSH keys are
+// returned unchanged.
+func TrimNewline(s string) string {
+	t := strings.TrimSuffix(s, "\n")
+	if strings.Contains(t, "\n") {
+		return s
+	}
+	return t
+}
+
+// EnvProvider reads secrets from environment variables. The variable of a secret is its name in
+// upper case with every character other than letters and digits replaced with an underscore,
+// preceded by Prefix. For example, with the prefix "SIMPLECM_SECRET_" the secret "host-password"
+// is read from SIMPLECM_SECRET_HOST_PASSWORD.
+type EnvProvider struct {
+	Prefix string
+}
+
+// Secret implements Provider.
+func (p EnvProvider) Secret(name string) (string, error) {
+	s, ok := os.LookupEnv(p.Variable(name))
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return s, nil
+}
+
+// Variable returns the name of the environment variable the given secret is read from.
+func (p EnvProvider) Variable(name string) string {
+	return p.Prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Chain resolves secrets using each of its providers in turn, returning the first secret found.
+type Chain []Provider
+
+// Secret implements Provider.
+func (c Chain) Secret(name string) (string, error) {
+	for _, p := range c {
+		s, err := p.Secret(name)
+		if err != ErrNotFound {
+			return s, err
+		}
+	}
+
+	return "", ErrNotFound
+}
@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// TODO Generate a real SSH key
+	contents := "secretstuff"
+	err = ioutil.WriteFile(filepath.Join(dir, "test_key"), []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("error writing dummy key: %v", err)
+	}
+
+	p := DirProvider{Dir: dir}
+	k, err := p.Secret("test_key")
+	if err != nil {
+		t.Fatalf("error reading key: %v", err)
+	}
+	if k != contents {
+		t.Fatalf("wrong contents read from key: got %v want %v", k, contents)
+	}
+
+	// A single trailing newline is removed from single-line secrets only, as by "vault set".
+	files := map[string]string{
+		"password": "hunter2\n",
+		"key":      "-----BEGIN KEY-----\nstuff\n-----END KEY-----\n",
+	}
+	want := map[string]string{
+		"password": "hunter2",
+		"key":      files["key"],
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("error writing secret: %v", err)
+		}
+		if s, err := p.Secret(name); err != nil || s != want[name] {
+			t.Fatalf("wrong secret %s: got %q, %v want %q", name, s, err, want[name])
+		}
+	}
+
+	if _, err := p.Secret("nosuchkey"); err != ErrNotFound {
+		t.Fatalf("wrong error for missing key: got %v want %v", err, ErrNotFound)
+	}
+	for _, name := range []string{"../test_key", "/etc/passwd", "..", ""} {
+		if _, err := p.Secret(name); err == nil || err == ErrNotFound {
+			t.Fatalf("expected an invalid name error for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	p := EnvProvider{Prefix: "SIMPLECM_TEST_SECRET_"}
+	if v := p.Variable("host-1.password"); v != "SIMPLECM_TEST_SECRET_HOST_1_PASSWORD" {
+		t.Fatalf("wrong variable: got %s", v)
+	}
+
+	os.Setenv("SIMPLECM_TEST_SECRET_HOST_1_PASSWORD", "pass")
+	defer os.Unsetenv("SIMPLECM_TEST_SECRET_HOST_1_PASSWORD")
+
+	s, err := p.Secret("host-1.password")
+	if err != nil || s != "pass" {
+		t.Fatalf("wrong secret: got %q, %v", s, err)
+	}
+	if _, err := p.Secret("nosuchsecret"); err != ErrNotFound {
+		t.Fatalf("wrong error for missing secret: got %v want %v", err, ErrNotFound)
+	}
+}
+
+func TestVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vault")
+
+	// A missing vault can't be opened.
+	if _, err := OpenVault(path, "passphrase"); err == nil {
+		t.Fatalf("expected an error opening a missing vault")
+	}
+
+	// An existing file is replaced and made readable only by its owner.
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := WriteVault(path, "passphrase", map[string]string{"key1": "value1"}); err != nil {
+		t.Fatalf("error writing vault: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("wrong vault file mode: got %v, %v", fi.Mode(), err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("temporary files weren't removed: got %d files", len(files))
+	}
+
+	if _, err := OpenVault(path, "wrong"); err == nil {
+		t.Fatalf("expected an error opening vault with the wrong passphrase")
+	}
+
+	v, err := OpenVault(path, "passphrase")
+	if err != nil {
+		t.Fatalf("error opening vault: %v", err)
+	}
+	if s, err := v.Secret("key1"); err != nil || s != "value1" {
+		t.Fatalf("wrong secret: got %q, %v", s, err)
+	}
+
+	// The first provider which has the secret wins.
+	c := Chain{DirProvider{Dir: dir}, v}
+	if s, err := c.Secret("key1"); err != nil || s != "value1" {
+		t.Fatalf("wrong secret from chain: got %q, %v", s, err)
+	}
+	if _, err := c.Secret("nosuchsecret"); err != ErrNotFound {
+		t.Fatalf("wrong error for missing secret: got %v want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,169 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// VaultPassphraseEnv is the environment variable the vault passphrase is read from by the
+// simple-cm binaries. An environment variable is used rather than a flag so that the passphrase
+// doesn't show up in process listings.
+const VaultPassphraseEnv = "SIMPLECM_VAULT_PASSPHRASE"
+
+// The version of the vault file format.
+const vaultVersion = 1
+
+// scrypt parameters for deriving the vault's key from the passphrase.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	vaultKeySize = 32
+)
+
+// The vault file. Data is the JSON-encoded map of secrets encrypted with AES-256-GCM using a key
+// which is derived from the passphrase and Salt using scrypt.
+type vaultFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// VaultProvider reads secrets from an encrypted vault file which is created using WriteVault.
+type VaultProvider struct {
+	secrets map[string]string
+}
+
+// OpenVault decrypts the vault file at path using passphrase and returns a *VaultProvider which
+// serves its secrets. It is an error for the file not to exist.
+func OpenVault(path, passphrase string) (*VaultProvider, error) {
+	s, err := ReadVault(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VaultProvider{secrets: s}, nil
+}
+
+// Secret implements Provider.
+func (p *VaultProvider) Secret(name string) (string, error) {
+	s, ok := p.secrets[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return s, nil
+}
+
+// ReadVault decrypts the vault file at path using passphrase and returns its secrets.
+func ReadVault(path, passphrase string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault: %v", err)
+	}
+
+	var f vaultFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("error decoding vault: %v", err)
+	}
+	if f.Version != vaultVersion {
+		return nil, fmt.Errorf("unsupported vault version %d", f.Version)
+	}
+
+	gcm, err := vaultCipher(passphrase, f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gcm.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		return nil, errors.New("error decrypting vault: wrong passphrase or corrupted file")
+	}
+
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("error decoding vault secrets: %v", err)
+	}
+
+	return secrets, nil
+}
+
+// WriteVault encrypts the given secrets using passphrase and writes them to a vault file at path,
+// replacing any existing file. The vault is written to a temporary file which is then renamed, so
+// that an interrupted write doesn't corrupt an existing vault, and is readable only by its owner.
+func WriteVault(path, passphrase string, secrets map[string]string) error {
+	f := vaultFile{Version: vaultVersion, Salt: make([]byte, 16)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return fmt.Errorf("error generating salt: %v", err)
+	}
+
+	gcm, err := vaultCipher(passphrase, f.Salt)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return fmt.Errorf("error encoding vault secrets: %v", err)
+	}
+	f.Data = gcm.Seal(nil, f.Nonce, data, nil)
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("error encoding vault: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating vault: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing vault: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing vault: %v", err)
+	}
+
+	return nil
+}
+
+// Returns the AEAD cipher for a vault with the given passphrase and salt.
+func vaultCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty vault passphrase")
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, vaultKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving vault key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,114 @@
+// Package tlsconfig builds the TLS configurations which are used for mutually authenticated
+// communication between the master and the workers, and dials RPC servers over TLS.
+package tlsconfig
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+// Files holds the paths of the PEM-encoded files which make up a TLS configuration.
+type Files struct {
+	// Cert and Key are the certificate and private key presented to the other side.
+	Cert string
+	Key  string
+	// CA is the certificate of the CA which the other side's certificate must be signed by.
+	CA string
+}
+
+// Enabled returns whether any of the files is set.
+func (f Files) Enabled() bool {
+	return f.Cert != "" || f.Key != "" || f.CA != ""
+}
+
+// Server returns a *tls.Config for a server which presents the given certificate and requires
+// clients to present a certificate signed by the given CA.
+func Server(f Files) (*tls.Config, error) {
+	cert, pool, err := load(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Client returns a *tls.Config for a client which presents the given certificate and requires
+// servers to present a certificate signed by the given CA.
+func Client(f Files) (*tls.Config, error) {
+	cert, pool, err := load(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Loads the certificate, key and CA certificate.
+func load(f Files) (tls.Certificate, *x509.CertPool, error) {
+	if f.Cert == "" || f.Key == "" || f.CA == "" {
+		return tls.Certificate{}, nil, errors.New("a certificate, a key and a CA certificate are required for TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(f.CA)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("error reading CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificates found in %s", f.CA)
+	}
+
+	return cert, pool, nil
+}
+
+// The response an RPC server sends to a successful HTTP CONNECT request. See net/rpc.
+const rpcConnected = "200 Connected to Go RPC"
+
+// DialRPC connects to an RPC server which is served over HTTP, like rpc.DialHTTP does. If config
+// isn't nil, the connection is made over TLS using config.
+func DialRPC(addr string, config *tls.Config) (*rpc.Client, error) {
+	if config == nil {
+		return rpc.DialHTTP("tcp", addr)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
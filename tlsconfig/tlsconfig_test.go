@@ -0,0 +1,182 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A self-signed CA which issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+	path string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{cert: cert, key: key, dir: dir, path: filepath.Join(dir, name+".crt")}
+	writePEM(t, ca.path, "CERTIFICATE", der)
+	return ca
+}
+
+// Issues a certificate which is valid for 127.0.0.1 and returns the files of a configuration
+// which presents it and trusts the CA.
+func (ca *testCA) issue(t *testing.T, name string) Files {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+
+	f := Files{
+		Cert: filepath.Join(ca.dir, name+".crt"),
+		Key:  filepath.Join(ca.dir, name+".key"),
+		CA:   ca.path,
+	}
+	writePEM(t, f.Cert, "CERTIFICATE", der)
+	writePEM(t, f.Key, "EC PRIVATE KEY", keyDER)
+	return f
+}
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600)
+	if err != nil {
+		t.Fatalf("Error writing %s: %v", path, err)
+	}
+}
+
+type Echo struct{}
+
+func (Echo) Echo(in string, out *string) error {
+	*out = in
+	return nil
+}
+
+func TestDialRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	serverConfig, err := Server(ca.issue(t, "worker"))
+	if err != nil {
+		t.Fatalf("Error creating server config: %v", err)
+	}
+
+	s := rpc.NewServer()
+	s.Register(Echo{})
+	server := httptest.NewUnstartedServer(s)
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	// A client with a certificate signed by the CA is accepted.
+	clientConfig, err := Client(ca.issue(t, "master"))
+	if err != nil {
+		t.Fatalf("Error creating client config: %v", err)
+	}
+	c, err := DialRPC(addr, clientConfig)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	var out string
+	if err := c.Call("Echo.Echo", "hello", &out); err != nil || out != "hello" {
+		t.Fatalf("Wrong response: got %q, %v", out, err)
+	}
+	c.Close()
+
+	// A client with a certificate signed by another CA is refused.
+	other := newTestCA(t, dir, "other")
+	otherFiles := other.issue(t, "rogue")
+	otherFiles.CA = ca.path
+	rogueConfig, err := Client(otherFiles)
+	if err != nil {
+		t.Fatalf("Error creating client config: %v", err)
+	}
+	if c, err := DialRPC(addr, rogueConfig); err == nil {
+		// The handshake error may only surface on the first call.
+		if err := c.Call("Echo.Echo", "hello", &out); err == nil {
+			t.Fatalf("Client with an unknown certificate wasn't refused")
+		}
+	}
+
+	// A client without a certificate is refused.
+	noCertConfig := clientConfig.Clone()
+	noCertConfig.Certificates = nil
+	if c, err := DialRPC(addr, noCertConfig); err == nil {
+		if err := c.Call("Echo.Echo", "hello", &out); err == nil {
+			t.Fatalf("Client without a certificate wasn't refused")
+		}
+	}
+
+	// The client refuses a server whose certificate isn't signed by the CA.
+	otherFiles = other.issue(t, "master2")
+	untrustingConfig, err := Client(otherFiles)
+	if err != nil {
+		t.Fatalf("Error creating client config: %v", err)
+	}
+	if _, err := DialRPC(addr, untrustingConfig); err == nil {
+		t.Fatalf("Server with an untrusted certificate wasn't refused")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Server(Files{Cert: "cert"}); err == nil {
+		t.Fatalf("Expected an error for missing files")
+	}
+	if _, err := Client(Files{Cert: "nope", Key: "nope", CA: "nope"}); err == nil {
+		t.Fatalf("Expected an error for nonexistent files")
+	}
+}
@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/rpc"
+	"reflect"
+
+	"github.com/johananl/simple-cm/tlsconfig"
+	"github.com/johananl/simple-cm/worker"
+)
+
+// An rpcClient is a Client which uses net/rpc. net/rpc has a single response per call, so events
+// aren't streamed.
+type rpcClient struct {
+	c *rpc.Client
+}
+
+// DialRPC connects to a worker which serves its methods using net/rpc over HTTP.
+func DialRPC(addr string, config *tls.Config) (Client, error) {
+	c, err := tlsconfig.DialRPC(addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpcClient{c: c}, nil
+}
+
+func (c *rpcClient) Ping(ctx context.Context, in *worker.PingInput, out *worker.PingOutput) error {
+	return c.call(ctx, "Worker.Ping", in, out)
+}
+
+func (c *rpcClient) Execute(ctx context.Context, in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error {
+	return c.call(ctx, "Worker.Execute", in, out)
+}
+
+func (c *rpcClient) Cancel(ctx context.Context, in *worker.CancelInput, out *worker.CancelOutput) error {
+	return c.call(ctx, "Worker.Cancel", in, out)
+}
+
+func (c *rpcClient) Close() error {
+	return c.c.Close()
+}
+
+// Calls the given method and waits for the response until ctx is done. The response is decoded
+// into a copy of out, since it may still arrive after the call returns.
+func (c *rpcClient) call(ctx context.Context, method string, in, out interface{}) error {
+	reply := reflect.New(reflect.TypeOf(out).Elem())
+	call := c.c.Go(method, in, reply.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		switch err := call.Error.(type) {
+		case rpc.ServerError:
+			return RemoteError(err)
+		case nil:
+			reflect.ValueOf(out).Elem().Set(reply.Elem())
+			return nil
+		default:
+			if err == rpc.ErrShutdown {
+				return ErrClosed
+			}
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,413 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johananl/simple-cm/worker"
+)
+
+// The stream transport's wire format: after exchanging streamMagic, each side sends frames. A
+// frame is a 4-byte big-endian length followed by a gob-encoded frame struct. Requests, events and
+// responses are matched by ID, so that a connection can carry any number of concurrent calls. A
+// worker may send any number of events for a request before sending its response.
+const streamMagic = "simple-cm stream 1\n"
+
+// The maximum size of a frame. Larger frames are rejected, which protects against a corrupt length
+// or a peer which doesn't speak the stream transport.
+var maxFrameSize = 64 << 20
+
+// Timeout for connecting to a worker and exchanging streamMagic.
+const streamDialTimeout = 10 * time.Second
+
+type frameKind uint8
+
+const (
+	kindRequest frameKind = iota
+	kindEvent
+	kindResponse
+)
+
+type frame struct {
+	Kind frameKind
+	ID   uint64
+	// Method is the called method. Set for requests.
+	Method string
+	// Body is the gob-encoded input of a request, worker.Event of an event or output of a
+	// response.
+	Body []byte
+	// Error is the error returned by the method. Set for responses.
+	Error string
+}
+
+// A frameSizeError is returned when a frame is larger than maxFrameSize.
+type frameSizeError int
+
+func (e frameSizeError) Error() string {
+	return fmt.Sprintf("frame too large: %d bytes", int(e))
+}
+
+// Writes f to w. Nothing is written if f is larger than maxFrameSize.
+func writeFrame(w io.Writer, f *frame) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		return fmt.Errorf("error encoding frame: %v", err)
+	}
+	b := buf.Bytes()
+	if len(b)-4 > maxFrameSize {
+		return frameSizeError(len(b) - 4)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	_, err := w.Write(b)
+	return err
+}
+
+// Reads a frame from r.
+func readFrame(r io.Reader) (*frame, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(maxFrameSize) {
+		return nil, frameSizeError(size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	var f frame
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&f); err != nil {
+		return nil, fmt.Errorf("error decoding frame: %v", err)
+	}
+
+	return &f, nil
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func decode(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// Writes streamMagic to conn and checks that the peer sent it too.
+func handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(streamDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, streamMagic); err != nil {
+		return err
+	}
+	b := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if string(b) != streamMagic {
+		return errors.New("peer doesn't speak the stream transport")
+	}
+
+	return nil
+}
+
+// A streamClient is a Client which uses the stream transport.
+type streamClient struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingCall
+	// err is set when the connection fails. Every subsequent call fails with it.
+	err error
+}
+
+// A call which is waiting for its response.
+type pendingCall struct {
+	// events is called for the call's events. May be nil.
+	events func(worker.Event)
+	done   chan *frame
+}
+
+// DialStream connects to a worker which serves its methods using ServeStream.
+func DialStream(addr string, config *tls.Config) (Client, error) {
+	dialer := &net.Dialer{Timeout: streamDialTimeout}
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &streamClient{conn: conn, pending: make(map[uint64]*pendingCall)}
+	go c.read()
+
+	return c, nil
+}
+
+func (c *streamClient) Ping(ctx context.Context, in *worker.PingInput, out *worker.PingOutput) error {
+	return c.call(ctx, "Worker.Ping", in, out, nil)
+}
+
+func (c *streamClient) Execute(ctx context.Context, in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error {
+	return c.call(ctx, "Worker.Execute", in, out, events)
+}
+
+func (c *streamClient) Cancel(ctx context.Context, in *worker.CancelInput, out *worker.CancelOutput) error {
+	return c.call(ctx, "Worker.Cancel", in, out, nil)
+}
+
+func (c *streamClient) Close() error {
+	c.fail(ErrClosed)
+	return c.conn.Close()
+}
+
+// Sends a request for the given method and waits for the response until ctx is done. events is
+// called for the events received before the response.
+func (c *streamClient) call(ctx context.Context, method string, in, out interface{}, events func(worker.Event)) error {
+	body, err := encode(in)
+	if err != nil {
+		return fmt.Errorf("error encoding input: %v", err)
+	}
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	p := &pendingCall{events: events, done: make(chan *frame, 1)}
+	c.pending[id] = p
+	c.lock.Unlock()
+	defer c.forget(id)
+
+	c.writeLock.Lock()
+	err = writeFrame(c.conn, &frame{Kind: kindRequest, ID: id, Method: method, Body: body})
+	c.writeLock.Unlock()
+	if _, ok := err.(frameSizeError); ok {
+		// Nothing was written, so the connection is still usable.
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	if err != nil {
+		c.fail(err)
+		return err
+	}
+
+	select {
+	case f, ok := <-p.done:
+		if !ok {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			return c.err
+		}
+		if f.Error != "" {
+			return RemoteError(f.Error)
+		}
+		if err := decode(f.Body, out); err != nil {
+			return fmt.Errorf("error decoding output: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Removes the pending call with the given ID.
+func (c *streamClient) forget(id uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, id)
+}
+
+// Marks the connection as failed with err and fails all pending calls.
+func (c *streamClient) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, p := range c.pending {
+		close(p.done)
+		delete(c.pending, id)
+	}
+}
+
+// Reads events and responses from the connection and delivers them to the pending calls until the
+// connection fails. Events are delivered synchronously, so a slow events function delays the
+// other calls on the connection.
+func (c *streamClient) read() {
+	for {
+		f, err := readFrame(c.conn)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.fail(err)
+			c.conn.Close()
+			return
+		}
+
+		c.lock.Lock()
+		p, ok := c.pending[f.ID]
+		if ok && f.Kind == kindResponse {
+			delete(c.pending, f.ID)
+		}
+		c.lock.Unlock()
+		if !ok {
+			continue
+		}
+
+		switch f.Kind {
+		case kindEvent:
+			if p.events == nil {
+				continue
+			}
+			var e worker.Event
+			if err := decode(f.Body, &e); err != nil {
+				log.Printf("Error decoding event: %v", err)
+				continue
+			}
+			p.events(e)
+		case kindResponse:
+			p.done <- f
+		}
+	}
+}
+
+// ServeStream accepts connections from l and serves the calls received over them using h. It
+// returns when l fails, e.g. when it is closed.
+func ServeStream(l net.Listener, h Handler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, h)
+	}
+}
+
+// Serves the calls received over conn until the connection fails. Calls are served
+// concurrently.
+func serveConn(conn net.Conn, h Handler) {
+	defer conn.Close()
+
+	if err := handshake(conn); err != nil {
+		log.Printf("Stream handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	var writeLock sync.Mutex
+	for {
+		f, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if f.Kind != kindRequest {
+			continue
+		}
+
+		go func(f *frame) {
+			write := func(f *frame) error {
+				writeLock.Lock()
+				defer writeLock.Unlock()
+				err := writeFrame(conn, f)
+				if err != nil {
+					log.Printf("Error writing to %s: %v", conn.RemoteAddr(), err)
+				}
+				return err
+			}
+			events := func(e worker.Event) {
+				body, err := encode(&e)
+				if err != nil {
+					log.Printf("Error encoding event: %v", err)
+					return
+				}
+				write(&frame{Kind: kindEvent, ID: f.ID, Body: body})
+			}
+
+			resp := &frame{Kind: kindResponse, ID: f.ID}
+			var err error
+			resp.Body, err = dispatch(h, f.Method, f.Body, events)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+			if err, ok := write(resp).(frameSizeError); ok {
+				// The caller waits for a response, so send it an error instead.
+				write(&frame{
+					Kind:  kindResponse,
+					ID:    f.ID,
+					Error: fmt.Sprintf("error sending response: %v", err),
+				})
+			}
+		}(f)
+	}
+}
+
+// Calls the given method of h with the gob-encoded input and returns the gob-encoded output.
+// events is called for the events of an Execute call.
+func dispatch(h Handler, method string, body []byte, events func(worker.Event)) ([]byte, error) {
+	switch method {
+	case "Worker.Ping":
+		var in worker.PingInput
+		var out worker.PingOutput
+		if err := decode(body, &in); err != nil {
+			return nil, fmt.Errorf("error decoding input: %v", err)
+		}
+		if err := h.Ping(&in, &out); err != nil {
+			return nil, err
+		}
+		return encode(&out)
+	case "Worker.Execute":
+		var in worker.ExecuteInput
+		var out worker.ExecuteOutput
+		if err := decode(body, &in); err != nil {
+			return nil, fmt.Errorf("error decoding input: %v", err)
+		}
+		if err := h.ExecuteStream(&in, &out, events); err != nil {
+			return nil, err
+		}
+		return encode(&out)
+	case "Worker.Cancel":
+		var in worker.CancelInput
+		var out worker.CancelOutput
+		if err := decode(body, &in); err != nil {
+			return nil, fmt.Errorf("error decoding input: %v", err)
+		}
+		if err := h.Cancel(&in, &out); err != nil {
+			return nil, err
+		}
+		return encode(&out)
+	}
+
+	return nil, fmt.Errorf("unknown method %s", method)
+}
@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/worker"
+)
+
+// Lower the frame size limit, so that tests can exceed it without allocating much. It is set before
+// any server starts, since the servers' goroutines read it.
+func init() {
+	maxFrameSize = 1 << 10
+}
+
+// A fake worker which echoes the operations it receives as results and sends their descriptions
+// as output events. ExecuteStream fails for hosts named "fail", blocks until block is closed for
+// hosts named "block" and returns output larger than maxFrameSize for hosts named "large".
+type fakeHandler struct {
+	block chan struct{}
+}
+
+func (h *fakeHandler) Ping(in *worker.PingInput, out *worker.PingOutput) error {
+	out.Nonce = in.Nonce
+	return nil
+}
+
+func (h *fakeHandler) Cancel(in *worker.CancelInput, out *worker.CancelOutput) error {
+	out.Running = in.ID == "running"
+	return nil
+}
+
+func (h *fakeHandler) ExecuteStream(in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error {
+	switch in.Hostname {
+	case "fail":
+		return errors.New("execution failed")
+	case "block":
+		<-h.block
+	case "large":
+		out.Results = []ops.OperationResult{{StdOut: strings.Repeat("x", maxFrameSize+1)}}
+		return nil
+	}
+	for i, o := range in.Operations {
+		events(worker.Event{Kind: worker.EventOutput, Index: i, Stream: "stdout", Data: o.Description})
+		out.Results = append(out.Results, ops.OperationResult{Operation: o, Status: ops.StatusOK})
+	}
+	return nil
+}
+
+// Starts a stream server which serves h and returns its address.
+func startStreamServer(t *testing.T, h Handler) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go ServeStream(l, h)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestStream(t *testing.T) {
+	h := &fakeHandler{block: make(chan struct{})}
+	addr, stop := startStreamServer(t, h)
+	defer stop()
+
+	c, err := DialStream(addr, nil)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	ping := worker.PingInput{Nonce: 42}
+	var pong worker.PingOutput
+	if err := c.Ping(context.Background(), &ping, &pong); err != nil || pong.Nonce != 42 {
+		t.Fatalf("Wrong ping response: got %+v, %v", pong, err)
+	}
+
+	// A blocked call doesn't hold up other calls on the same connection.
+	blocked := make(chan error, 1)
+	go func() {
+		in := worker.ExecuteInput{Hostname: "block"}
+		var out worker.ExecuteOutput
+		blocked <- c.Execute(context.Background(), &in, &out, nil)
+	}()
+
+	in := worker.ExecuteInput{
+		Hostname:   "host1",
+		Operations: []ops.Operation{{Description: "op1"}, {Description: "op2"}},
+	}
+	var out worker.ExecuteOutput
+	var output []string
+	events := func(e worker.Event) {
+		output = append(output, e.Data)
+	}
+	if err := c.Execute(context.Background(), &in, &out, events); err != nil {
+		t.Fatalf("Error executing: %v", err)
+	}
+	if len(out.Results) != 2 || out.Results[1].Operation.Description != "op2" {
+		t.Fatalf("Wrong results: got %+v", out.Results)
+	}
+	// Events are received before the response.
+	if len(output) != 2 || output[0] != "op1" || output[1] != "op2" {
+		t.Fatalf("Wrong events: got %v", output)
+	}
+
+	close(h.block)
+	if err := <-blocked; err != nil {
+		t.Fatalf("Error executing blocked call: %v", err)
+	}
+
+	var cancelled worker.CancelOutput
+	err = c.Cancel(context.Background(), &worker.CancelInput{ID: "running"}, &cancelled)
+	if err != nil || !cancelled.Running {
+		t.Fatalf("Wrong cancel response: got %+v, %v", cancelled, err)
+	}
+
+	// Errors returned by the worker are RemoteErrors.
+	in.Hostname = "fail"
+	err = c.Execute(context.Background(), &in, &out, nil)
+	if _, ok := err.(RemoteError); !ok || err.Error() != "execution failed" {
+		t.Fatalf("Wrong error: got %#v", err)
+	}
+}
+
+func TestStreamFailures(t *testing.T) {
+	h := &fakeHandler{block: make(chan struct{})}
+	defer close(h.block)
+	addr, stop := startStreamServer(t, h)
+	defer stop()
+
+	c, err := DialStream(addr, nil)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+
+	// A call returns when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	in := worker.ExecuteInput{Hostname: "block"}
+	var out worker.ExecuteOutput
+	if err := c.Execute(ctx, &in, &out, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Wrong error: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// A response larger than maxFrameSize fails the call but not the connection.
+	large := worker.ExecuteInput{Hostname: "large"}
+	err = c.Execute(context.Background(), &large, &out, nil)
+	if _, ok := err.(RemoteError); !ok || !strings.Contains(err.Error(), "frame too large") {
+		t.Fatalf("Wrong error for large response: got %#v", err)
+	}
+	// So does a request larger than maxFrameSize.
+	large.Operations = []ops.Operation{{Description: strings.Repeat("x", maxFrameSize+1)}}
+	err = c.Execute(context.Background(), &large, &out, nil)
+	if err == nil || !strings.Contains(err.Error(), "frame too large") {
+		t.Fatalf("Wrong error for large request: got %v", err)
+	}
+	if err := c.Ping(context.Background(), &worker.PingInput{}, &worker.PingOutput{}); err != nil {
+		t.Fatalf("Error pinging after large frames: %v", err)
+	}
+
+	// Closing the connection fails pending and subsequent calls.
+	pending := make(chan error, 1)
+	go func() {
+		pending <- c.Execute(context.Background(), &in, &out, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	if err := <-pending; err != ErrClosed {
+		t.Fatalf("Wrong error for pending call: got %v want %v", err, ErrClosed)
+	}
+	if err := c.Ping(context.Background(), &worker.PingInput{}, &worker.PingOutput{}); err != ErrClosed {
+		t.Fatalf("Wrong error after close: got %v want %v", err, ErrClosed)
+	}
+
+	// Dialing a worker which uses the RPC transport fails.
+	server := httptest.NewServer(rpc.NewServer())
+	defer server.Close()
+	if _, err := DialStream(strings.TrimPrefix(server.URL, "http://"), nil); err == nil {
+		t.Fatalf("Expected an error dialing an RPC worker")
+	}
+}
@@ -0,0 +1,67 @@
+// Package transport implements the connections over which the master sends work to the workers.
+// Two transports are available: RPC, which uses Go's net/rpc over HTTP, and Stream, which sends
+// length-prefixed gob-encoded frames over a plain TCP connection and streams the worker's events
+// to the master while operations execute.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/johananl/simple-cm/worker"
+)
+
+// Names of the supported transports.
+const (
+	RPC    = "rpc"
+	Stream = "stream"
+)
+
+// ErrClosed is returned by calls on a Client whose connection was closed.
+var ErrClosed = errors.New("connection closed")
+
+// A Client is a connection to a worker. It is safe for concurrent use.
+type Client interface {
+	// Ping calls the worker's Ping method.
+	Ping(ctx context.Context, in *worker.PingInput, out *worker.PingOutput) error
+	// Execute calls the worker's Execute method. If events isn't nil, it is called for every
+	// worker.Event the worker sends while executing, if the transport supports streaming events.
+	Execute(ctx context.Context, in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error
+	// Cancel calls the worker's Cancel method.
+	Cancel(ctx context.Context, in *worker.CancelInput, out *worker.CancelOutput) error
+	// Close closes the connection. Pending calls fail with ErrClosed or a transport error.
+	Close() error
+}
+
+// A Handler serves the calls received from the master. It is implemented by *worker.Worker.
+type Handler interface {
+	Ping(in *worker.PingInput, out *worker.PingOutput) error
+	ExecuteStream(in *worker.ExecuteInput, out *worker.ExecuteOutput, events func(worker.Event)) error
+	Cancel(in *worker.CancelInput, out *worker.CancelOutput) error
+}
+
+// A RemoteError is an error which was returned by the worker's method rather than caused by a
+// failure of the worker or of the connection to it.
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return string(e)
+}
+
+// A Dialer connects to the worker at the given <host>:<port> address. If config isn't nil, the
+// connection is made over TLS using config.
+type Dialer func(addr string, config *tls.Config) (Client, error)
+
+// NewDialer returns the Dialer of the transport with the given name.
+func NewDialer(name string) (Dialer, error) {
+	switch name {
+	case RPC:
+		return DialRPC, nil
+	case Stream:
+		return DialStream, nil
+	}
+
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
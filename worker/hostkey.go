@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMismatchError is returned when a host presents an SSH host key which doesn't match its
+// pinned fingerprint or its entry in the known_hosts file.
+type HostKeyMismatchError struct {
+	Hostname string
+	// Want is the fingerprint of the expected key and Got is the fingerprint of the presented key.
+	Want string
+	Got  string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: got %s want %s", e.Hostname, e.Got, e.Want)
+}
+
+// UnknownHostKeyError is returned when a host presents an SSH host key which can't be verified
+// because the host has no pinned fingerprint and no entry in the known_hosts file, and trust on
+// first use isn't enabled.
+type UnknownHostKeyError struct {
+	Hostname string
+	Got      string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host key %s for %s", e.Got, e.Hostname)
+}
+
+// Verifies the key presented by a host. The key is checked against the host's pinned fingerprint
+// if there is one, or else against the worker's known_hosts file. If the host is unknown, the key
+// is accepted only if trust on first use is enabled.
+func (w *Worker) verifyHostKey(in *ExecuteInput, addr string, remote net.Addr, key ssh.PublicKey) error {
+	got := ssh.FingerprintSHA256(key)
+
+	if in.HostKeyFingerprint != "" {
+		if got != in.HostKeyFingerprint {
+			return &HostKeyMismatchError{Hostname: in.Hostname, Want: in.HostKeyFingerprint, Got: got}
+		}
+		return nil
+	}
+
+	if w.KnownHostsFile != "" {
+		callback, err := knownhosts.New(w.KnownHostsFile)
+		if err != nil {
+			return fmt.Errorf("error reading known hosts file: %v", err)
+		}
+
+		err = callback(addr, remote, key)
+		ke, ok := err.(*knownhosts.KeyError)
+		switch {
+		case err == nil:
+			return nil
+		case ok && len(ke.Want) > 0:
+			return &HostKeyMismatchError{
+				Hostname: in.Hostname,
+				Want:     ssh.FingerprintSHA256(ke.Want[0].Key),
+				Got:      got,
+			}
+		case !ok:
+			// E.g. a revoked key
+			return err
+		}
+	}
+
+	if in.TrustOnFirstUse {
+		return nil
+	}
+
+	return &UnknownHostKeyError{Hostname: in.Hostname, Got: got}
+}
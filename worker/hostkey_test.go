@@ -0,0 +1,95 @@
+package worker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Returns a new random SSH public key.
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Error converting key: %v", err)
+	}
+	return key
+}
+
+func TestVerifyHostKey(t *testing.T) {
+	key := newPublicKey(t)
+	other := newPublicKey(t)
+	fingerprint := ssh.FingerprintSHA256(key)
+	otherFingerprint := ssh.FingerprintSHA256(other)
+
+	// known_hosts has an entry for host1 only.
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("host1:22")}, key) + "\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		t.Fatalf("Error writing known hosts file: %v", err)
+	}
+
+	mismatch := func(want, got string) error {
+		return &HostKeyMismatchError{Hostname: "host1", Want: want, Got: got}
+	}
+	unknown := func(got string) error {
+		return &UnknownHostKeyError{Hostname: "host1", Got: got}
+	}
+
+	tests := []struct {
+		name            string
+		fingerprint     string
+		knownHostsFile  string
+		trustOnFirstUse bool
+		addr            string
+		key             ssh.PublicKey
+		want            error
+	}{
+		{"pinned fingerprint matches", fingerprint, "", false, "host1:22", key, nil},
+		{"pinned fingerprint mismatch", fingerprint, "", true, "host1:22", other,
+			mismatch(fingerprint, otherFingerprint)},
+		// A pinned fingerprint takes precedence over known_hosts.
+		{"pinned fingerprint overrides known hosts", otherFingerprint, knownHosts, false, "host1:22",
+			other, nil},
+		{"known hosts match", "", knownHosts, false, "host1:22", key, nil},
+		{"known hosts mismatch", "", knownHosts, true, "host1:22", other,
+			mismatch(fingerprint, otherFingerprint)},
+		{"known hosts unknown", "", knownHosts, false, "host2:22", key, unknown(fingerprint)},
+		{"known hosts unknown with trust on first use", "", knownHosts, true, "host2:22", key, nil},
+		{"no known hosts", "", "", false, "host1:22", key, unknown(fingerprint)},
+		{"trust on first use", "", "", true, "host1:22", key, nil},
+	}
+
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := Worker{KnownHostsFile: tc.knownHostsFile}
+			in := ExecuteInput{
+				Hostname:           "host1",
+				HostKeyFingerprint: tc.fingerprint,
+				TrustOnFirstUse:    tc.trustOnFirstUse,
+			}
+
+			err := w.verifyHostKey(&in, tc.addr, remote, tc.key)
+			if reflect.TypeOf(err) != reflect.TypeOf(tc.want) || errString(err) != errString(tc.want) {
+				t.Fatalf("Wrong error: got %#v want %#v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegistrationTokenEnv is the environment variable the token which workers present to the master
+// when registering is read from, by both the master and the workers.
+const RegistrationTokenEnv = "SIMPLECM_REGISTRATION_TOKEN"
+
+// errNotRegistered is returned by heartbeat when the master doesn't know the worker, e.g. because
+// the master was restarted or expired the worker.
+var errNotRegistered = errors.New("worker not registered with master")
+
+// Register announces the worker to the master API at masterURL under the <host>:<port> address
+// addr, which the master uses to connect to the worker. Once registered, a heartbeat is sent every
+// interval so that the master keeps the worker in its pool. Failed registrations are retried, and
+// the worker registers again if the master stops recognizing it. Register blocks until ctx is done.
+//
+// The master only accepts registrations which carry its registration token or which are made over
+// TLS with a client certificate it trusts. token is sent with every request if it isn't empty. If
+// config isn't nil, it is used for connecting to an https masterURL.
+func Register(ctx context.Context, masterURL, addr, token string, interval time.Duration, config *tls.Config) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if config != nil {
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+	masterURL = strings.TrimRight(masterURL, "/")
+
+	registered := false
+	for {
+		if !registered {
+			if err := post(client, masterURL+"/workers/register", addr, token); err != nil {
+				log.Printf("Could not register with master %s: %v", masterURL, err)
+			} else {
+				log.Printf("Registered with master %s as %s", masterURL, addr)
+				registered = true
+			}
+		} else {
+			err := post(client, masterURL+"/workers/heartbeat", addr, token)
+			if err == errNotRegistered {
+				log.Printf("Master %s doesn't recognize this worker, registering again", masterURL)
+				registered = false
+				continue
+			}
+			if err != nil {
+				log.Printf("Could not send heartbeat to master %s: %v", masterURL, err)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sends a worker registration or heartbeat request to the master.
+func post(client *http.Client, url, addr, token string) error {
+	body, err := json.Marshal(map[string]string{"addr": addr})
+	if err != nil {
+		return fmt.Errorf("error encoding request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotRegistered
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("master responded with %s: %s", resp.Status, e.Error)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPost(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		status  int
+		wantErr string
+	}{
+		{"ok", "secret", http.StatusOK, ""},
+		{"no token", "", http.StatusOK, ""},
+		{"not registered", "secret", http.StatusNotFound, errNotRegistered.Error()},
+		{"unauthorized", "wrong", http.StatusUnauthorized, "master responded with 401 Unauthorized: failed"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotAuth string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAuth = r.Header.Get("Authorization")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(`{"error": "failed"}`))
+			}))
+			defer server.Close()
+
+			err := post(server.Client(), server.URL, "worker1:8888", tc.token)
+			if gotErr := errString(err); gotErr != tc.wantErr {
+				t.Fatalf("Wrong error: got %q want %q", gotErr, tc.wantErr)
+			}
+			wantAuth := ""
+			if tc.token != "" {
+				wantAuth = "Bearer " + tc.token
+			}
+			if gotAuth != wantAuth {
+				t.Fatalf("Wrong Authorization header: got %q want %q", gotAuth, wantAuth)
+			}
+		})
+	}
+}
+
+// Returns the message of err, or an empty string if err is nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
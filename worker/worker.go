@@ -2,118 +2,660 @@ package worker
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/secrets"
 	"golang.org/x/crypto/ssh"
 )
 
 // A Worker executes operations.
 type Worker struct {
+	// ModulesDir is the directory of the modules which are used if the master doesn't send the
+	// modules along with the operations.
 	ModulesDir string
+	// Secrets resolves the SSH keys and passwords referenced by ExecuteInput.
+	Secrets secrets.Provider
+	// KnownHostsFile is the path of an OpenSSH known_hosts file which is used for verifying the
+	// keys of hosts which don't have a pinned host key fingerprint. Optional.
+	KnownHostsFile string
+
+	// Cancels the executions which are in progress, by ID.
+	running map[string]context.CancelFunc
+	// IDs of executions which were cancelled before they started.
+	cancelled map[string]bool
+	// The latest version of each module which was sent by the master, by name. A module is parsed
+	// again only when its version changes.
+	modules map[string]*ops.Module
+	lock    sync.Mutex
 }
 
+// The time to wait for a script to exit after it is killed because it timed out or was cancelled.
+// If it doesn't exit in time, e.g. because the host stopped responding, the operation is reported
+// without waiting further.
+var killGracePeriod = 5 * time.Second
+
+// The port hosts are connected to over SSH.
+var sshPort = 22
+
 // ExecuteInput represents the input to the Execute function. It contains the hostname to connect
-// to, the SSH username, an SSH password and/or an SSH key, and finally one or more operations to
-// be executed on the host.
+// to, the SSH username, the names of an SSH password and/or an SSH key, and finally one or more
+// operations to be executed on the host. The key and password are resolved by the worker's secrets
+// provider, so credentials are never sent over the network.
 // If both an SSH key and a password are configured, the key will be preferred.
+//
+// HostKeyFingerprint is the host's pinned SSH host key fingerprint. If TrustOnFirstUse is set, the
+// key of a host which has no pinned fingerprint and isn't in the worker's known_hosts file is
+// accepted.
+//
+// ID identifies the execution for cancelling it using Cancel. If Timeout isn't 0, the operation
+// which is executing once Timeout has elapsed is killed and the remaining operations aren't
+// executed. If Check is set, the operations are executed in check mode (see ops.CheckEnv). Operations
+// whose module doesn't support check mode aren't executed then (see ops.Module.SupportsCheck).
+//
+// Variables are the host's variables, which are used for rendering the operations' scripts along
+// with the operations' attributes.
+//
+// Modules are the sources of the modules which the operations use. If Modules is empty, the
+// modules are read from the worker's ModulesDir.
 type ExecuteInput struct {
-	Hostname   string
-	User       string
-	Key        string
-	Password   string
-	Operations []ops.Operation
+	Hostname           string
+	User               string
+	KeyName            string
+	PasswordName       string
+	Operations         []ops.Operation
+	HostKeyFingerprint string
+	TrustOnFirstUse    bool
+	ID                 string
+	Timeout            time.Duration
+	Check              bool
+	Variables          map[string]string
+	Modules            []ops.ModuleSource
 }
 
 // ExecuteOutput represents the output returned by the Execute function. The output contains a
-// slice of OperationResults.
+// slice of OperationResults and the fingerprint of the SSH host key which was presented by the
+// host, if the host could be reached and the key was accepted.
 type ExecuteOutput struct {
-	Results []ops.OperationResult
+	Results            []ops.OperationResult
+	HostKeyFingerprint string
+}
+
+// PingInput represents the input to the Ping function.
+type PingInput struct {
+	Nonce int64
+}
+
+// PingOutput represents the output returned by the Ping function. It echoes the input's nonce.
+type PingOutput struct {
+	Nonce int64
+}
+
+// Ping is used by the master to check the health of the worker.
+func (w *Worker) Ping(in *PingInput, out *PingOutput) error {
+	out.Nonce = in.Nonce
+	return nil
 }
 
-// Execute executes one or more Operations on a remote host.
+// CancelInput represents the input to the Cancel function. ID is the ID of the execution to
+// cancel.
+type CancelInput struct {
+	ID string
+}
+
+// CancelOutput represents the output returned by the Cancel function. Running is true if the
+// execution was in progress when it was cancelled.
+type CancelOutput struct {
+	Running bool
+}
+
+// Cancel cancels an execution: the operation which is executing is killed and the remaining
+// operations aren't executed. Their results are marked with StatusCancelled. An execution which
+// hasn't started yet is cancelled as soon as it starts.
+func (w *Worker) Cancel(in *CancelInput, out *CancelOutput) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if cancel, ok := w.running[in.ID]; ok {
+		cancel()
+		out.Running = true
+		return nil
+	}
+	if w.cancelled == nil {
+		w.cancelled = make(map[string]bool)
+	}
+	w.cancelled[in.ID] = true
+
+	return nil
+}
+
+// Returns the context of an execution, which is done once the host's timeout expires or the
+// execution is cancelled. The returned function must be called once the execution completes.
+func (w *Worker) start(in *ExecuteInput) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if in.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), in.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	if in.ID == "" {
+		return ctx, cancel
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cancelled[in.ID] {
+		delete(w.cancelled, in.ID)
+		cancel()
+	}
+	if w.running == nil {
+		w.running = make(map[string]context.CancelFunc)
+	}
+	w.running[in.ID] = cancel
+
+	return ctx, func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.running, in.ID)
+		cancel()
+	}
+}
+
+// Returns the status and error of operations which were interrupted or not executed because the
+// host's context is done.
+func interrupted(ctx context.Context, in *ExecuteInput) (ops.Status, error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ops.StatusTimeout, fmt.Errorf("host timed out after %v", in.Timeout)
+	}
+	return ops.StatusCancelled, errors.New("execution cancelled")
+}
+
+// EventKind is the kind of an Event.
+type EventKind string
+
+// Event kinds.
+const (
+	// EventStarted is sent when an operation starts executing.
+	EventStarted EventKind = "started"
+	// EventOutput is sent for every chunk of output an operation writes to stdout or stderr.
+	EventOutput EventKind = "output"
+	// EventFinished is sent when an operation finishes executing.
+	EventFinished EventKind = "finished"
+)
+
+// An Event reports the progress of an operation while ExecuteStream runs.
+type Event struct {
+	Kind EventKind
+	// Index is the index of the operation in ExecuteInput.Operations.
+	Index int
+	// Stream is either "stdout" or "stderr" and Data is a chunk of output. Set for EventOutput.
+	Stream string
+	Data   string
+	// Result is the operation's result. Set for EventFinished.
+	Result ops.OperationResult
+	Time   time.Time
+}
+
+// Execute executes one or more Operations on a remote host. Failures are reported in the results
+// of the individual operations: if the host can't be reached, every operation is marked as
+// unreachable.
 func (w *Worker) Execute(in *ExecuteInput, out *ExecuteOutput) error {
+	return w.ExecuteStream(in, out, nil)
+}
+
+// ExecuteStream is like Execute, but it also calls events for every Event while the operations
+// execute. Calls to events are serialized. Events are sent only for operations which are
+// executed, so operations which fail because the host can't be reached have only a result.
+func (w *Worker) ExecuteStream(in *ExecuteInput, out *ExecuteOutput, events func(Event)) error {
+	ctx, done := w.start(in)
+	defer done()
+
+	order, err := ops.Plan(in.Operations)
+	if err != nil {
+		log.Printf("[%s] Invalid operations: %v", in.Hostname, err)
+		out.Results = failAll(in.Operations, ops.StatusError,
+			fmt.Errorf("invalid operation dependencies: %v", err))
+		return nil
+	}
+
+	// Load the modules and validate the operations against the manifests of their modules before
+	// connecting to the host. Operations which fail validation aren't executed.
+	modules, invalid := w.prepare(in)
+
+	var eventsLock sync.Mutex
+	emit := func(e Event) {
+		if events == nil {
+			return
+		}
+		e.Time = time.Now()
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		events(e)
+	}
+
 	// Initialize SSH connection to remote host
+	var hostKeyErr error
 	config := &ssh.ClientConfig{
 		User: in.User,
 		Auth: []ssh.AuthMethod{},
-		// The following line prevents the need to manually approve each remote host as a known
-		// host. This, however, poses a security risk and a better mechanism should probably be
-		// used in production.
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+		HostKeyCallback: func(addr string, remote net.Addr, key ssh.PublicKey) error {
+			// Keep the error since ssh.Dial doesn't preserve its type.
+			hostKeyErr = w.verifyHostKey(in, addr, remote, key)
+			if hostKeyErr == nil {
+				out.HostKeyFingerprint = ssh.FingerprintSHA256(key)
+			}
+			return hostKeyErr
+		},
+		Timeout: 10 * time.Second,
 	}
 
 	// Set SSH auth method(s)
-	if in.Key != "" {
-		k, err := parseKey([]byte(in.Key))
+	var authErr error
+	if in.KeyName != "" {
+		k, err := w.key(in.KeyName)
 		if err != nil {
-			return fmt.Errorf("could not parse SSH key: %v", err)
+			log.Printf("[%s] %v", in.Hostname, err)
+			// Not failing here because we might still be able to log in with a password.
+			authErr = err
+		} else {
+			config.Auth = append(config.Auth, k)
 		}
-		config.Auth = append(config.Auth, k)
 	}
-	if in.Password != "" {
-		config.Auth = append(config.Auth, ssh.Password(in.Password))
+	if in.PasswordName != "" {
+		p, err := w.secret(in.PasswordName)
+		if err != nil {
+			log.Printf("[%s] Could not resolve SSH password: %v", in.Hostname, err)
+			authErr = fmt.Errorf("could not resolve SSH password: %v", err)
+		} else {
+			config.Auth = append(config.Auth, ssh.Password(p))
+		}
+	}
+	if len(config.Auth) == 0 && authErr != nil {
+		out.Results = failAll(in.Operations, ops.StatusError, authErr)
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		status, err := interrupted(ctx, in)
+		out.Results = failAll(in.Operations, status, err)
+		return nil
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", in.Hostname), config)
+	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", in.Hostname, sshPort), config)
 	if err != nil {
-		return fmt.Errorf("failed to dial: %v", err)
+		log.Printf("[%s] Failed to dial: %v", in.Hostname, err)
+		switch hostKeyErr.(type) {
+		case nil:
+			out.Results = failAll(in.Operations, ops.StatusUnreachable,
+				fmt.Errorf("failed to dial: %v", err))
+		case *HostKeyMismatchError:
+			out.Results = failAll(in.Operations, ops.StatusHostKeyMismatch, hostKeyErr)
+		default:
+			out.Results = failAll(in.Operations, ops.StatusError, hostKeyErr)
+		}
+		return nil
 	}
+	defer client.Close()
 
-	// Execute operations
-	var results []ops.OperationResult
+	// Execute operations in dependency order. Results are kept in the order of in.Operations.
+	results := make([]ops.OperationResult, len(in.Operations))
+	// The facts reported by the operations which were executed so far.
+	facts := make(map[string]string)
 
-	for _, o := range in.Operations {
-		stdOut, stdErr, err := w.executeOperation(client, in.Hostname, o)
+	for n, i := range order {
+		o := in.Operations[i]
+		if ctx.Err() != nil {
+			log.Printf("[%s] Not executing the remaining %d operations: %v", in.Hostname,
+				len(order)-n, ctx.Err())
+			status, err := interrupted(ctx, in)
+			for _, j := range order[n:] {
+				results[j] = failedResult(in.Operations[j], status, err)
+			}
+			break
+		}
 
-		r := ops.OperationResult{Operation: o, StdOut: stdOut, StdErr: stdErr}
-		if err != nil {
-			log.Printf("Execution failed: %v", err)
-			if stdOut != "" {
-				log.Printf("stdout: %s", stdOut)
+		if err, ok := invalid[i]; ok {
+			log.Printf("[%s] Not executing operation %s: %v", in.Hostname, o.Description, err)
+			r := failedResult(o, ops.StatusError, err)
+			emit(Event{Kind: EventFinished, Index: i, Result: r})
+			results[i] = r
+			continue
+		}
+
+		if d := FailedDependency(o, in.Operations, results); d != "" {
+			log.Printf("[%s] Skipping operation %s since %s didn't succeed", in.Hostname,
+				o.Description, d)
+			r := failedResult(o, ops.StatusSkipped, fmt.Errorf("dependency %s didn't succeed", d))
+			emit(Event{Kind: EventFinished, Index: i, Result: r})
+			results[i] = r
+			continue
+		}
+
+		// A module which doesn't support check mode may change the host regardless.
+		if in.Check && !modules[i].SupportsCheck() {
+			log.Printf("[%s] Not executing operation %s in check mode: module %s doesn't support it",
+				in.Hostname, o.Description, o.ScriptName)
+			r := failedResult(o, ops.StatusUnsupported,
+				fmt.Errorf("module %s doesn't support check mode", o.ScriptName))
+			emit(Event{Kind: EventFinished, Index: i, Result: r})
+			results[i] = r
+			continue
+		}
+
+		emit(Event{Kind: EventStarted, Index: i})
+		r := w.executeOperation(ctx, in, client, o, modules[i], facts, func(stream, data string) {
+			emit(Event{Kind: EventOutput, Index: i, Stream: stream, Data: data})
+		})
+		for k, v := range r.Facts {
+			facts[k] = v
+		}
+		if !r.Successful {
+			log.Printf("[%s] Execution failed (%s): %s", in.Hostname, r.Status, r.FailureReason())
+			if r.StdOut != "" {
+				log.Printf("stdout: %s", r.StdOut)
 			}
-			if stdErr != "" {
-				log.Printf("stderr: %s", stdErr)
+			if r.StdErr != "" {
+				log.Printf("stderr: %s", r.StdErr)
 			}
-		} else {
-			r.Successful = true
 		}
-		results = append(results, r)
+		emit(Event{Kind: EventFinished, Index: i, Result: r})
+		results[i] = r
 	}
 	out.Results = results
 
 	return nil
 }
 
-// Executes one Operation on a remote host. The function sends back OperationResults or an error.
-func (w *Worker) executeOperation(c *ssh.Client, host string, o ops.Operation) (string, string, error) {
+// Loads the modules of the operations in in, validates the operations' attributes against the
+// manifests of their modules and fills in the defaults of their parameters. Returns the modules
+// by the index of the operation along with the errors of the operations which can't be executed.
+func (w *Worker) prepare(in *ExecuteInput) ([]*ops.Module, map[int]error) {
+	sources := make(map[string]ops.ModuleSource)
+	for _, s := range in.Modules {
+		sources[s.Name] = s
+	}
+
+	modules := make([]*ops.Module, len(in.Operations))
+	invalid := make(map[int]error)
+	for i, o := range in.Operations {
+		m, err := w.module(o.ScriptName, sources)
+		if err != nil {
+			invalid[i] = err
+			continue
+		}
+		modules[i] = m
+		if m.Manifest == nil {
+			continue
+		}
+		if in.Operations[i], err = m.Manifest.Apply(o, in.Variables); err != nil {
+			invalid[i] = err
+		}
+	}
+	return modules, invalid
+}
+
+// Returns the module with the given name. If the master sent the sources of the modules, the
+// module is parsed from its source unless the same version was parsed already. Otherwise, the
+// module is loaded from w.ModulesDir.
+func (w *Worker) module(name string, sources map[string]ops.ModuleSource) (*ops.Module, error) {
+	if len(sources) == 0 {
+		return ops.LoadModule(w.ModulesDir, name)
+	}
+	s, ok := sources[name]
+	if !ok {
+		return nil, fmt.Errorf("module %s wasn't sent by the master", name)
+	}
+
+	version := s.Version()
+	w.lock.Lock()
+	m, ok := w.modules[name]
+	w.lock.Unlock()
+	if ok && m.Version == version {
+		return m, nil
+	}
+
+	m, err := s.Parse()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded version %s of module %s", version, name)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.modules == nil {
+		w.modules = make(map[string]*ops.Module)
+	}
+	w.modules[name] = m
+	return m, nil
+}
+
+// Executes one Operation on a remote host and returns its result. The operation's script is
+// rendered from the module m with the given facts, which were reported by earlier operations.
+// Output is passed to output as it is received. The operation's script is killed once the
+// operation's timeout expires or ctx is done.
+func (w *Worker) executeOperation(ctx context.Context, in *ExecuteInput, c *ssh.Client, o ops.Operation, m *ops.Module, facts map[string]string, output func(stream, data string)) ops.OperationResult {
+	host := in.Hostname
 	log.Printf("[%s] Executing operation %s", host, o.Description)
+	r := ops.OperationResult{Operation: o, ExitCode: -1, StartTime: time.Now(),
+		ModuleVersion: m.Version}
+
+	script, err := m.Script(&o, ops.ScriptContext{
+		Check:     in.Check,
+		Hostname:  in.Hostname,
+		Variables: in.Variables,
+		Facts:     facts,
+	})
+	if err != nil {
+		r.Status = ops.StatusError
+		r.Error = err.Error()
+		r.EndTime = time.Now()
+		return r
+	}
+	if in.Check {
+		script = fmt.Sprintf("export %s=1\n%s", ops.CheckEnv, script)
+	}
+
 	// Initialize session (this needs to be done per operation).
 	sess, err := c.NewSession()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create session: %v", err)
+		r.Status = ops.StatusUnreachable
+		r.Error = fmt.Sprintf("failed to create session: %v", err)
+		r.EndTime = time.Now()
+		return r
 	}
 	defer sess.Close()
 
-	var stdOut, stdErr bytes.Buffer
+	stdOut := &outputBuffer{stream: "stdout", output: output}
+	stdErr := &outputBuffer{stream: "stderr", output: output}
+	sess.Stdout = stdOut
+	sess.Stderr = stdErr
 
-	sess.Stdout = &stdOut
-	sess.Stderr = &stdErr
-	script, err := o.Script(w.ModulesDir)
-	if err != nil {
-		return "", "", err
+	opCtx := ctx
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		opCtx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
 	}
 
 	log.Printf("Running the following script:\n%v", formatScriptOutput(script))
-	err = sess.Run(script)
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Run(script)
+	}()
+	select {
+	case err = <-done:
+	case <-opCtx.Done():
+		// Not all SSH servers support signals, so the session is closed as well.
+		log.Printf("[%s] Killing operation %s: %v", host, o.Description, opCtx.Err())
+		sess.Signal(ssh.SIGKILL)
+		sess.Close()
+		select {
+		case err = <-done:
+		case <-time.After(killGracePeriod):
+		}
+	}
+
+	// A killed session's output may still be copied after the grace period, so the output is
+	// closed before it is read.
+	r.StdOut = stdOut.close()
+	r.StdErr = stdErr.close()
+	r.EndTime = time.Now()
+
+	if opCtx.Err() != nil {
+		// The script was killed, or finished just as it was about to be.
+		switch {
+		case ctx.Err() != nil:
+			st, e := interrupted(ctx, in)
+			r.Status, r.Error = st, e.Error()
+		default:
+			r.Status = ops.StatusTimeout
+			r.Error = fmt.Sprintf("operation timed out after %v", o.Timeout)
+		}
+		if e, ok := err.(*ssh.ExitError); ok {
+			r.Signal = e.Signal()
+		}
+		return r
+	}
 
-	stdOutStr := string(stdOut.Bytes())
-	stdErrStr := string(stdErr.Bytes())
+	switch e := err.(type) {
+	case nil:
+		r.Status = ops.StatusOK
+		r.Successful = true
+		r.ExitCode = 0
+	case *ssh.ExitError:
+		// The script ran and exited with a non-zero exit code or was killed by a signal.
+		r.Status = ops.StatusFailed
+		r.Signal = e.Signal()
+		if r.Signal == "" {
+			r.ExitCode = e.ExitStatus()
+		}
+		if r.Signal == "" && r.ExitCode == ops.ChangedExitCode {
+			r.Status = ops.StatusChanged
+			r.Successful = true
+		}
+	default:
+		// The exit status wasn't received, e.g. because the connection was lost.
+		r.Status = ops.StatusUnreachable
+		r.Error = err.Error()
+		return r
+	}
+
+	// The script ran, so it may have reported a result.
+	if mr, stdout, ok := ops.ParseModuleResult(r.StdOut); ok {
+		r.StdOut = stdout
+		r.Facts = mr.Facts
+		r.Message = mr.Msg
+		if mr.Changed && r.Status == ops.StatusOK {
+			r.Status = ops.StatusChanged
+		}
+	}
+	r.Changed = r.Status == ops.StatusChanged
+
+	return r
+}
+
+// An outputBuffer stores everything written to it and passes it to a function along with the name
+// of the stream. Once the buffer is closed, writes are discarded.
+type outputBuffer struct {
+	stream string
+	output func(stream, data string)
+
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.closed {
+		b.buf.Write(p)
+		b.output(b.stream, string(p))
+	}
+	return len(p), nil
+}
+
+// Closes the buffer and returns its contents. output isn't called once close returns.
+func (b *outputBuffer) close() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	return b.buf.String()
+}
+
+// Returns a result with the given status for each of the given operations. This is used when
+// none of the operations can be executed.
+func failAll(operations []ops.Operation, status ops.Status, err error) []ops.OperationResult {
+	var results []ops.OperationResult
+	for _, o := range operations {
+		results = append(results, failedResult(o, status, err))
+	}
+	return results
+}
+
+// Returns the result of an operation which wasn't executed.
+func failedResult(o ops.Operation, status ops.Status, err error) ops.OperationResult {
+	now := time.Now()
+	return ops.OperationResult{
+		Operation: o,
+		Status:    status,
+		ExitCode:  -1,
+		Error:     err.Error(),
+		StartTime: now,
+		EndTime:   now,
+	}
+}
+
+// FailedDependency returns the description of a dependency of o which didn't succeed, or "" if all
+// of o's dependencies succeeded. The dependencies must have been executed already, and results
+// holds the result of each of the given operations.
+func FailedDependency(o ops.Operation, operations []ops.Operation, results []ops.OperationResult) string {
+	for _, d := range o.DependsOn {
+		for i, dep := range operations {
+			if dep.Description == d && !results[i].Successful {
+				return d
+			}
+		}
+	}
+	return ""
+}
+
+// Resolves the SSH key with the given name and returns an ssh.AuthMethod.
+func (w *Worker) key(name string) (ssh.AuthMethod, error) {
+	s, err := w.secret(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve SSH key: %v", err)
+	}
+
+	k, err := parseKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse SSH key: %v", err)
+	}
+
+	return k, nil
+}
+
+// Resolves the secret with the given name using the worker's secrets provider.
+func (w *Worker) secret(name string) (string, error) {
+	if w.Secrets == nil {
+		return "", fmt.Errorf("no secrets provider configured for secret %q", name)
+	}
+
+	s, err := w.Secrets.Secret(name)
+	if err == secrets.ErrNotFound {
+		return "", fmt.Errorf("secret %q not found", name)
+	}
 
-	return stdOutStr, stdErrStr, err
+	return s, err
 }
 
 // Parses a private key and returns an ssh.AuthMethod.
@@ -0,0 +1,645 @@
+package worker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	ops "github.com/johananl/simple-cm/operations"
+	"github.com/johananl/simple-cm/secrets"
+	"golang.org/x/crypto/ssh"
+)
+
+// A secrets provider which resolves secrets from a map.
+type testSecrets map[string]string
+
+func (s testSecrets) Secret(name string) (string, error) {
+	v, ok := s[name]
+	if !ok {
+		return "", secrets.ErrNotFound
+	}
+	return v, nil
+}
+
+// A testServer is an SSH server which executes the commands of sessions using the local shell. It
+// accepts the password "secret" for any user.
+type testServer struct {
+	hostKey  ssh.Signer
+	listener net.Listener
+}
+
+// Starts a testServer and points the worker's SSH connections at it. The returned function stops
+// the server.
+func startTestServer(t *testing.T) (*testServer, func()) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Error creating host key signer: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+
+	s := &testServer{hostKey: hostKey, listener: l}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c, config)
+		}
+	}()
+
+	port := sshPort
+	sshPort = l.Addr().(*net.TCPAddr).Port
+	return s, func() {
+		l.Close()
+		sshPort = port
+	}
+}
+
+func (s *testServer) serve(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, requests)
+	}
+}
+
+// Signal names by signal, as sent in exit-signal requests.
+var signalNames = map[syscall.Signal]string{syscall.SIGKILL: "KILL", syscall.SIGTERM: "TERM"}
+
+// Executes the command of a session and reports its exit status. The command and the processes
+// it starts are killed if a signal is received or once the session is closed.
+func (s *testServer) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	var lock sync.Mutex
+	var cmd *exec.Cmd
+	kill := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if cmd != nil && cmd.Process != nil {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	defer kill()
+
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			lock.Lock()
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			err := cmd.Start()
+			lock.Unlock()
+			if err != nil {
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{127}))
+				ch.Close()
+				continue
+			}
+			go func(cmd *exec.Cmd) {
+				cmd.Wait()
+				ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
+				if ws.Signaled() {
+					ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: signalNames[ws.Signal()]}))
+				} else {
+					ch.SendRequest("exit-status", false,
+						ssh.Marshal(struct{ Status uint32 }{uint32(ws.ExitStatus())}))
+				}
+				ch.Close()
+			}(cmd)
+		case "signal":
+			kill()
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// Returns an ExecuteInput for executing the given operations on the test server. Every operation
+// uses the module whose name is its description, and modules holds the modules' scripts.
+func testInput(operations []ops.Operation, modules map[string]string) ExecuteInput {
+	in := ExecuteInput{
+		Hostname:        "127.0.0.1",
+		User:            "test",
+		PasswordName:    "password",
+		TrustOnFirstUse: true,
+	}
+	for _, o := range operations {
+		o.ScriptName = o.Description
+		in.Operations = append(in.Operations, o)
+	}
+	for name, script := range modules {
+		in.Modules = append(in.Modules, ops.ModuleSource{Name: name, Script: []byte(script)})
+	}
+	return in
+}
+
+func testWorker() *Worker {
+	return &Worker{Secrets: testSecrets{"password": "secret"}}
+}
+
+func TestExecuteResults(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	for _, tc := range []struct {
+		script string
+		want   ops.OperationResult
+	}{
+		{"echo out; echo err >&2", ops.OperationResult{Status: ops.StatusOK, Successful: true,
+			StdOut: "out\n", StdErr: "err\n"}},
+		{"echo out; exit 3", ops.OperationResult{Status: ops.StatusFailed, ExitCode: 3,
+			StdOut: "out\n"}},
+		{"kill -KILL $$", ops.OperationResult{Status: ops.StatusFailed, ExitCode: -1,
+			Signal: "KILL"}},
+		{"echo {{.missing}}", ops.OperationResult{Status: ops.StatusError, ExitCode: -1}},
+	} {
+		in := testInput([]ops.Operation{{Description: "op"}}, map[string]string{"op": tc.script})
+		var out ExecuteOutput
+		if err := testWorker().Execute(&in, &out); err != nil {
+			t.Fatalf("Error executing operations: %v", err)
+		}
+		if len(out.Results) != 1 {
+			t.Fatalf("%s: wrong number of results: got %d", tc.script, len(out.Results))
+		}
+		got := out.Results[0]
+		if got.Status != tc.want.Status || got.Successful != tc.want.Successful ||
+			got.ExitCode != tc.want.ExitCode || got.Signal != tc.want.Signal ||
+			got.StdOut != tc.want.StdOut || got.StdErr != tc.want.StdErr {
+			t.Errorf("%s: wrong result: got %+v", tc.script, got)
+		}
+		if tc.want.Status == ops.StatusError && got.Error == "" {
+			t.Errorf("%s: missing error", tc.script)
+		}
+		if got.ModuleVersion != in.Modules[0].Version() {
+			t.Errorf("%s: wrong module version: got %s", tc.script, got.ModuleVersion)
+		}
+	}
+}
+
+func TestExecuteUnreachable(t *testing.T) {
+	// Nothing listens on the port of a closed listener.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	port := sshPort
+	sshPort = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	defer func() { sshPort = port }()
+
+	in := testInput([]ops.Operation{{Description: "op1"}, {Description: "op2"}},
+		map[string]string{"op1": "true", "op2": "true"})
+	var out ExecuteOutput
+	if err := testWorker().Execute(&in, &out); err != nil {
+		t.Fatalf("Error executing operations: %v", err)
+	}
+	if len(out.Results) != 2 {
+		t.Fatalf("Wrong number of results: got %d", len(out.Results))
+	}
+	for _, r := range out.Results {
+		if r.Status != ops.StatusUnreachable || r.Error == "" {
+			t.Errorf("Wrong result: got %+v", r)
+		}
+	}
+}
+
+// Checks that no output events of an operation were sent after the operation finished.
+func checkEventOrder(t *testing.T, events []Event) {
+	finished := make(map[int]bool)
+	for _, e := range events {
+		switch {
+		case e.Kind == EventFinished:
+			finished[e.Index] = true
+		case finished[e.Index]:
+			t.Errorf("Event %+v sent after operation %d finished", e, e.Index)
+		}
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	for _, tc := range []struct {
+		name        string
+		hostTimeout time.Duration
+		opTimeout   time.Duration
+		want        []ops.Status
+		wantErr     []string
+	}{
+		// The timed out operation is killed and the next operation is executed.
+		{"operation timeout", 0, 200 * time.Millisecond,
+			[]ops.Status{ops.StatusTimeout, ops.StatusOK},
+			[]string{"operation timed out after 200ms", ""}},
+		// The remaining operations aren't executed.
+		{"host timeout", 200 * time.Millisecond, 0,
+			[]ops.Status{ops.StatusTimeout, ops.StatusTimeout},
+			[]string{"host timed out after 200ms", "host timed out after 200ms"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The first operation writes output until it is killed.
+			in := testInput([]ops.Operation{{Description: "op1", Timeout: tc.opTimeout},
+				{Description: "op2"}},
+				map[string]string{"op1": "while true; do echo output; done", "op2": "true"})
+			in.Timeout = tc.hostTimeout
+			var out ExecuteOutput
+			var events []Event
+			start := time.Now()
+			err := testWorker().ExecuteStream(&in, &out, func(e Event) { events = append(events, e) })
+			if err != nil {
+				t.Fatalf("Error executing operations: %v", err)
+			}
+			if d := time.Since(start); d > killGracePeriod {
+				t.Errorf("Execution took %v", d)
+			}
+			if len(out.Results) != 2 {
+				t.Fatalf("Wrong number of results: got %d", len(out.Results))
+			}
+			for i, r := range out.Results {
+				if r.Status != tc.want[i] || r.Error != tc.wantErr[i] {
+					t.Errorf("Wrong result %d: got %s %q want %s %q", i, r.Status, r.Error,
+						tc.want[i], tc.wantErr[i])
+				}
+			}
+			if !strings.HasPrefix(out.Results[0].StdOut, "output\n") {
+				t.Errorf("Wrong output: got %q", out.Results[0].StdOut)
+			}
+			checkEventOrder(t, events)
+		})
+	}
+}
+
+func TestExecuteCancel(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	w := testWorker()
+	in := testInput([]ops.Operation{{Description: "op1"}, {Description: "op2"}},
+		map[string]string{"op1": "echo started; while true; do echo output; done", "op2": "true"})
+	in.ID = "execution1"
+
+	started := make(chan struct{})
+	var once sync.Once
+	var events []Event
+	var out ExecuteOutput
+	done := make(chan error)
+	go func() {
+		done <- w.ExecuteStream(&in, &out, func(e Event) {
+			events = append(events, e)
+			if e.Kind == EventOutput {
+				once.Do(func() { close(started) })
+			}
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Operation didn't start")
+	}
+	var cancelOut CancelOutput
+	if err := w.Cancel(&CancelInput{ID: in.ID}, &cancelOut); err != nil || !cancelOut.Running {
+		t.Fatalf("Wrong cancellation: got %+v, %v", cancelOut, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Error executing operations: %v", err)
+	}
+
+	for _, r := range out.Results {
+		if r.Status != ops.StatusCancelled || r.Error != "execution cancelled" {
+			t.Errorf("Wrong result: got %s %q", r.Status, r.Error)
+		}
+	}
+	checkEventOrder(t, events)
+
+	// An execution which is cancelled before it starts isn't executed.
+	in.ID = "execution2"
+	cancelOut = CancelOutput{}
+	if err := w.Cancel(&CancelInput{ID: in.ID}, &cancelOut); err != nil || cancelOut.Running {
+		t.Fatalf("Wrong cancellation: got %+v, %v", cancelOut, err)
+	}
+	out = ExecuteOutput{}
+	if err := w.Execute(&in, &out); err != nil {
+		t.Fatalf("Error executing operations: %v", err)
+	}
+	for _, r := range out.Results {
+		if r.Status != ops.StatusCancelled || r.StdOut != "" {
+			t.Errorf("Wrong result: got %+v", r)
+		}
+	}
+}
+
+// Starts a proxy in front of the worker's SSH port which stops forwarding traffic from the worker
+// to the host once *stalled is set to 1, as if the host stopped responding, while traffic from the
+// host is still forwarded. The returned function stops the proxy.
+func startStallingProxy(t *testing.T, stalled *int32) func() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(sshPort))
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(c, upstream)
+				buf := make([]byte, 32*1024)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					if atomic.LoadInt32(stalled) == 0 {
+						upstream.Write(buf[:n])
+					}
+				}
+			}()
+		}
+	}()
+
+	port := sshPort
+	sshPort = l.Addr().(*net.TCPAddr).Port
+	return func() {
+		l.Close()
+		sshPort = port
+	}
+}
+
+func TestExecuteUnresponsiveHost(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+	var stalled int32
+	stopProxy := startStallingProxy(t, &stalled)
+	defer stopProxy()
+	defer func(d time.Duration) { killGracePeriod = d }(killGracePeriod)
+	killGracePeriod = 100 * time.Millisecond
+
+	// The host stops responding once the operation writes output, so the operation can't be killed
+	// and its output keeps arriving after it is reported.
+	in := testInput([]ops.Operation{{Description: "op1"}, {Description: "op2"}},
+		map[string]string{"op1": "while true; do echo output; sleep 0.01; done", "op2": "true"})
+	in.Timeout = 200 * time.Millisecond
+	var out ExecuteOutput
+	var events []Event
+	err := testWorker().ExecuteStream(&in, &out, func(e Event) {
+		if e.Kind == EventOutput {
+			atomic.StoreInt32(&stalled, 1)
+		}
+		events = append(events, e)
+	})
+	if err != nil {
+		t.Fatalf("Error executing operations: %v", err)
+	}
+
+	if len(out.Results) != 2 {
+		t.Fatalf("Wrong number of results: got %d", len(out.Results))
+	}
+	for _, r := range out.Results {
+		if r.Status != ops.StatusTimeout {
+			t.Errorf("Wrong result: got %s %q", r.Status, r.Error)
+		}
+	}
+	if !strings.HasPrefix(out.Results[0].StdOut, "output\n") {
+		t.Errorf("Wrong output: got %q", out.Results[0].StdOut)
+	}
+	checkEventOrder(t, events)
+}
+
+func TestExecuteSkipsDependents(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	// op2 depends on the failing op1 and op3 depends on op2. op4 is independent.
+	in := testInput([]ops.Operation{
+		{Description: "op3", DependsOn: []string{"op2"}},
+		{Description: "op2", DependsOn: []string{"op1"}},
+		{Description: "op1"},
+		{Description: "op4"},
+	}, map[string]string{"op1": "exit 1", "op2": "echo op2", "op3": "echo op3", "op4": "echo op4"})
+	var out ExecuteOutput
+	var events []Event
+	err := testWorker().ExecuteStream(&in, &out, func(e Event) { events = append(events, e) })
+	if err != nil {
+		t.Fatalf("Error executing operations: %v", err)
+	}
+
+	want := []struct {
+		status ops.Status
+		err    string
+	}{
+		{ops.StatusSkipped, "dependency op2 didn't succeed"},
+		{ops.StatusSkipped, "dependency op1 didn't succeed"},
+		{ops.StatusFailed, ""},
+		{ops.StatusOK, ""},
+	}
+	if len(out.Results) != len(want) {
+		t.Fatalf("Wrong number of results: got %d", len(out.Results))
+	}
+	for i, r := range out.Results {
+		if r.Status != want[i].status || r.Error != want[i].err ||
+			r.Operation.Description != in.Operations[i].Description {
+			t.Errorf("Wrong result %d: got %s %s %q", i, r.Operation.Description, r.Status, r.Error)
+		}
+	}
+
+	// Skipped operations are reported, but never started.
+	for _, e := range events {
+		if e.Kind == EventStarted && (e.Index == 0 || e.Index == 1) {
+			t.Errorf("Skipped operation %d was started", e.Index)
+		}
+	}
+}
+
+func TestExecuteModuleResults(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	for _, tc := range []struct {
+		name   string
+		script string
+		want   ops.OperationResult
+	}{
+		{"changed exit code", "echo out; exit 80", ops.OperationResult{Status: ops.StatusChanged,
+			Successful: true, Changed: true, ExitCode: 80, StdOut: "out\n"}},
+		{"result line", `echo out; echo '{"changed": true, "facts": {"version": "1.2.3", "n": 1}, "msg": "Upgraded"}'`,
+			ops.OperationResult{Status: ops.StatusChanged, Successful: true, Changed: true,
+				StdOut: "out\n", Facts: map[string]string{"version": "1.2.3", "n": "1"},
+				Message: "Upgraded"}},
+		{"unchanged result line", `echo '{"facts": {"version": "1.2.3"}}'`,
+			ops.OperationResult{Status: ops.StatusOK, Successful: true,
+				Facts: map[string]string{"version": "1.2.3"}}},
+		// Only the last line is a result.
+		{"not a result line", `echo '{"changed": true}'; echo out`, ops.OperationResult{
+			Status: ops.StatusOK, Successful: true, StdOut: "{\"changed\": true}\nout\n"}},
+		// A failed module may still report a message.
+		{"failed result line", `echo '{"msg": "No space left"}'; exit 1`, ops.OperationResult{
+			Status: ops.StatusFailed, ExitCode: 1, Message: "No space left"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := testInput([]ops.Operation{{Description: "op"}}, map[string]string{"op": tc.script})
+			var out ExecuteOutput
+			if err := testWorker().Execute(&in, &out); err != nil {
+				t.Fatalf("Error executing operations: %v", err)
+			}
+			got := out.Results[0]
+			if got.Status != tc.want.Status || got.Successful != tc.want.Successful ||
+				got.Changed != tc.want.Changed || got.ExitCode != tc.want.ExitCode ||
+				got.StdOut != tc.want.StdOut || got.Message != tc.want.Message ||
+				!reflect.DeepEqual(got.Facts, tc.want.Facts) {
+				t.Errorf("Wrong result: got %+v", got)
+			}
+		})
+	}
+}
+
+func TestExecuteFacts(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	// Facts reported by an operation are available to the operations which are executed after it.
+	in := testInput([]ops.Operation{
+		{Description: "op2", DependsOn: []string{"op1"}},
+		{Description: "op1"},
+	}, map[string]string{
+		"op1": `echo '{"facts": {"version": "1.2.3"}}'`,
+		"op2": "echo {{.Facts.version}}",
+	})
+	var out ExecuteOutput
+	if err := testWorker().Execute(&in, &out); err != nil {
+		t.Fatalf("Error executing operations: %v", err)
+	}
+	if r := out.Results[0]; r.Status != ops.StatusOK || r.StdOut != "1.2.3\n" {
+		t.Fatalf("Wrong result: got %+v", r)
+	}
+}
+
+func TestExecuteCheck(t *testing.T) {
+	_, stop := startTestServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "simplecm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changed")
+
+	// "env" declares check support in its manifest and reads CheckEnv, "tmpl" uses the check
+	// function and "unsupported" ignores check mode, so it must not be executed in check mode.
+	script := `echo "check=${` + ops.CheckEnv + `:-0}"; if [ -n "$` + ops.CheckEnv + `" ]; then exit 80; fi`
+	modules := map[string]string{
+		"env":         script,
+		"tmpl":        "{{if check}}exit 80{{end}}",
+		"unsupported": "touch " + path,
+		"dependent":   "true",
+	}
+	operations := []ops.Operation{
+		{Description: "env"},
+		{Description: "tmpl"},
+		{Description: "unsupported"},
+		{Description: "dependent", DependsOn: []string{"unsupported"}},
+	}
+	for _, tc := range []struct {
+		check  bool
+		want   []ops.Status
+		stdout string
+	}{
+		{false, []ops.Status{ops.StatusOK, ops.StatusOK, ops.StatusOK, ops.StatusOK}, "check=0\n"},
+		{true, []ops.Status{ops.StatusChanged, ops.StatusChanged, ops.StatusUnsupported,
+			ops.StatusSkipped}, "check=1\n"},
+	} {
+		os.Remove(path)
+		in := testInput(operations, modules)
+		for i := range in.Modules {
+			if in.Modules[i].Name == "env" {
+				in.Modules[i].Manifest = []byte(`{"check": true}`)
+			}
+		}
+		in.Check = tc.check
+		var out ExecuteOutput
+		if err := testWorker().Execute(&in, &out); err != nil {
+			t.Fatalf("Error executing operations: %v", err)
+		}
+		for i, r := range out.Results {
+			if r.Status != tc.want[i] {
+				t.Errorf("Check %t: wrong status of %s: got %s want %s (%s)", tc.check,
+					r.Operation.Description, r.Status, tc.want[i], r.Error)
+			}
+		}
+		if r := out.Results[0]; r.StdOut != tc.stdout {
+			t.Errorf("Check %t: wrong stdout: got %q want %q", tc.check, r.StdOut, tc.stdout)
+		}
+		_, err := os.Stat(path)
+		if executed := err == nil; executed == tc.check {
+			t.Errorf("Check %t: module without check support executed: %t", tc.check, executed)
+		}
+	}
+}